@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+/*
+announce_peer, see http://www.bittorrent.org/beps/bep_0005.html
+先迭代 get_peers 找到离infohash最近的K个节点，再用它们各自返回的token发送
+announce_peer，token是对方给的，不是自己生成的
+*/
+
+const (
+	// announceInterval is how often the infohashes of AnnouncePeerLists are
+	// announced again.
+	announceInterval = time.Minute * 15
+	// announceTimeout is how long the periodic announce waits.
+	announceTimeout = time.Minute
+)
+
+// ErrNotAnnounced is returned by Announce when no node accepts it.
+var ErrNotAnnounced = errors.New("dht: no node accepts the announce")
+
+// AnnounceResult is the result of announce_peer sent to one node.
+type AnnounceResult struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+	// Err is nil when the node accepts it, a *KRPCError when the node refuses
+	// it, or ErrNoResponse
+	Err error
+}
+
+/*
+Announce announces that the peer on port has infoHash. It looks up infoHash
+with get_peers, then sends announce_peer to the K closest nodes answering,
+with the token each of them gives. When impliedPort is set, the nodes use
+the source port of the udp packet instead of port, which works behind NAT.
+It returns the result of every node, and ErrNotAnnounced when none accepts
+it. infoHash is the 20-length raw or 40-length hex string.
+*/
+func (dht *DHT) Announce(ctx context.Context, infoHash string, port int,
+	impliedPort bool) ([]*AnnounceResult, error) {
+
+	infoHash, err := parseInfoHash(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	if port <= 0 || port > 65535 {
+		if !impliedPort {
+			return nil, errors.New("dht: invalid port")
+		}
+		port = 0
+	}
+
+	responses, err := dht.lookup(ctx, getPeersType, infoHash,
+		dht.getPeersArgs(infoHash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	implied := 0
+	if impliedPort {
+		implied = 1
+	}
+	nodes, errs := dht.queryClosest(ctx, responses, announcePeerType,
+		func(token string) map[string]interface{} {
+			return map[string]interface{}{
+				"id":           dht.id(infoHash),
+				"info_hash":    infoHash,
+				"implied_port": implied,
+				"port":         port,
+				"token":        token,
+			}
+		})
+
+	results := make([]*AnnounceResult, len(nodes))
+	announced := false
+	for i, no := range nodes {
+		results[i] = &AnnounceResult{Addr: no.addr, Err: errs[i]}
+		copy(results[i].ID[:], no.id.RawString())
+		announced = announced || errs[i] == nil
+	}
+
+	if !announced {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		return results, ErrNotAnnounced
+	}
+	return results, nil
+}
+
+// doAnnouncePeer announces the infohashes of AnnouncePeerLists.
+func (dht *DHT) doAnnouncePeer() {
+	for _, infoHash := range append([]string(nil), dht.AnnouncePeerLists...) {
+		dht.announceInBackground(infoHash)
+	}
+}
+
+// announceInBackground announces infoHash with the port of the dht, the
+// result is ignored.
+func (dht *DHT) announceInBackground(infoHash string) {
+	addr, ok := dht.Addr().(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	dht.spawn(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+		defer cancel()
+
+		dht.Announce(ctx, infoHash, addr.Port, true)
+	})
+}
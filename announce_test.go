@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnnounce(t *testing.T) {
+	nodes := startTestChain(t, 3)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	infoHash := randomString(20)
+	results, err := nodes[0].Announce(ctx, infoHash, 6881, false)
+	if err != nil || len(results) != 2 {
+		t.Fatal(len(results), err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Error(r.Addr, r.Err)
+		}
+	}
+	for _, d := range nodes[1:] {
+		peers := d.peersManager.GetPeers(infoHash, d.K)
+		if len(peers) != 1 || peers[0].Port != 6881 {
+			t.Error("peer is not stored", peers)
+		}
+	}
+
+	// implied_port 使用udp包的源端口
+	infoHash = randomString(20)
+	if _, err := nodes[0].Announce(ctx, infoHash, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	port := nodes[0].Addr().(*net.UDPAddr).Port
+	if peers := nodes[2].peersManager.GetPeers(infoHash, 8); len(peers) != 1 ||
+		peers[0].Port != port {
+		t.Error("implied port", peers)
+	}
+
+	if _, err := nodes[0].Announce(ctx, infoHash, 0, false); err == nil {
+		t.Error("invalid port is announced")
+	}
+}
+
+func TestAnnounceInvalidToken(t *testing.T) {
+	a, b := startTestPair(t)
+	defer a.Stop()
+	defer b.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	no, _ := newNode(b.node.id.RawString(), "udp4", b.Addr().String())
+	infoHash := randomString(20)
+	_, errs := a.queryClosest(ctx, []*lookupResponse{{node: no, token: "bad"}},
+		announcePeerType, func(token string) map[string]interface{} {
+			return map[string]interface{}{
+				"id":        a.node.id.RawString(),
+				"info_hash": infoHash,
+				"port":      6881,
+				"token":     token,
+			}
+		})
+	if len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	if e, ok := errs[0].(*KRPCError); !ok || e.Code != protocolError {
+		t.Error(errs[0])
+	}
+}
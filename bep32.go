@@ -0,0 +1,265 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+/*
+BEP 32, IPv6 extension for DHT.
+See http://www.bittorrent.org/beps/bep_0032.html
+ipv4和ipv6节点分别保存在两个路由表中，find_node、get_peers 通过 want 请求
+nodes（ipv4）和 nodes6（ipv6），Network 为 udp 时同时运行两种协议
+*/
+
+const (
+	// compactNodeInfoLen is the length of a ipv4 node in `nodes`.
+	compactNodeInfoLen = 26
+	// compactNodeInfo6Len is the length of a ipv6 node in `nodes6`.
+	compactNodeInfo6Len = 38
+)
+
+var errCompactNodesLength = errors.New(
+	"the length of nodes should can be divided by 26, nodes6 by 38")
+
+// isIPv4 returns whether ip is a ipv4 address, which may be stored in 16
+// bytes.
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+/*
+setFamilies decides which ip families the dht runs from Network and the
+address the conn listens on. A "udp" conn on the unspecified ipv6 address is
+dual stack, ipv4 packets come as ipv4-mapped addresses.
+*/
+func (dht *DHT) setFamilies(laddr net.Addr) {
+	switch dht.Network {
+	case "udp4":
+		dht.ipv4, dht.ipv6 = true, false
+	case "udp6":
+		dht.ipv4, dht.ipv6 = false, true
+	default:
+		var ip net.IP
+		if addr, err := toUDPAddr(laddr); err == nil {
+			ip = addr.IP
+		}
+		dht.ipv4 = ip == nil || ip.Equal(net.IPv6unspecified) || isIPv4(ip)
+		dht.ipv6 = ip == nil || !isIPv4(ip)
+	}
+}
+
+// IsDualStack returns whether the dht runs both ipv4 and ipv6.
+func (dht *DHT) IsDualStack() bool {
+	return dht.ipv4 && dht.ipv6
+}
+
+// resolveNetwork returns the network to resolve the addresses of nodes.
+func (dht *DHT) resolveNetwork() string {
+	switch {
+	case dht.IsDualStack():
+		return "udp"
+	case dht.ipv6:
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// table returns the routing table of ip's family, or nil if the dht doesn't
+// run that family.
+func (dht *DHT) table(ip net.IP) *routingTable {
+	if isIPv4(ip) {
+		if dht.ipv4 {
+			return dht.routingTable
+		}
+	} else if dht.ipv6 {
+		return dht.routingTable6
+	}
+	return nil
+}
+
+// tables returns the routing tables of the families the dht runs.
+func (dht *DHT) tables() []*routingTable {
+	tables := make([]*routingTable, 0, 2)
+	if dht.ipv4 {
+		tables = append(tables, dht.routingTable)
+	}
+	if dht.ipv6 {
+		tables = append(tables, dht.routingTable6)
+	}
+	return tables
+}
+
+// tablesLen returns the number of nodes in all routing tables.
+func (dht *DHT) tablesLen() (n int) {
+	for _, rt := range dht.tables() {
+		n += rt.Len()
+	}
+	return
+}
+
+// insertNode adds no to the routing table of its family.
+func (dht *DHT) insertNode(no *node) bool {
+	if rt := dht.table(no.addr.IP); rt != nil {
+		return rt.Insert(no)
+	}
+	return false
+}
+
+// removeByAddr removes the node whose address is addr from the routing table.
+func (dht *DHT) removeByAddr(addr *net.UDPAddr) {
+	if rt := dht.table(addr.IP); rt != nil {
+		rt.RemoveByAddr(addr.String())
+	}
+}
+
+// getNodeByAddress finds node by address in the routing table of its family.
+func (dht *DHT) getNodeByAddress(addr *net.UDPAddr) (*node, bool) {
+	if rt := dht.table(addr.IP); rt != nil {
+		return rt.GetNodeByAddress(addr.String())
+	}
+	return nil, false
+}
+
+// getNeighbors returns the size-length nodes closest to id of every family.
+func (dht *DHT) getNeighbors(id *bitmap, size int) []*node {
+	var nodes []*node
+	for _, rt := range dht.tables() {
+		nodes = append(nodes, rt.GetNeighbors(id, size)...)
+	}
+	return nodes
+}
+
+// want returns the `want` of queries, nil if the dht runs only one family.
+func (dht *DHT) want() []interface{} {
+	if !dht.IsDualStack() {
+		return nil
+	}
+	return []interface{}{"n4", "n6"}
+}
+
+/*
+peerValues returns the `values` of get_peers response, the peers of
+infoHash in the family of addr. The seeds are left out when noseed is
+set, see BEP 33.
+*/
+func (dht *DHT) peerValues(infoHash string, addr *net.UDPAddr,
+	noseed bool) []interface{} {
+
+	peers := dht.peersManager.GetPeers(infoHash, dht.K)
+	values := make([]interface{}, 0, len(peers))
+
+	for _, p := range peers {
+		if isIPv4(p.IP) == isIPv4(addr.IP) && !(noseed && p.Seed) {
+			values = append(values, p.CompactIPPortInfo())
+		}
+	}
+	return values
+}
+
+/*
+parseWant returns which families the querying node wants. Without `want`
+it is the family the query comes from.
+*/
+func parseWant(a map[string]interface{}, addr *net.UDPAddr) (n4, n6 bool) {
+	if err := ParseKey(a, "want", "list"); err != nil {
+		return isIPv4(addr.IP), !isIPv4(addr.IP)
+	}
+
+	for _, v := range a["want"].([]interface{}) {
+		switch v {
+		case "n4":
+			n4 = true
+		case "n6":
+			n6 = true
+		}
+	}
+	return
+}
+
+/*
+setCompactNodes sets `nodes` and `nodes6` of the response r to the nodes
+closest to target, the node whose id is target only when it is known.
+没有运行的协议不返回
+*/
+func (dht *DHT) setCompactNodes(r map[string]interface{}, target *bitmap,
+	n4, n6 bool) {
+
+	compact := func(rt *routingTable) string {
+		if no, _ := rt.GetNodeKBucktByID(target); no != nil {
+			return no.CompactNodeInfo()
+		}
+		return strings.Join(rt.GetNeighborCompactInfos(target, dht.K), "")
+	}
+
+	if n4 && dht.ipv4 {
+		r["nodes"] = compact(dht.routingTable)
+	}
+	if n6 && dht.ipv6 {
+		r["nodes6"] = compact(dht.routingTable6)
+	}
+}
+
+// insertCompactNodes puts the nodes of the response r into the routing tables.
+func (dht *DHT) insertCompactNodes(r map[string]interface{}) {
+	if nodes, err := dht.parseCompactNodes(r); err == nil {
+		for _, no := range nodes {
+			dht.insertNode(no)
+		}
+	}
+}
+
+/*
+parseCompactNodes returns the nodes in `nodes` and `nodes6` of the response
+r. The fields are parsed on their own, one with a wrong length is skipped.
+It returns an error when neither is a valid field.
+*/
+func (dht *DHT) parseCompactNodes(r map[string]interface{}) ([]*node, error) {
+	fields := []struct {
+		key  string
+		size int
+		on   bool
+	}{
+		{"nodes", compactNodeInfoLen, dht.ipv4},
+		{"nodes6", compactNodeInfo6Len, dht.ipv6},
+	}
+
+	var (
+		nodes []*node
+		err   error
+		found bool
+	)
+	for _, f := range fields {
+		if e := ParseKey(r, f.key, "string"); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+
+		info := r[f.key].(string)
+		// 长度必须是26（ipv6为38）的倍数，不对只丢弃这个字段
+		if len(info)%f.size != 0 {
+			err = errCompactNodesLength
+			continue
+		}
+		found = true
+		if !f.on {
+			continue
+		}
+
+		for i := 0; i < len(info)/f.size; i++ {
+			no, e := newNodeFromCompactInfo(info[i*f.size : (i+1)*f.size])
+			if e != nil {
+				continue
+			}
+			nodes = append(nodes, no)
+		}
+	}
+
+	if !found {
+		return nil, err
+	}
+	return nodes, nil
+}
@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCompactIPPortInfo6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+
+	info, err := encodeCompactIPPortInfo(ip, 6881)
+	if err != nil || len(info) != 18 {
+		t.Fatal(err, len(info))
+	}
+
+	ip2, port, err := decodeCompactIPPortInfo(info)
+	if err != nil || !ip2.Equal(ip) || port != 6881 {
+		t.Error(ip2, port, err)
+	}
+
+	if _, _, err := decodeCompactIPPortInfo(info[:10]); err == nil {
+		t.Error("10-length compact info is decoded")
+	}
+}
+
+func TestNewNodeFromCompactInfo6(t *testing.T) {
+	id := RandomNodeID()
+	no, err := newNode(id.RawString(), "udp6", "[2001:db8::1]:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := no.CompactNodeInfo()
+	if len(info) != compactNodeInfo6Len {
+		t.Fatal(len(info))
+	}
+
+	no2, err := newNodeFromCompactInfo(info)
+	if err != nil || no2.addr.String() != no.addr.String() ||
+		no2.id.RawString() != id.RawString() {
+		t.Error(no2, err)
+	}
+}
+
+func TestSetFamilies(t *testing.T) {
+	cases := []struct {
+		network, addr string
+		ipv4, ipv6    bool
+	}{
+		{"udp4", "0.0.0.0:6881", true, false},
+		{"udp6", "[::]:6881", false, true},
+		{"udp", "[::]:6881", true, true},
+		{"udp", "0.0.0.0:6881", true, false},
+		{"udp", "[::1]:6881", false, true},
+	}
+
+	for _, c := range cases {
+		d := &DHT{Config: &Config{Network: c.network}}
+		addr, _ := net.ResolveUDPAddr("udp", c.addr)
+		d.setFamilies(addr)
+
+		if d.ipv4 != c.ipv4 || d.ipv6 != c.ipv6 {
+			t.Error(c.network, c.addr, d.ipv4, d.ipv6)
+		}
+	}
+}
+
+func TestParseWant(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6881}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+
+	if n4, n6 := parseWant(map[string]interface{}{}, v4); !n4 || n6 {
+		t.Error("ipv4 query without want")
+	}
+	if n4, n6 := parseWant(map[string]interface{}{}, v6); n4 || !n6 {
+		t.Error("ipv6 query without want")
+	}
+
+	a := map[string]interface{}{"want": []interface{}{"n4", "n6"}}
+	if n4, n6 := parseWant(a, v4); !n4 || !n6 {
+		t.Error("want n4 and n6")
+	}
+}
+
+func TestCompactNodesDualStack(t *testing.T) {
+	d := New(newTestConfig().With(WithNetwork("udp")))
+	d.ipv4, d.ipv6 = true, true
+	d.routingTable = newRoutingTable(d.KBucketSize, d)
+	d.routingTable6 = newRoutingTable(d.KBucketSize, d)
+
+	no4, _ := newNode(RandomNodeID().RawString(), "udp4", "1.2.3.4:6881")
+	no6, _ := newNode(RandomNodeID().RawString(), "udp6", "[2001:db8::1]:6881")
+	for _, no := range []*node{no4, no6} {
+		if !d.insertNode(no) {
+			t.Fatal("node is not inserted", no.addr)
+		}
+	}
+	if d.routingTable.Len() != 1 || d.routingTable6.Len() != 1 {
+		t.Fatal("nodes are not in the routing table of their family")
+	}
+
+	r := map[string]interface{}{}
+	d.setCompactNodes(r, newBitmapFromString(RandomNodeID().RawString()),
+		true, true)
+	if len(r["nodes"].(string)) != compactNodeInfoLen ||
+		len(r["nodes6"].(string)) != compactNodeInfo6Len {
+		t.Fatal(r)
+	}
+
+	nodes, err := d.parseCompactNodes(r)
+	if err != nil || len(nodes) != 2 {
+		t.Fatal(nodes, err)
+	}
+
+	// ipv4 only node ignores nodes6
+	d.ipv6 = false
+	if nodes, err := d.parseCompactNodes(r); err != nil || len(nodes) != 1 {
+		t.Error(nodes, err)
+	}
+
+	// 坏的 nodes6 不影响 nodes
+	d.ipv6 = true
+	r["nodes6"] = "bad"
+	if nodes, err := d.parseCompactNodes(r); err != nil || len(nodes) != 1 ||
+		!isIPv4(nodes[0].addr.IP) {
+		t.Error("nodes is dropped", nodes, err)
+	}
+	r["nodes"] = "bad"
+	if _, err := d.parseCompactNodes(r); err != errCompactNodesLength {
+		t.Error("bad nodes are parsed", err)
+	}
+	if _, err := d.parseCompactNodes(map[string]interface{}{}); err == nil {
+		t.Error("response without nodes is parsed")
+	}
+}
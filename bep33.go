@@ -0,0 +1,231 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+BEP 33, DHT scrape.
+See http://www.bittorrent.org/beps/bep_0033.html
+announce_peer 的ip记录在两个bloom filter中：做种的（seed=1）在BFsd，其他的在
+BFpe，get_peers 带 scrape=1 时返回，合并多个节点的filter就可以估算种子的热度
+*/
+
+const (
+	// bloomFilterSize is the length of BFsd and BFpe in bytes.
+	bloomFilterSize = 256
+	// scrapeRotatePeriod is how often the bloom filters are renewed, the
+	// ips announced in the last two periods are in the responses.
+	scrapeRotatePeriod = time.Minute * 30
+	// maxScrapes is how many infohashes have scrape filters, the oldest is
+	// dropped when it's full, so random announces can't grow it forever.
+	maxScrapes = 1 << 14
+)
+
+// ErrNoScrape is returned by Scrape when no node sends the bloom filters.
+var ErrNoScrape = errors.New("dht: no node returns scrape bloom filters")
+
+// bloomFilter is the bloom filter of BEP 33, m = 2048, k = 2.
+type bloomFilter [bloomFilterSize]byte
+
+// add inserts ip into the filter.
+func (bf *bloomFilter) add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	hash := sha1.Sum(ip)
+	for _, i := range []uint{
+		uint(hash[0]) | uint(hash[1])<<8,
+		uint(hash[2]) | uint(hash[3])<<8,
+	} {
+		i %= bloomFilterSize * 8
+		bf[i/8] |= 1 << (i % 8)
+	}
+}
+
+// merge sets the bits of other into the filter.
+func (bf *bloomFilter) merge(other *bloomFilter) {
+	for i := range bf {
+		bf[i] |= other[i]
+	}
+}
+
+// estimate returns the estimated number of ips inserted.
+func (bf *bloomFilter) estimate() int {
+	const m = bloomFilterSize * 8
+
+	zeros := m
+	for _, b := range bf {
+		zeros -= bits.OnesCount8(b)
+	}
+	if zeros == m {
+		return 0
+	}
+	if zeros == 0 {
+		zeros = 1
+	}
+
+	return int(math.Round(
+		math.Log(float64(zeros)/m) / (2 * math.Log(1-1.0/m))))
+}
+
+// parseBloomFilter returns the filter in r[key], nil if it's invalid.
+func parseBloomFilter(r map[string]interface{}, key string) *bloomFilter {
+	data, ok := r[key].(string)
+	if !ok || len(data) != bloomFilterSize {
+		return nil
+	}
+
+	bf := new(bloomFilter)
+	copy(bf[:], data)
+	return bf
+}
+
+/*
+scrapeFilters are the bloom filters of the ips announcing an infohash. The
+current ones are moved to previous every scrapeRotatePeriod.
+*/
+type scrapeFilters struct {
+	sync.Mutex
+	infoHash             string
+	seeds, peers         bloomFilter
+	prevSeeds, prevPeers bloomFilter
+	rotateTime           time.Time
+	// lastAnnounce is when infoHash is announced last
+	lastAnnounce time.Time
+}
+
+// rotate renews the filters when scrapeRotatePeriod passes.
+func (sf *scrapeFilters) rotate(now time.Time) {
+	if now.Sub(sf.rotateTime) < scrapeRotatePeriod {
+		return
+	}
+
+	sf.prevSeeds, sf.prevPeers = sf.seeds, sf.peers
+	if now.Sub(sf.rotateTime) >= scrapeRotatePeriod*2 {
+		sf.prevSeeds, sf.prevPeers = bloomFilter{}, bloomFilter{}
+	}
+	sf.seeds, sf.peers = bloomFilter{}, bloomFilter{}
+	sf.rotateTime = now
+}
+
+// addScrape records that ip announces infoHash.
+func (pm *peersManager) addScrape(infoHash string, ip net.IP, seed bool) {
+	now := pm.dht.clock.Now()
+
+	pm.Lock()
+	e, ok := pm.scrapes.Get(infoHash)
+	if !ok {
+		if pm.scrapes.Len() >= maxScrapes {
+			pm.scrapes.Remove(pm.scrapes.Front())
+		}
+		pm.scrapes.Push(infoHash, &scrapeFilters{
+			infoHash: infoHash, rotateTime: now})
+		e, _ = pm.scrapes.Get(infoHash)
+	}
+	pm.Unlock()
+
+	sf := e.Value.(*scrapeFilters)
+	sf.Lock()
+	defer sf.Unlock()
+
+	sf.rotate(now)
+	sf.lastAnnounce = now
+	if seed {
+		sf.seeds.add(ip)
+	} else {
+		sf.peers.add(ip)
+	}
+}
+
+/*
+expireScrapes drops the filters of the infohashes not announced for two
+scrapeRotatePeriod, they are empty after rotating anyway.
+*/
+func (pm *peersManager) expireScrapes(now time.Time) {
+	var expired []string
+	for e := range pm.scrapes.Iter() {
+		sf := e.Value.(*scrapeFilters)
+		sf.Lock()
+		if now.Sub(sf.lastAnnounce) >= scrapeRotatePeriod*2 {
+			expired = append(expired, sf.infoHash)
+		}
+		sf.Unlock()
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+	for _, infoHash := range expired {
+		pm.scrapes.Delete(infoHash)
+	}
+}
+
+// setScrape sets `BFsd` and `BFpe` of the get_peers response r.
+func (pm *peersManager) setScrape(infoHash string, r map[string]interface{}) {
+	var seeds, peers bloomFilter
+
+	if e, ok := pm.scrapes.Get(infoHash); ok {
+		sf := e.Value.(*scrapeFilters)
+		sf.Lock()
+		sf.rotate(pm.dht.clock.Now())
+		seeds, peers = sf.seeds, sf.peers
+		seeds.merge(&sf.prevSeeds)
+		peers.merge(&sf.prevPeers)
+		sf.Unlock()
+	}
+
+	r["BFsd"] = string(seeds[:])
+	r["BFpe"] = string(peers[:])
+}
+
+/*
+Scrape estimates how many seeders and leechers infoHash has. It sends
+get_peers with scrape=1 to the K nodes closest to infoHash and merges the
+bloom filters they return. infoHash is the 20-length raw or 40-length hex
+string. It returns ErrNoScrape when no node supports BEP 33.
+*/
+func (dht *DHT) Scrape(ctx context.Context, infoHash string) (
+	seeders, leechers int, err error) {
+
+	infoHash, err = parseInfoHash(infoHash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	a := dht.getPeersArgs(infoHash)
+	a["scrape"] = 1
+
+	responses, err := dht.lookup(ctx, getPeersType, infoHash, a, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var seeds, peers bloomFilter
+	n := 0
+	for _, resp := range responses {
+		if n == dht.K {
+			break
+		}
+
+		bfsd, bfpe := parseBloomFilter(resp.r, "BFsd"), parseBloomFilter(resp.r, "BFpe")
+		if bfsd == nil || bfpe == nil {
+			continue
+		}
+		seeds.merge(bfsd)
+		peers.merge(bfpe)
+		n++
+	}
+
+	if n == 0 {
+		return 0, 0, ErrNoScrape
+	}
+	return seeds.estimate(), peers.estimate(), nil
+}
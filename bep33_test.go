@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// BEP 33 test vector.
+func TestBloomFilter(t *testing.T) {
+	var bf bloomFilter
+	for i := 0; i < 256; i++ {
+		bf.add(net.IPv4(192, 0, 2, byte(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP("2001:DB8::")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		bf.add(ip)
+	}
+
+	if n := bf.estimate(); n < 1223 || n > 1225 {
+		t.Error("estimate", n)
+	}
+
+	var empty bloomFilter
+	if n := empty.estimate(); n != 0 {
+		t.Error("empty estimate", n)
+	}
+	empty.merge(&bf)
+	if empty != bf {
+		t.Error("merge")
+	}
+}
+
+func TestScrapeFilters(t *testing.T) {
+	pm := newPeersManager(New(newTestConfig()))
+	infoHash := randomString(20)
+
+	pm.addScrape(infoHash, net.ParseIP("1.2.3.4"), true)
+	pm.addScrape(infoHash, net.ParseIP("1.2.3.5"), false)
+	pm.addScrape(infoHash, net.ParseIP("1.2.3.6"), false)
+
+	r := make(map[string]interface{})
+	pm.setScrape(infoHash, r)
+	if n := parseBloomFilter(r, "BFsd").estimate(); n != 1 {
+		t.Error("seeds", n)
+	}
+	if n := parseBloomFilter(r, "BFpe").estimate(); n != 2 {
+		t.Error("peers", n)
+	}
+
+	// the filters of the last period are still returned
+	e, _ := pm.scrapes.Get(infoHash)
+	sf := e.Value.(*scrapeFilters)
+	sf.rotate(sf.rotateTime.Add(scrapeRotatePeriod))
+	pm.setScrape(infoHash, r)
+	if n := parseBloomFilter(r, "BFpe").estimate(); n != 2 {
+		t.Error("rotated peers", n)
+	}
+
+	sf.rotate(sf.rotateTime.Add(scrapeRotatePeriod * 2))
+	pm.setScrape(infoHash, r)
+	if n := parseBloomFilter(r, "BFsd").estimate(); n != 0 {
+		t.Error("expired seeds", n)
+	}
+}
+
+func TestScrapeLimits(t *testing.T) {
+	pm := newPeersManager(New(newTestConfig()))
+	ip := net.ParseIP("1.2.3.4")
+
+	first := randomString(20)
+	pm.addScrape(first, ip, false)
+	for i := 0; i < maxScrapes; i++ {
+		pm.addScrape(randomString(20), ip, false)
+	}
+	if n := pm.scrapes.Len(); n != maxScrapes {
+		t.Error("len", n)
+	}
+	if pm.scrapes.HasKey(first) {
+		t.Error("the oldest is kept")
+	}
+
+	// 刚公告过的保留，其他的过期
+	kept := pm.scrapes.Front().Value.(*scrapeFilters)
+	now := pm.scrapes.Back().Value.(*scrapeFilters).lastAnnounce.Add(
+		scrapeRotatePeriod * 2)
+	kept.lastAnnounce = now
+	pm.expireScrapes(now)
+	if n := pm.scrapes.Len(); n != 1 || !pm.scrapes.HasKey(kept.infoHash) {
+		t.Error("expired", n)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	a, b := startTestPair(t)
+	defer a.Stop()
+	defer b.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	infoHash := randomString(20)
+	b.peersManager.addScrape(infoHash, net.ParseIP("1.2.3.4"), true)
+	for i := 0; i < 5; i++ {
+		b.peersManager.addScrape(infoHash, net.IPv4(10, 0, 0, byte(i)), false)
+	}
+
+	seeders, leechers, err := a.Scrape(ctx, infoHash)
+	if err != nil || seeders != 1 || leechers != 5 {
+		t.Fatal(seeders, leechers, err)
+	}
+
+	seeders, leechers, err = a.Scrape(ctx, randomString(20))
+	if err != nil || seeders != 0 || leechers != 0 {
+		t.Error(seeders, leechers, err)
+	}
+}
@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+/*
+BEP 42, DHT Security extension.
+See http://www.bittorrent.org/beps/bep_0042.html
+节点id的前21位由节点的ip计算得到，伪造id需要控制对应的ip，增加Sybil攻击的难度
+*/
+
+const (
+	// AcceptAnyNodeID inserts nodes into the routing table whatever ids they
+	// have.
+	AcceptAnyNodeID = iota
+	// PreferSecureNodeID lets nodes with BEP 42 compliant ids replace the
+	// others when their bucket or the routing table is full, and promotes
+	// the secure candidates of a bucket first.
+	PreferSecureNodeID
+	// RequireSecureNodeID keeps nodes without BEP 42 compliant ids out of the
+	// routing table.
+	RequireSecureNodeID
+)
+
+// ipVotesNeeded is how many nodes of the routing table, each from a
+// different /16 (/32 for ipv6), must report the same external ip before it's
+// accepted.
+const ipVotesNeeded = 10
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+	bep42V4Mask = []byte{0x03, 0x0f, 0x3f, 0xff}
+	bep42V6Mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// bep42Prefix returns the crc32c of the masked ip with r in the top bits,
+// whose highest 21 bits are the prefix of the node id.
+func bep42Prefix(ip net.IP, r byte) uint32 {
+	mask := bep42V4Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		mask = bep42V6Mask
+	}
+
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= (r & 0x07) << 5
+
+	return crc32.Checksum(masked, crc32cTable)
+}
+
+// SecureNodeID returns a random node id which is BEP 42 compliant for ip.
+func SecureNodeID(ip net.IP) (id NodeID) {
+	id = RandomNodeID()
+	crc := bep42Prefix(ip, id[19])
+
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return
+}
+
+// bep42Exempt returns whether ip is a local address, whose nodes can have
+// any id.
+func bep42Exempt(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// IsSecureNodeID returns whether id is BEP 42 compliant for ip. Local ips
+// are always compliant.
+func IsSecureNodeID(id NodeID, ip net.IP) bool {
+	if ip == nil || (ip.To4() == nil && len(ip) != net.IPv6len) {
+		return false
+	}
+	if bep42Exempt(ip) {
+		return true
+	}
+
+	crc := bep42Prefix(ip, id[19])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// isSecure returns whether the node has a BEP 42 compliant id.
+func (node *node) isSecure() bool {
+	var id NodeID
+	copy(id[:], node.id.RawString())
+	return IsSecureNodeID(id, node.addr.IP)
+}
+
+/*
+ipVoter learns our external ip from the `ip` field of responses. An ip is
+accepted when ipVotesNeeded nodes from different networks report it, so that
+a few hosts, or many hosts of one network, can't move it.
+*/
+type ipVoter struct {
+	sync.Mutex
+	votes map[string]map[string]struct{}
+}
+
+// newIPVoter returns a new ipVoter pointer.
+func newIPVoter() *ipVoter {
+	return &ipVoter{votes: make(map[string]map[string]struct{})}
+}
+
+// voterNetwork returns the network of reporter a vote is counted for, its
+// /16 for ipv4 or /32 for ipv6.
+func voterNetwork(reporter net.IP) string {
+	if ip4 := reporter.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return reporter.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// vote records that reporter says our ip is ip. It returns ip when it gets
+// enough votes, otherwise it returns "". The reporters of a network count
+// once.
+func (v *ipVoter) vote(ip string, reporter net.IP) string {
+	v.Lock()
+	defer v.Unlock()
+
+	// 防止内存无限增长
+	if _, ok := v.votes[ip]; !ok && len(v.votes) >= 64 {
+		v.votes = make(map[string]map[string]struct{})
+	}
+
+	if _, ok := v.votes[ip]; !ok {
+		v.votes[ip] = make(map[string]struct{})
+	}
+	v.votes[ip][voterNetwork(reporter)] = struct{}{}
+
+	if len(v.votes[ip]) < ipVotesNeeded {
+		return ""
+	}
+
+	v.votes = make(map[string]map[string]struct{})
+	return ip
+}
+
+/*
+learnPublicIp handles the `ip` field of a response sent by addr. Only the
+nodes already in the routing table vote, a new node can't choose our ip. The
+learned ip isn't blocked: it comes from the votes, not from our own
+addresses.
+*/
+func (dht *DHT) learnPublicIp(addr *net.UDPAddr, response map[string]interface{}) {
+	if err := ParseKey(response, "ip", "string"); err != nil {
+		return
+	}
+
+	ip, _, err := decodeCompactIPPortInfo(response["ip"].(string))
+	if err != nil || bep42Exempt(ip) {
+		return
+	}
+	// 双栈时 PublicIp 是ipv4地址
+	if dht.ipv4 && !isIPv4(ip) {
+		return
+	}
+
+	if _, ok := dht.getNodeByAddress(addr); !ok {
+		return
+	}
+
+	learned := dht.ipVoter.vote(ip.String(), addr.IP)
+	if learned == "" || learned == dht.publicIP() {
+		return
+	}
+
+	old := dht.setPublicIP(learned)
+	dht.Log("public ip learned from responses: ", learned, " old: ", old)
+}
+
+// WithSecureNodeID derives the node id from PublicIp, see BEP 42. PublicIp
+// must be set too, NewDHT fails otherwise.
+func WithSecureNodeID() Option {
+	return func(config *Config) {
+		config.SecureNodeID = true
+	}
+}
+
+// WithNodeIDPolicy sets how BEP 42 compliance affects the routing table,
+// one of AcceptAnyNodeID, PreferSecureNodeID, RequireSecureNodeID.
+func WithNodeIDPolicy(policy int) Option {
+	return func(config *Config) {
+		config.NodeIDPolicy = policy
+	}
+}
@@ -0,0 +1,246 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestBEP42Vectors(t *testing.T) {
+	cases := []struct {
+		ip string
+		id string
+	}{
+		{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+
+	for _, c := range cases {
+		id, err := ParseNodeID(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ip := net.ParseIP(c.ip)
+		if !IsSecureNodeID(id, ip) {
+			t.Error(c.ip, c.id)
+		}
+
+		// another ip doesn't match
+		if IsSecureNodeID(id, net.ParseIP("8.8.8.8")) {
+			t.Error(c.id)
+		}
+
+		secure := SecureNodeID(ip)
+		if !IsSecureNodeID(secure, ip) {
+			t.Error(c.ip, hex.EncodeToString(secure[:]))
+		}
+	}
+
+	ip6 := net.ParseIP("2001:db8::1")
+	if !IsSecureNodeID(SecureNodeID(ip6), ip6) {
+		t.Error(ip6)
+	}
+
+	// local ips are exempt
+	if !IsSecureNodeID(RandomNodeID(), net.ParseIP("192.168.1.1")) {
+		t.Fail()
+	}
+}
+
+func TestIPVoter(t *testing.T) {
+	v := newIPVoter()
+
+	// 同一个 /16 的节点只算一票
+	for i := 0; i < ipVotesNeeded*2; i++ {
+		if v.vote("1.2.3.4", net.IPv4(5, 5, byte(i), 1)) != "" {
+			t.Fatal(i)
+		}
+	}
+
+	for i := 0; i < ipVotesNeeded-1; i++ {
+		reporter := net.IPv4(6, byte(i), 6, 6)
+		if ip := v.vote("1.2.3.4", reporter); ip != "" && i != ipVotesNeeded-2 {
+			t.Error(i, ip)
+		} else if i == ipVotesNeeded-2 && ip != "1.2.3.4" {
+			t.Error(i, ip)
+		}
+	}
+}
+
+func TestLearnPublicIp(t *testing.T) {
+	d := New(newTestConfig())
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	d.blackList.ClearAll()
+
+	ip, _ := encodeCompactIPPortInfo(net.ParseIP("1.2.3.4"), 6881)
+	response := map[string]interface{}{"ip": ip}
+	reporter := func(i int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(byte(20+i), 1, 1, 1), Port: 6881}
+	}
+
+	// 不在路由表里的节点不算
+	for i := 0; i < ipVotesNeeded; i++ {
+		d.learnPublicIp(reporter(i), response)
+	}
+	if d.publicIP() != "" {
+		t.Fatal("voted by strangers", d.publicIP())
+	}
+
+	for i := 0; i < ipVotesNeeded; i++ {
+		no, err := newNode(randomString(20), "udp4", reporter(i).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.routingTable.Insert(no)
+		d.learnPublicIp(reporter(i), response)
+	}
+	if d.publicIP() != "1.2.3.4" {
+		t.Fatal("not learned", d.publicIP())
+	}
+	// 投票得来的ip不拉黑
+	if d.blackList.in("1.2.3.4", 6881) {
+		t.Error("blocked")
+	}
+}
+
+// newPolicyNode returns a node at ip whose id is secure or not.
+func newPolicyNode(t *testing.T, ip string, secure bool) *node {
+	t.Helper()
+	id := RandomNodeID()
+	if secure {
+		id = SecureNodeID(net.ParseIP(ip))
+	} else if IsSecureNodeID(id, net.ParseIP(ip)) {
+		id[0]++
+	}
+
+	no, err := newNode(id.RawString(), "udp4", genAddress(ip, 6881))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return no
+}
+
+func TestNodeIDPolicy(t *testing.T) {
+	newTestNode := func(ip string, secure bool) *node {
+		return newPolicyNode(t, ip, secure)
+	}
+
+	config := newTestConfig().With(WithNodeIDPolicy(RequireSecureNodeID))
+	d := New(config)
+	rt := newRoutingTable(config.KBucketSize, d)
+
+	if rt.Insert(newTestNode("1.2.3.4", false)) || rt.Len() != 0 {
+		t.Fail()
+	}
+	if !rt.Insert(newTestNode("1.2.3.5", true)) || rt.Len() != 1 {
+		t.Fail()
+	}
+
+	config = newTestConfig().With(WithNodeIDPolicy(PreferSecureNodeID))
+	config.MaxNodes = 1
+	d = New(config)
+	rt = newRoutingTable(config.KBucketSize, d)
+
+	// The routing table is full after the first node, only a secure node
+	// can take the place of an insecure one.
+	insecure := newTestNode("1.2.3.4", false)
+	if !rt.Insert(insecure) {
+		t.Fatal("insecure node is not inserted")
+	}
+	if rt.Insert(newTestNode("1.2.3.6", false)) {
+		t.Error("insecure node is inserted into a full routing table")
+	}
+
+	secure := newTestNode("1.2.3.5", true)
+	if !rt.Insert(secure) {
+		t.Fatal("secure node doesn't replace the insecure one")
+	}
+	if _, ok := rt.GetNodeByAddress(insecure.addr.String()); ok {
+		t.Error("insecure node is still in the routing table")
+	}
+	if _, ok := rt.GetNodeByAddress(secure.addr.String()); !ok {
+		t.Error("secure node is not in the routing table")
+	}
+	if rt.Insert(newTestNode("1.2.3.7", true)) {
+		t.Error("secure node replaces a secure one")
+	}
+}
+
+func TestNodeIDPolicyBucket(t *testing.T) {
+	config := newTestConfig().With(WithNodeIDPolicy(PreferSecureNodeID))
+	d := New(config)
+	rt := newRoutingTable(2, d)
+
+	// The bucket is full, but the routing table isn't.
+	insecure := []*node{
+		newPolicyNode(t, "1.2.3.4", false),
+		newPolicyNode(t, "1.2.3.5", false),
+	}
+	for _, no := range insecure {
+		if !rt.Insert(no) {
+			t.Fatal("insecure node is not inserted")
+		}
+	}
+
+	for i, ip := range []string{"1.2.3.6", "1.2.3.7"} {
+		if !rt.Insert(newPolicyNode(t, ip, true)) {
+			t.Fatal("secure node is not inserted", i)
+		}
+		if rt.Len() != 2 || rt.cachedKBuckets.Len() != 1 {
+			t.Fatal("secure node doesn't replace an insecure one", i,
+				rt.Len(), rt.cachedKBuckets.Len())
+		}
+	}
+	for _, no := range insecure {
+		if _, ok := rt.GetNodeByAddress(no.addr.String()); ok {
+			t.Error("insecure node is still in the bucket")
+		}
+	}
+	if rt.insecureNodes.Len() != 0 {
+		t.Error("insecure nodes", rt.insecureNodes.Len())
+	}
+
+	// No insecure node is left, the bucket is split as usual.
+	if !rt.Insert(newPolicyNode(t, "1.2.3.8", true)) || rt.Len() != 3 {
+		t.Error("bucket isn't split", rt.Len())
+	}
+}
+
+func TestReplacePrefersSecure(t *testing.T) {
+	d := New(newTestConfig())
+	bucket := newKBucket(newBitmap(0), d.clock)
+
+	old := newPolicyNode(t, "1.2.3.4", false)
+	bucket.Insert(old)
+	secure := newPolicyNode(t, "1.2.3.5", true)
+	for _, no := range []*node{
+		newPolicyNode(t, "1.2.3.6", false),
+		secure,
+		newPolicyNode(t, "1.2.3.7", false),
+	} {
+		bucket.candidates.Push(no.id.RawString(), no)
+	}
+
+	if no := bucket.Replace(old, true); no != secure {
+		t.Fatal("secure candidate isn't promoted", no)
+	}
+	if bucket.nodes.Len() != 1 || !bucket.nodes.HasKey(secure.id.RawString()) {
+		t.Error("nodes", bucket.nodes.Len())
+	}
+
+	// 不偏好时提升最后一个候选
+	last := bucket.candidates.Back().Value.(*node)
+	if no := bucket.Replace(secure, false); no != last {
+		t.Error("last candidate isn't promoted", no)
+	}
+	if bucket.candidates.Len() != 1 {
+		t.Error("candidates", bucket.candidates.Len())
+	}
+}
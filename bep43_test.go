@@ -0,0 +1,101 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMakeQueryReadOnly(t *testing.T) {
+	a := map[string]interface{}{"id": randomString(20)}
+	if _, ok := makeQuery("aa", pingType, a, false)["ro"]; ok {
+		t.Error("ro is sent by default")
+	}
+	if ro := makeQuery("aa", pingType, a, true)["ro"]; ro != 1 {
+		t.Error("ro is not sent", ro)
+	}
+}
+
+/*
+queryFrom sends a query to d from conn and returns the response, nil when
+there is none in a second. The queries d sends to conn meanwhile are skipped.
+*/
+func queryFrom(t *testing.T, conn *net.UDPConn, d *DHT, q string,
+	a map[string]interface{}, readOnly bool) map[string]interface{} {
+
+	data := makeQuery("aa", q, a, readOnly)
+	if _, err := conn.WriteTo([]byte(Encode(data)), d.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+
+		message, err := Decode(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := parseMessage(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response["y"] != "q" {
+			return response
+		}
+	}
+}
+
+// pingFrom pings d from conn, see queryFrom.
+func pingFrom(t *testing.T, conn *net.UDPConn, d *DHT, id string,
+	readOnly bool) map[string]interface{} {
+
+	return queryFrom(t, conn, d, pingType, map[string]interface{}{"id": id},
+		readOnly)
+}
+
+func TestReadOnly(t *testing.T) {
+	config := newTestConfig()
+	config.ReadOnly = true
+
+	ro, d := New(config), New(newTestConfig())
+	for _, n := range []*DHT{ro, d} {
+		n.blackList.ClearAll()
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if response := pingFrom(t, conn, ro, randomString(20), false); response != nil {
+		t.Error("read-only node answers", response)
+	}
+
+	response := pingFrom(t, conn, d, randomString(20), true)
+	if response == nil || response["y"] != "r" {
+		t.Fatal("read-only query is not answered", response)
+	}
+	if _, ok := d.getNodeByAddress(conn.LocalAddr().(*net.UDPAddr)); ok {
+		t.Error("read-only node is in the routing table")
+	}
+
+	// 回应之后才插入路由表
+	pingFrom(t, conn, d, randomString(20), false)
+	for i := 0; i < 100; i++ {
+		if _, ok := d.getNodeByAddress(conn.LocalAddr().(*net.UDPAddr)); ok {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("node is not in the routing table")
+}
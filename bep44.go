@@ -0,0 +1,400 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"strconv"
+)
+
+/*
+BEP 44, Storing arbitrary data in the DHT.
+See http://www.bittorrent.org/beps/bep_0044.html
+不可变数据（immutable）的target是v的SHA-1，可变数据（mutable）的target是公钥+salt
+的SHA-1，用ed25519签名，每次修改seq递增
+*/
+
+const (
+	// maxItemValueSize is the max length of the bencoded v.
+	maxItemValueSize = 1000
+	// maxItemSaltSize is the max length of salt.
+	maxItemSaltSize = 64
+)
+
+// BEP 44 error codes.
+const (
+	itemTooBigError       = 205
+	invalidSignatureError = 206
+	saltTooBigError       = 207
+	casMismatchError      = 301
+	seqTooSmallError      = 302
+)
+
+var (
+	// ErrItemNotFound is returned by Get when no node has the item.
+	ErrItemNotFound = errors.New("dht: item not found")
+	// ErrItemNotStored is returned by Put when no node stores the item.
+	ErrItemNotStored = errors.New("dht: item not stored")
+
+	errInvalidItemValue = errors.New(
+		"dht: item v should be a string, int, list or dict")
+	errItemTooBig       = &KRPCError{itemTooBigError, "message (v field) too big"}
+	errInvalidSignature = &KRPCError{invalidSignatureError, "invalid signature"}
+	errSaltTooBig       = &KRPCError{saltTooBigError, "salt (salt field) too big"}
+)
+
+/*
+Item is a BEP 44 item. An immutable item only has V, a mutable item is
+signed by the ed25519 key K and is changed by putting a greater Seq.
+*/
+type Item struct {
+	// V is a string, int, []interface{} or map[string]interface{} whose
+	// bencoded length is no more than 1000 bytes.
+	V interface{}
+	// K is the public key of mutable items, nil for immutable items
+	K    ed25519.PublicKey
+	Salt string
+	Seq  int64
+	Sig  []byte
+}
+
+// NewImmutableItem returns an immutable item whose value is v.
+func NewImmutableItem(v interface{}) (*Item, error) {
+	item := &Item{V: v}
+	if err := item.Verify(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// NewMutableItem returns a mutable item signed by key.
+func NewMutableItem(key ed25519.PrivateKey, v interface{}, salt string,
+	seq int64) (*Item, error) {
+
+	item := &Item{
+		V:    v,
+		K:    key.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+	}
+
+	data, err := item.signData()
+	if err != nil {
+		return nil, err
+	}
+	item.Sig = ed25519.Sign(key, data)
+	return item, nil
+}
+
+// MutableTarget returns the target of mutable items whose key is k and salt
+// is salt.
+func MutableTarget(k ed25519.PublicKey, salt string) NodeID {
+	return sha1.Sum(append(append([]byte(nil), k...), salt...))
+}
+
+// Mutable returns whether item is a mutable item.
+func (item *Item) Mutable() bool {
+	return len(item.K) > 0
+}
+
+// Target returns the key item is stored under, item should be valid.
+func (item *Item) Target() NodeID {
+	if item.Mutable() {
+		return MutableTarget(item.K, item.Salt)
+	}
+	return sha1.Sum([]byte(Encode(item.V)))
+}
+
+// Verify checks the length of V and Salt, and the signature of mutable items.
+func (item *Item) Verify() error {
+	if !item.Mutable() {
+		_, err := encodeItemValue(item.V)
+		return err
+	}
+
+	if len(item.K) != ed25519.PublicKeySize ||
+		len(item.Sig) != ed25519.SignatureSize {
+		return errInvalidSignature
+	}
+
+	data, err := item.signData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(item.K, data, item.Sig) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+/*
+signData returns the data mutable items sign:
+4:salt<len>:<salt>3:seqi<seq>e1:v<bencoded v>, no salt part when it's empty.
+*/
+func (item *Item) signData() ([]byte, error) {
+	v, err := encodeItemValue(item.V)
+	if err != nil {
+		return nil, err
+	}
+	if len(item.Salt) > maxItemSaltSize {
+		return nil, errSaltTooBig
+	}
+
+	data := make([]byte, 0, len(v)+len(item.Salt)+32)
+	if item.Salt != "" {
+		data = append(data, "4:salt"+EncodeString(item.Salt)...)
+	}
+	data = append(data, "3:seqi"+strconv.FormatInt(item.Seq, 10)+"e1:v"...)
+	return append(data, v...), nil
+}
+
+// encodeItemValue returns the bencoded v and checks its length.
+func encodeItemValue(v interface{}) (data string, err error) {
+	defer func() {
+		if recover() != nil {
+			data, err = "", errInvalidItemValue
+		}
+	}()
+
+	if data = Encode(v); len(data) > maxItemValueSize {
+		return "", errItemTooBig
+	}
+	return
+}
+
+/*
+parseItem returns the item in the `v`, `k`, `sig` and `seq` fields of data,
+which is the arguments of a put query or a get response. salt is used by
+mutable items.
+*/
+func parseItem(data map[string]interface{}, salt string) (*Item, error) {
+	v, ok := data["v"]
+	if !ok {
+		return nil, errors.New("lack of key")
+	}
+
+	item := &Item{V: v, Salt: salt}
+	if _, ok := data["k"]; ok {
+		if err := ParseKeys(data, [][]string{
+			{"k", "string"}, {"sig", "string"}, {"seq", "int"}}); err != nil {
+			return nil, err
+		}
+
+		item.K = ed25519.PublicKey(data["k"].(string))
+		item.Sig = []byte(data["sig"].(string))
+		item.Seq = int64(data["seq"].(int))
+	}
+
+	return item, item.Verify()
+}
+
+// sendError sends err to addr, with its code when it is a *KRPCError.
+func sendError(dht *DHT, addr *net.UDPAddr, t string, err error) {
+	if e, ok := err.(*KRPCError); ok {
+		send(dht, addr, makeError(t, e.Code, e.Message))
+		return
+	}
+	send(dht, addr, makeError(t, protocolError, err.Error()))
+}
+
+/*
+handleGet answers the get query with the token, the closest nodes and the
+item when it's stored here. 请求中的seq不小于已有的seq时不返回v
+*/
+func handleGet(dht *DHT, addr *net.UDPAddr, t string,
+	a map[string]interface{}) bool {
+
+	if err := ParseKey(a, "target", "string"); err != nil {
+		sendError(dht, addr, t, err)
+		return false
+	}
+
+	target := a["target"].(string)
+	if len(target) != 20 {
+		send(dht, addr, makeError(t, protocolError, "invalid target"))
+		return false
+	}
+
+	r := map[string]interface{}{
+		"id":    dht.id(target),
+		"token": dht.token(addr),
+	}
+	n4, n6 := parseWant(a, addr)
+	dht.setCompactNodes(r, newBitmapFromString(target), n4, n6)
+
+	if item, ok := dht.itemStore.get(target); ok && !item.Mutable() {
+		r["v"] = item.V
+	} else if ok {
+		r["k"] = string(item.K)
+		r["seq"] = int(item.Seq)
+
+		if seq, ok := a["seq"].(int); !ok || int64(seq) < item.Seq {
+			r["v"] = item.V
+			r["sig"] = string(item.Sig)
+		}
+	}
+
+	send(dht, addr, makeResponse(t, r))
+	return true
+}
+
+// handlePut stores the item in the put query, the token is from get.
+func handlePut(dht *DHT, addr *net.UDPAddr, t string,
+	a map[string]interface{}) bool {
+
+	if err := ParseKey(a, "token", "string"); err != nil {
+		sendError(dht, addr, t, err)
+		return false
+	}
+
+	if !dht.checkToken(addr, a["token"].(string)) {
+		send(dht, addr, makeError(t, protocolError, "invalid token"))
+		return false
+	}
+
+	salt, _ := a["salt"].(string)
+	item, err := parseItem(a, salt)
+	if err != nil {
+		sendError(dht, addr, t, err)
+		return false
+	}
+
+	var cas *int64
+	if v, ok := a["cas"].(int); ok && item.Mutable() {
+		c := int64(v)
+		cas = &c
+	}
+
+	target := item.Target().RawString()
+	if err := dht.itemStore.put(target, item, cas); err != nil {
+		sendError(dht, addr, t, err)
+		return false
+	}
+
+	send(dht, addr, makeResponse(t, map[string]interface{}{
+		"id": dht.id(target),
+	}))
+	return true
+}
+
+// getArgs returns the arguments of get query.
+func (dht *DHT) getArgs(target string) map[string]interface{} {
+	a := map[string]interface{}{
+		"id":     dht.id(target),
+		"target": target,
+	}
+	if want := dht.want(); want != nil {
+		a["want"] = want
+	}
+	return a
+}
+
+/*
+Get looks up the item whose target is target, see Item.Target. salt is
+needed by mutable items, whose target is MutableTarget(k, salt), and the
+one with the greatest seq is returned. It returns ErrItemNotFound when no
+node has the item.
+*/
+func (dht *DHT) Get(ctx context.Context, target NodeID, salt string) (
+	*Item, error) {
+
+	var best *Item
+	_, err := dht.lookup(ctx, getType, target.RawString(),
+		dht.getArgs(target.RawString()), func(resp *lookupResponse) bool {
+			item, err := parseItem(resp.r, salt)
+			if err != nil || item.Target() != target {
+				return false
+			}
+
+			if !item.Mutable() {
+				best = item
+				return true
+			}
+			if best == nil || item.Seq > best.Seq {
+				best = item
+			}
+			return false
+		})
+
+	if best != nil {
+		return best, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrItemNotFound
+}
+
+/*
+Put stores item on the K nodes closest to its target, using the tokens
+they give in get responses. It returns how many nodes store the item, and
+when none does, the error one of them sends, eg a *KRPCError whose code is
+302 when a greater seq is stored, or ErrItemNotStored.
+*/
+func (dht *DHT) Put(ctx context.Context, item *Item) (int, error) {
+	return dht.put(ctx, item, nil)
+}
+
+// PutCAS is like Put, but the nodes only store the mutable item when the
+// seq they have is cas.
+func (dht *DHT) PutCAS(ctx context.Context, item *Item, cas int64) (
+	int, error) {
+
+	return dht.put(ctx, item, &cas)
+}
+
+func (dht *DHT) put(ctx context.Context, item *Item, cas *int64) (int, error) {
+	if err := item.Verify(); err != nil {
+		return 0, err
+	}
+
+	target := item.Target().RawString()
+	responses, err := dht.lookup(ctx, getType, target, dht.getArgs(target),
+		nil)
+	if err != nil {
+		return 0, err
+	}
+
+	_, errs := dht.queryClosest(ctx, responses, putType,
+		func(token string) map[string]interface{} {
+			a := map[string]interface{}{
+				"id":    dht.id(target),
+				"token": token,
+				"v":     item.V,
+			}
+			if item.Mutable() {
+				a["k"] = string(item.K)
+				a["sig"] = string(item.Sig)
+				a["seq"] = int(item.Seq)
+				if item.Salt != "" {
+					a["salt"] = item.Salt
+				}
+				if cas != nil {
+					a["cas"] = int(*cas)
+				}
+			}
+			return a
+		})
+
+	stored, err := 0, error(ErrItemNotStored)
+	var canceled error
+	for _, e := range errs {
+		if e == nil {
+			stored++
+		} else if _, ok := e.(*KRPCError); ok {
+			err = e
+		} else if e != ErrNoResponse {
+			canceled = e
+		}
+	}
+
+	if canceled != nil {
+		return stored, canceled
+	}
+	if stored == 0 {
+		return 0, err
+	}
+	return stored, nil
+}
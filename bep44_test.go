@@ -0,0 +1,200 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// BEP 44 test vectors.
+func TestItemVectors(t *testing.T) {
+	item, err := NewImmutableItem("Hello World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := item.Target(); target.String() !=
+		"e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Error("immutable target", target)
+	}
+
+	k, _ := hex.DecodeString(
+		"77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+
+	cases := []struct {
+		salt, sig, target string
+	}{
+		{"",
+			"305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff" +
+				"1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			"4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"foobar",
+			"6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17d" +
+				"df9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			"411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+	}
+
+	for _, c := range cases {
+		sig, _ := hex.DecodeString(c.sig)
+		item := &Item{
+			V:    "Hello World!",
+			K:    ed25519.PublicKey(k),
+			Salt: c.salt,
+			Seq:  1,
+			Sig:  sig,
+		}
+
+		if err := item.Verify(); err != nil {
+			t.Error(c.salt, err)
+		}
+		if target := item.Target(); target.String() != c.target {
+			t.Error(c.salt, "mutable target", target)
+		}
+
+		item.Seq = 2
+		if err := item.Verify(); err != errInvalidSignature {
+			t.Error(c.salt, "changed item is verified")
+		}
+	}
+}
+
+func TestNewItem(t *testing.T) {
+	if _, err := NewImmutableItem(string(make([]byte, 1000))); err != errItemTooBig {
+		t.Error("too big item", err)
+	}
+	if _, err := NewImmutableItem(1.5); err != errInvalidItemValue {
+		t.Error("invalid item value", err)
+	}
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	if _, err := NewMutableItem(key, "v", string(make([]byte, 65)), 1); err != errSaltTooBig {
+		t.Error("too big salt", err)
+	}
+
+	item, err := NewMutableItem(key, map[string]interface{}{
+		"b": 1, "a": []interface{}{"x"}}, "salt", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := item.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestItemStore(t *testing.T) {
+	clock := newFakeClock()
+	s := newItemStore(2, time.Hour, clock)
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	put := func(v string, seq int64, cas *int64) error {
+		item, _ := NewMutableItem(key, v, "", seq)
+		return s.put(item.Target().RawString(), item, cas)
+	}
+
+	if err := put("a", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("a", 2, nil); err != nil {
+		t.Error("same item is refused", err)
+	}
+	if err, ok := put("b", 2, nil).(*KRPCError); !ok ||
+		err.Code != seqTooSmallError {
+		t.Error("same seq with another v", err)
+	}
+	if err, ok := put("b", 1, nil).(*KRPCError); !ok ||
+		err.Code != seqTooSmallError {
+		t.Error("smaller seq", err)
+	}
+
+	cas := int64(1)
+	if err, ok := put("b", 3, &cas).(*KRPCError); !ok ||
+		err.Code != casMismatchError {
+		t.Error("cas mismatch", err)
+	}
+	cas = 2
+	if err := put("b", 3, &cas); err != nil {
+		t.Error(err)
+	}
+
+	// the oldest item is removed when it's full
+	var targets []string
+	for _, v := range []string{"x", "y"} {
+		item, _ := NewImmutableItem(v)
+		targets = append(targets, item.Target().RawString())
+		s.put(targets[len(targets)-1], item, nil)
+	}
+	mutable, _ := NewMutableItem(key, "b", "", 3)
+	if _, ok := s.get(mutable.Target().RawString()); ok || s.len() != 2 {
+		t.Error("the oldest item is not removed")
+	}
+	if item, ok := s.get(targets[1]); !ok || item.V != "y" {
+		t.Error("item is not stored")
+	}
+
+	clock.Add(time.Hour + time.Second)
+	if _, ok := s.get(targets[1]); ok {
+		t.Error("expired item is returned")
+	}
+}
+
+// startTestPair starts two dht nodes on 127.0.0.1 which know each other.
+func startTestPair(t *testing.T) (a, b *DHT) {
+	a, b = New(newTestConfig()), New(newTestConfig())
+	for _, d := range []*DHT{a, b} {
+		// 本地ip默认在黑名单中
+		d.blackList.ClearAll()
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	no, err := newNode(b.node.id.RawString(), "udp4", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.routingTable.Insert(no)
+	return
+}
+
+func TestPutGet(t *testing.T) {
+	a, b := startTestPair(t)
+	defer a.Stop()
+	defer b.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	item, _ := NewImmutableItem("Hello World!")
+	if n, err := a.Put(ctx, item); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	got, err := a.Get(ctx, item.Target(), "")
+	if err != nil || got.V != "Hello World!" {
+		t.Fatal(got, err)
+	}
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	for seq := int64(1); seq <= 2; seq++ {
+		item, _ := NewMutableItem(key, "v"+string(rune('0'+seq)), "s", seq)
+		if _, err := a.Put(ctx, item); err != nil {
+			t.Fatal(seq, err)
+		}
+	}
+
+	got, err = a.Get(ctx, MutableTarget(key.Public().(ed25519.PublicKey), "s"), "s")
+	if err != nil || got.V != "v2" || got.Seq != 2 {
+		t.Fatal(got, err)
+	}
+
+	old, _ := NewMutableItem(key, "v1", "s", 1)
+	if _, err := a.Put(ctx, old); err == nil {
+		t.Error("item with smaller seq is stored")
+	} else if e, ok := err.(*KRPCError); !ok || e.Code != seqTooSmallError {
+		t.Error(err)
+	}
+
+	if _, err := a.Get(ctx, RandomNodeID(), ""); err != ErrItemNotFound {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,265 @@
+package dht
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+BEP 51, DHT Infohash Indexing.
+See http://www.bittorrent.org/beps/bep_0051.html
+sample_infohashes 返回节点保存的infohash的随机样本，爬虫不用再被动等待
+get_peers、announce_peer
+*/
+
+const (
+	sampleInfohashesType = "sample_infohashes"
+	// maxSamples is how many infohashes a response has at most, 20 * 20
+	// bytes keeps the packet small.
+	maxSamples = 20
+	// sampleInterval is how long the samples are kept before drawn again,
+	// it's the `interval` of responses, BEP 51 allows up to 6 hours.
+	sampleInterval = time.Hour * 6
+	// sampleQueryPeriod is how often SampleInfohashes sends a query.
+	sampleQueryPeriod = time.Millisecond * 50
+	// sampleMinInterval is the least time SampleInfohashes waits before
+	// querying a node again, and the time it waits after a failure.
+	sampleMinInterval = time.Minute
+	// maxSampleQueries is how many queries SampleInfohashes waits for at
+	// the same time.
+	maxSampleQueries = 8
+	// maxSampleQueue is how many nodes SampleInfohashes keeps to visit.
+	maxSampleQueue = 10000
+)
+
+// infoHashSample is the samples peersManager answers with.
+type infoHashSample struct {
+	sync.Mutex
+	samples    string
+	num        int
+	sampleTime time.Time
+}
+
+/*
+sample returns at most maxSamples random infohashes joined together, and how
+many infohashes there are. 样本每 sampleInterval 重新抽取一次
+*/
+func (pm *peersManager) sample() (samples string, num int) {
+	s := &pm.samples
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.sampleTime.IsZero() && time.Since(s.sampleTime) < sampleInterval {
+		return s.samples, s.num
+	}
+
+	// reservoir sampling
+	hashes := make([]string, 0, maxSamples)
+	n := 0
+	for item := range pm.table.Iter() {
+		if len(hashes) < maxSamples {
+			hashes = append(hashes, item.key.(string))
+		} else if i := rand.Intn(n + 1); i < maxSamples {
+			hashes[i] = item.key.(string)
+		}
+		n++
+	}
+
+	s.samples, s.num, s.sampleTime = strings.Join(hashes, ""), n, time.Now()
+	return s.samples, s.num
+}
+
+// handleSampleInfohashes answers the sample_infohashes query.
+func handleSampleInfohashes(dht *DHT, addr *net.UDPAddr, t string,
+	a map[string]interface{}) bool {
+
+	if err := ParseKey(a, "target", "string"); err != nil {
+		sendError(dht, addr, t, err)
+		return false
+	}
+
+	target := a["target"].(string)
+	if len(target) != 20 {
+		send(dht, addr, makeError(t, protocolError, "invalid target"))
+		return false
+	}
+
+	samples, num := dht.peersManager.sample()
+	r := map[string]interface{}{
+		"id":       dht.id(target),
+		"interval": int(sampleInterval / time.Second),
+		"num":      num,
+		"samples":  samples,
+	}
+	n4, n6 := parseWant(a, addr)
+	dht.setCompactNodes(r, newBitmapFromString(target), n4, n6)
+
+	send(dht, addr, makeResponse(t, r))
+	return true
+}
+
+// sampleResponse is the response of a sample_infohashes query, r is nil
+// when the query fails.
+type sampleResponse struct {
+	node *node
+	r    map[string]interface{}
+}
+
+/*
+sampler keeps the nodes SampleInfohashes visits, and when each of them can
+be queried again.
+*/
+type sampler struct {
+	queue  []*node
+	queued map[string]bool
+	// 下一次可以查询的时间
+	next map[string]time.Time
+}
+
+// newSampler returns a new sampler pointer.
+func newSampler() *sampler {
+	return &sampler{
+		queued: make(map[string]bool),
+		next:   make(map[string]time.Time),
+	}
+}
+
+// push adds no to the queue unless it's queued, full or can't be queried
+// now.
+func (s *sampler) push(no *node, now time.Time) {
+	addr := no.addr.String()
+	if s.queued[addr] || len(s.queue) >= maxSampleQueue ||
+		now.Before(s.next[addr]) {
+		return
+	}
+
+	s.queued[addr] = true
+	s.queue = append(s.queue, no)
+}
+
+// pop returns the next node to query, nil if the queue is empty.
+func (s *sampler) pop(now time.Time) *node {
+	for len(s.queue) > 0 {
+		no := s.queue[0]
+		s.queue = s.queue[1:]
+		delete(s.queued, no.addr.String())
+
+		if !now.Before(s.next[no.addr.String()]) {
+			return no
+		}
+	}
+	return nil
+}
+
+// wait makes no not be queried until after d.
+func (s *sampler) wait(no *node, now time.Time, d time.Duration) {
+	if d < sampleMinInterval {
+		d = sampleMinInterval
+	}
+	s.next[no.addr.String()] = now.Add(d)
+
+	// 防止内存无限增长，删除已经到期的
+	if len(s.next) > maxSampleQueue*10 {
+		for addr, t := range s.next {
+			if now.After(t) {
+				delete(s.next, addr)
+			}
+		}
+	}
+}
+
+/*
+SampleInfohashes walks the keyspace with sample_infohashes queries until
+ctx is done, and calls onSample with every infohash a node returns. The
+nodes come from the routing table and the responses, each of them is not
+queried again before the `interval` it asks for. The same infohash may be
+returned by many nodes, onSample should dedupe them if needed.
+It returns ctx.Err(), or ErrNotReady when the dht stops.
+*/
+func (dht *DHT) SampleInfohashes(ctx context.Context,
+	onSample func(infoHash string, addr *net.UDPAddr)) error {
+
+	if dht.isClosing() {
+		return ErrNotReady
+	}
+
+	s := newSampler()
+	ch := make(chan *sampleResponse, maxSampleQueries)
+	inflight := 0
+
+	tick := time.NewTicker(sampleQueryPeriod)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-dht.closing:
+			return ErrNotReady
+		case resp := <-ch:
+			inflight--
+			now := time.Now()
+
+			if resp.r == nil {
+				s.wait(resp.node, now, sampleMinInterval)
+				continue
+			}
+
+			interval, _ := resp.r["interval"].(int)
+			s.wait(resp.node, now, time.Duration(interval)*time.Second)
+
+			if samples, ok := resp.r["samples"].(string); ok &&
+				len(samples)%20 == 0 {
+				for i := 0; i < len(samples); i += 20 {
+					onSample(samples[i:i+20], resp.node.addr)
+				}
+			}
+
+			if nodes, err := dht.parseCompactNodes(resp.r); err == nil {
+				for _, no := range nodes {
+					s.push(no, now)
+				}
+			}
+		case <-tick.C:
+			if inflight >= maxSampleQueries {
+				continue
+			}
+
+			now := time.Now()
+			target := randomString(20)
+			no := s.pop(now)
+			if no == nil {
+				// 从路由表中随机位置补充
+				for _, no := range dht.getNeighbors(
+					newBitmapFromString(target), dht.K) {
+					s.push(no, now)
+				}
+				if no = s.pop(now); no == nil {
+					continue
+				}
+			}
+
+			a := map[string]interface{}{
+				"id":     dht.id(target),
+				"target": target,
+			}
+			if want := dht.want(); want != nil {
+				a["want"] = want
+			}
+
+			inflight++
+			dht.transactionManager.sendQueryDone(no, sampleInfohashesType, a,
+				func(response map[string]interface{}) {
+					resp := &sampleResponse{node: no}
+					if response != nil && response["y"] == "r" {
+						resp.r = response["r"].(map[string]interface{})
+					}
+					ch <- resp
+				})
+		}
+	}
+}
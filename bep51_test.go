@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeersManagerSample(t *testing.T) {
+	pm := newPeersManager(New(newTestConfig()))
+	for i := 0; i < 30; i++ {
+		pm.Insert(randomString(20), newPeer(net.ParseIP("1.2.3.4"), 6881, ""))
+	}
+
+	samples, num := pm.sample()
+	if len(samples) != maxSamples*20 || num != 30 {
+		t.Fatal(len(samples), num)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(samples); i += 20 {
+		seen[samples[i:i+20]] = true
+	}
+	if len(seen) != maxSamples {
+		t.Error("samples are not distinct")
+	}
+
+	// samples are kept for sampleInterval
+	pm.Insert(randomString(20), newPeer(net.ParseIP("1.2.3.4"), 6881, ""))
+	if samples2, num2 := pm.sample(); samples2 != samples || num2 != num {
+		t.Error("samples are drawn again")
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler()
+	now := time.Now()
+	no, _ := newNode(randomString(20), "udp4", "1.2.3.4:6881")
+
+	s.push(no, now)
+	s.push(no, now)
+	if len(s.queue) != 1 {
+		t.Fatal("node is queued twice")
+	}
+	if s.pop(now) != no || s.pop(now) != nil {
+		t.Fatal("pop")
+	}
+
+	s.wait(no, now, time.Second)
+	s.push(no, now)
+	if s.pop(now) != nil {
+		t.Error("node is queried before its interval")
+	}
+	if s.push(no, now.Add(sampleMinInterval)); s.pop(now.Add(sampleMinInterval)) != no {
+		t.Error("node is not queried after its interval")
+	}
+}
+
+func TestSampleInfohashes(t *testing.T) {
+	a, b := startTestPair(t)
+	defer a.Stop()
+	defer b.Stop()
+
+	infoHash := randomString(20)
+	b.peersManager.Insert(infoHash, newPeer(net.ParseIP("1.2.3.4"), 6881, ""))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var got string
+	err := a.SampleInfohashes(ctx, func(h string, addr *net.UDPAddr) {
+		if addr.String() == b.Addr().String() {
+			got = h
+			cancel()
+		}
+	})
+	if err != context.Canceled || got != infoHash {
+		t.Error(err, got == infoHash)
+	}
+}
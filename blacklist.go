@@ -1,6 +1,8 @@
 package dht
 
 import (
+	"net"
+	"sync"
 	"time"
 )
 
@@ -14,15 +16,25 @@ type blockedItem struct {
 // blackList manages the blocked nodes including which sends bad information
 // and can't ping out.
 type blackList struct {
-	list         *syncedMap
+	list *syncedMap
+	// prefixes are the ips and ranges blocked until ClearAll, eg the local
+	// ips, Config.BlockedIPs and the bogons. They don't expire and don't
+	// count in maxSize
+	prefixes *prefixTree
+	// lists are the Blocklists added by AddBlocklist, ClearAll keeps them
+	listsMu      sync.RWMutex
+	lists        []*blocklistUse
 	maxSize      int
 	expiredAfter time.Duration
+	// inserted is called after an item is inserted, it may be nil
+	inserted func(ip string, port int)
 }
 
 // newBlackList returns a blackList pointer.
 func newBlackList(size int) *blackList {
 	return &blackList{
 		list:         newSyncedMap(),
+		prefixes:     newPrefixTree(),
 		maxSize:      size,
 		expiredAfter: time.Hour * 1,
 	}
@@ -40,8 +52,21 @@ func (bl *blackList) genKey(ip string, port int) string {
 
 // 清空所有
 func (bl *blackList) ClearAll() {
-	bl.list.data = make(map[interface{}]interface{})
-	// bl.list = newSyncedMap()
+	// 加锁清空，数据包处理中的 in、insert 同时在用
+	bl.list.Clear()
+	bl.prefixes.clear()
+}
+
+// block adds the ip prefixes to the blacklist, they stay until ClearAll.
+func (bl *blackList) block(prefixes ...*net.IPNet) {
+	for _, prefix := range prefixes {
+		bl.prefixes.insert(prefix, nil)
+	}
+}
+
+// Len returns how many items and prefixes are blocked.
+func (bl *blackList) Len() int {
+	return bl.list.Len() + bl.prefixes.Len()
 }
 
 /*
@@ -64,6 +89,9 @@ func (bl *blackList) insert(ip string, port int) {
 		port:       port,
 		createTime: time.Now(),
 	})
+	if bl.inserted != nil {
+		bl.inserted(ip, port)
+	}
 }
 
 // delete removes blocked item form the blackList.
@@ -95,6 +123,11 @@ func (bl *blackList) in(ip string, port int) bool {
 	if _, ok := bl.list.Get(ip); ok {
 		return true
 	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if _, ok := bl.prefixes.lookup(parsed); ok || bl.inLists(parsed) {
+			return true
+		}
+	}
 
 	key := bl.genKey(ip, port)
 
@@ -108,9 +141,18 @@ func (bl *blackList) in(ip string, port int) bool {
 	return false
 }
 
-// clear cleans the expired items every 10 minutes.
-func (bl *blackList) clear() {
-	for _ = range time.Tick(time.Minute * 10) {
+// clear cleans the expired items every 10 minutes until stop is closed.
+func (bl *blackList) clear(stop <-chan struct{}) {
+	tick := time.NewTicker(time.Minute * 10)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
 		keys := make([]interface{}, 0, 100)
 
 		for item := range bl.list.Iter() {
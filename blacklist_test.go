@@ -2,6 +2,7 @@ package dht
 
 import (
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -55,3 +56,61 @@ func TestBlackList(t *testing.T) {
 		}
 	}
 }
+
+func TestBlackListPrefixes(t *testing.T) {
+	config := newTestConfig()
+	config.BlockedIPs = []string{"10.0.0.0/8", "1.2.3.0-1.2.3.9"}
+	config.BlockBogons = true
+	d := New(config)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	for _, addr := range []string{"10.1.2.3:1", "1.2.3.9:1", "192.168.0.1:1"} {
+		no, _ := newNode(randomString(20), "udp4", addr)
+		if d.routingTable.Insert(no) {
+			t.Error("inserted", addr)
+		}
+	}
+	no, _ := newNode(randomString(20), "udp4", "1.2.3.10:1")
+	if !d.routingTable.Insert(no) {
+		t.Error("not inserted")
+	}
+	// bogons 只是不进路由表，数据包照常处理
+	if d.blackList.in("192.168.0.1", 1) ||
+		!d.isBogon(net.ParseIP("192.168.0.1")) {
+		t.Error("bogon is blacklisted")
+	}
+	if New(newTestConfig()).isBogon(net.ParseIP("192.168.0.1")) ||
+		NewStandardConfig().BlockBogons {
+		t.Error("bogons are blocked by default")
+	}
+
+	config.BlockedIPs = []string{"10.0.0.0/33"}
+	if err := config.Validate(); err == nil ||
+		!err.(ConfigErrors).Has("BlockedIPs") {
+		t.Error(err)
+	}
+
+	d.blackList.ClearAll()
+	if d.blackList.Len() != 0 || d.blackList.in("10.1.2.3", 1) {
+		t.Error("not cleared")
+	}
+}
+
+func TestBlackListClearAllConcurrent(t *testing.T) {
+	bl := newBlackList(256)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			bl.insert("1.2.3.4", i)
+			bl.in("1.2.3.4", i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		bl.ClearAll()
+	}
+	<-done
+}
@@ -0,0 +1,402 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Blocklist 是 eMule ipfilter.dat 或 PeerGuardian P2P 格式的ip黑名单，文件可以用
+gzip压缩。同一个 Blocklist 可以同时给 DHT 和 Wire 用，只加载一份：
+	list, err := dht.LoadBlocklist("level1.p2p.gz")
+	d.AddBlocklist(list)
+	wire.AddBlocklist(list)
+	go list.Watch(ctx, time.Minute)
+ipfilter.dat lines are `start - end , level , description`, the ranges with
+a level above 127 are allowed. P2P lines are `description:start-end`. Blank
+lines and lines starting with # or // are skipped, the other lines which
+can't be parsed are counted in BlocklistStats.Invalid.
+
+The lists have hundreds of thousands of ranges, so they are kept as sorted
+ranges instead of the prefixes of blackList.
+*/
+
+// maxIPFilterLevel is the highest ipfilter.dat level which is blocked.
+const maxIPFilterLevel = 127
+
+// ipRange is the ips from start to end, ipv4 is in the 16 bytes form.
+type ipRange struct {
+	start, end [net.IPv6len]byte
+}
+
+// ipRanges are sorted ranges without overlapping.
+type ipRanges []ipRange
+
+// newIPRanges sorts rs and merges the overlapping ranges.
+func newIPRanges(rs []ipRange) ipRanges {
+	sort.Slice(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].start[:], rs[j].start[:]) < 0
+	})
+
+	merged := rs[:0]
+	for _, r := range rs {
+		if n := len(merged); n > 0 &&
+			bytes.Compare(r.start[:], merged[n-1].end[:]) <= 0 {
+
+			if bytes.Compare(r.end[:], merged[n-1].end[:]) > 0 {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return ipRanges(merged)
+}
+
+// contains returns whether ip is in one of the ranges.
+func (rs ipRanges) contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	// 第一个 end 不小于 ip 的区间
+	i := sort.Search(len(rs), func(i int) bool {
+		return bytes.Compare(rs[i].end[:], ip16) >= 0
+	})
+	return i < len(rs) && bytes.Compare(rs[i].start[:], ip16) <= 0
+}
+
+// parsePaddedIP parses an ip, the ipv4 may be zero padded, eg 001.002.003.004.
+func parsePaddedIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != net.IPv4len {
+		return nil
+	}
+	var ip [net.IPv4len]byte
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+}
+
+// parseIPRange parses a `start-end` range.
+func parseIPRange(s string) (r ipRange, ok bool) {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return
+	}
+	start, end := parsePaddedIP(s[:i]), parsePaddedIP(s[i+1:])
+	if start == nil || end == nil ||
+		(start.To4() == nil) != (end.To4() == nil) {
+		return
+	}
+	copy(r.start[:], start.To16())
+	copy(r.end[:], end.To16())
+	return r, bytes.Compare(r.start[:], r.end[:]) <= 0
+}
+
+/*
+parseBlocklistLine parses a line of ipfilter.dat or P2P format. allowed is set
+for the ipfilter.dat ranges above maxIPFilterLevel.
+*/
+func parseBlocklistLine(line string) (r ipRange, allowed, ok bool) {
+	fields := strings.SplitN(line, ",", 3)
+	if r, ok = parseIPRange(fields[0]); ok {
+		if len(fields) > 1 {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return r, false, false
+			}
+			allowed = level > maxIPFilterLevel
+		}
+		return
+	}
+
+	// P2P 格式的描述里可能有冒号，ipv6 的区间里也有，区间从第一个后面能解析
+	// 出区间的冒号开始
+	for i := 0; ; {
+		j := strings.IndexByte(line[i:], ':')
+		if j < 0 {
+			return r, false, false
+		}
+		i += j + 1
+		if r, ok = parseIPRange(line[i:]); ok {
+			return
+		}
+	}
+}
+
+// readBlocklist reads the ranges of a list in r, which may be gzipped.
+func readBlocklist(r io.Reader) (ranges ipRanges, invalid int, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f &&
+		magic[1] == 0x8b {
+
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	var rs []ipRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		r, allowed, ok := parseBlocklistLine(line)
+		if !ok {
+			invalid++
+		} else if !allowed {
+			rs = append(rs, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return newIPRanges(rs), invalid, nil
+}
+
+// Blocklist is an ip blocklist loaded from ipfilter.dat or P2P format.
+type Blocklist struct {
+	// blocked is first to be 64-bit aligned for atomic
+	blocked uint64
+	name    string
+	// path is empty when the list isn't loaded from a file
+	path string
+
+	sync.RWMutex
+	ranges  ipRanges
+	invalid int
+	modTime time.Time
+	size    int64
+	loaded  time.Time
+	err     error
+}
+
+// BlocklistStats is a snapshot of a Blocklist.
+type BlocklistStats struct {
+	// Name is the base name of the file by default.
+	Name string
+	Path string
+	// Ranges is how many ranges are blocked after merging the overlapping.
+	Ranges int
+	// Invalid is how many lines can't be parsed.
+	Invalid int
+	// Blocked is how many times the list blocks a packet, a node or a peer,
+	// counting all the DHTs and Wires sharing it.
+	Blocked uint64
+	// Loaded is when the list is loaded last.
+	Loaded time.Time
+	// Err is the error of the last reload, the list loaded before is kept.
+	Err error
+}
+
+/*
+LoadBlocklist loads the blocklist file at path, which may be gzipped, see
+Blocklist. Reload and Watch reload it when the file changes.
+*/
+func LoadBlocklist(path string) (*Blocklist, error) {
+	list := &Blocklist{name: filepath.Base(path), path: path}
+	if _, err := list.Reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ParseBlocklist reads a blocklist named name from r, which may be gzipped.
+func ParseBlocklist(name string, r io.Reader) (*Blocklist, error) {
+	ranges, invalid, err := readBlocklist(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Blocklist{
+		name:    name,
+		ranges:  ranges,
+		invalid: invalid,
+		loaded:  time.Now(),
+	}, nil
+}
+
+/*
+Reload loads the file again when its size or modification time is changed,
+and returns whether it's reloaded. On error the ranges loaded before are
+kept.
+*/
+func (list *Blocklist) Reload() (bool, error) {
+	if list.path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(list.path)
+	if err == nil {
+		list.RLock()
+		changed := list.loaded.IsZero() || !info.ModTime().Equal(list.modTime) ||
+			info.Size() != list.size
+		list.RUnlock()
+		if !changed {
+			return false, nil
+		}
+	}
+
+	var (
+		ranges  ipRanges
+		invalid int
+	)
+	if err == nil {
+		var f *os.File
+		if f, err = os.Open(list.path); err == nil {
+			ranges, invalid, err = readBlocklist(f)
+			f.Close()
+		}
+	}
+
+	list.Lock()
+	defer list.Unlock()
+
+	list.err = err
+	if err != nil {
+		return false, err
+	}
+	list.ranges, list.invalid = ranges, invalid
+	list.modTime, list.size = info.ModTime(), info.Size()
+	list.loaded = time.Now()
+	return true, nil
+}
+
+// Watch calls Reload every period until ctx is done.
+func (list *Blocklist) Watch(ctx context.Context, period time.Duration) {
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			list.Reload()
+		}
+	}
+}
+
+// Contains returns whether ip is blocked by the list.
+func (list *Blocklist) Contains(ip net.IP) bool {
+	list.RLock()
+	defer list.RUnlock()
+	return list.ranges.contains(ip)
+}
+
+// Stats returns a snapshot of the list.
+func (list *Blocklist) Stats() BlocklistStats {
+	list.RLock()
+	defer list.RUnlock()
+
+	return BlocklistStats{
+		Name:    list.name,
+		Path:    list.path,
+		Ranges:  len(list.ranges),
+		Invalid: list.invalid,
+		Blocked: atomic.LoadUint64(&list.blocked),
+		Loaded:  list.loaded,
+		Err:     list.err,
+	}
+}
+
+// blocklistUse is a Blocklist added to a blackList, and what it blocks there.
+type blocklistUse struct {
+	// blocked is first to be 64-bit aligned for atomic
+	blocked uint64
+	list    *Blocklist
+	// key is the name of list in listStats, unique in the blackList
+	key string
+}
+
+// addList adds list to bl, it's checked by in until bl is dropped.
+func (bl *blackList) addList(list *Blocklist) {
+	bl.listsMu.Lock()
+	defer bl.listsMu.Unlock()
+
+	keys := make(map[string]bool, len(bl.lists))
+	for _, use := range bl.lists {
+		if use.list == list {
+			return
+		}
+		keys[use.key] = true
+	}
+
+	// 不同的文件可能同名，后加的加上序号，例如 level1.p2p#2
+	key := list.name
+	for i := 2; keys[key]; i++ {
+		key = list.name + "#" + strconv.Itoa(i)
+	}
+	bl.lists = append(bl.lists, &blocklistUse{list: list, key: key})
+}
+
+// inLists returns whether ip is blocked by one of the lists, and counts it.
+func (bl *blackList) inLists(ip net.IP) bool {
+	bl.listsMu.RLock()
+	defer bl.listsMu.RUnlock()
+
+	for _, use := range bl.lists {
+		if use.list.Contains(ip) {
+			atomic.AddUint64(&use.blocked, 1)
+			atomic.AddUint64(&use.list.blocked, 1)
+			return true
+		}
+	}
+	return false
+}
+
+// listStats returns how many times each list blocks in bl, by its key.
+func (bl *blackList) listStats() map[string]uint64 {
+	bl.listsMu.RLock()
+	defer bl.listsMu.RUnlock()
+
+	stats := make(map[string]uint64, len(bl.lists))
+	for _, use := range bl.lists {
+		stats[use.key] = atomic.LoadUint64(&use.blocked)
+	}
+	return stats
+}
+
+/*
+AddBlocklist blocks the ips in list, see Blocklist. A list may be shared by
+several DHTs and Wires, the blocks of each are in Metrics.Blocklists. The
+lists with the same name are keyed there with a suffix, eg level1.p2p#2.
+*/
+func (dht *DHT) AddBlocklist(list *Blocklist) {
+	dht.blackList.addList(list)
+}
+
+// AddBlocklist blocks the peers in list, see DHT.AddBlocklist.
+func (wire *Wire) AddBlocklist(list *Blocklist) {
+	wire.blackList.addList(list)
+}
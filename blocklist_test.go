@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# ipfilter.dat
+001.002.003.000 - 001.002.003.255 , 000 , Some Org
+001.002.003.128 - 001.002.004.010 , 100 , Overlapping: the same org
+005.006.007.000 - 005.006.007.255 , 200 , Allowed
+2001:db8:: - 2001:db8::ffff , 0 , Documentation
+// P2P
+Bad:Guys:009.009.009.001-9.9.9.9
+IPv6: range:2001:db8:1::-2001:db8:1::ff
+not a range
+1.2.3.4 - 1.2.3.1 , 0 , Reversed
+`
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseBlocklist(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"plain": []byte(testBlocklist),
+		"gzip":  gzipped(t, testBlocklist),
+	} {
+		list, err := ParseBlocklist(name, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if s := list.Stats(); s.Name != name || s.Ranges != 4 || s.Invalid != 2 {
+			t.Error(name, s)
+		}
+
+		cases := map[string]bool{
+			"1.2.3.0":         true,
+			"1.2.3.200":       true,
+			"1.2.4.10":        true,
+			"1.2.4.11":        false,
+			"1.2.2.255":       false,
+			"5.6.7.8":         false,
+			"9.9.9.1":         true,
+			"9.9.9.9":         true,
+			"9.9.9.10":        false,
+			"2001:db8::1":     true,
+			"2001:db8::1:0":   false,
+			"2001:db8:1::10":  true,
+			"2001:db8:1::100": false,
+			"::ffff:1.2.3.10": true,
+		}
+		for ip, blocked := range cases {
+			if list.Contains(net.ParseIP(ip)) != blocked {
+				t.Error(name, ip, !blocked)
+			}
+		}
+		if list.Contains(nil) {
+			t.Error(name, "nil ip")
+		}
+	}
+
+	if _, err := ParseBlocklist("broken", bytes.NewReader(
+		gzipped(t, testBlocklist)[:20])); err == nil {
+		t.Error("broken gzip")
+	}
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "level1.p2p.gz")
+	if err := os.WriteFile(path, gzipped(t, "a:1.1.1.1-1.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := list.Stats(); s.Name != "level1.p2p.gz" || s.Path != path ||
+		s.Ranges != 1 || !list.Contains(net.ParseIP("1.1.1.1")) {
+		t.Error(s)
+	}
+	if reloaded, err := list.Reload(); reloaded || err != nil {
+		t.Error("unchanged", reloaded, err)
+	}
+
+	data := gzipped(t, "a:2.2.2.0-2.2.2.255\nb:3.3.3.3-3.3.3.3\n")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := list.Reload(); !reloaded || err != nil {
+		t.Fatal("changed", reloaded, err)
+	}
+	if list.Contains(net.ParseIP("1.1.1.1")) || !list.Contains(net.ParseIP("2.2.2.2")) {
+		t.Error("not reloaded")
+	}
+
+	// 出错时保留原来的
+	if err := os.WriteFile(path, data[:20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := list.Reload(); err == nil {
+		t.Error("broken file")
+	}
+	if s := list.Stats(); s.Err == nil || s.Ranges != 2 {
+		t.Error(s)
+	}
+
+	if _, err := LoadBlocklist(path + ".missing"); err == nil {
+		t.Error("missing file")
+	}
+}
+
+func TestSharedBlocklist(t *testing.T) {
+	list, err := ParseBlocklist("p2p", strings.NewReader("a:1.2.3.0-1.2.3.255\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(newTestConfig())
+	wire := NewWire(16, 16, 16)
+	d.AddBlocklist(list)
+	d.AddBlocklist(list)
+	wire.AddBlocklist(list)
+
+	if !d.blackList.in("1.2.3.4", 1) || !d.blackList.in("1.2.3.5", 1) ||
+		d.blackList.in("1.2.4.4", 1) || !wire.blackList.in("1.2.3.4", 1) {
+		t.Error("not blocked")
+	}
+	if n := d.Metrics().Blocklists["p2p"]; n != 2 {
+		t.Error("dht", n)
+	}
+	if n := wire.Metrics().Blocklists["p2p"]; n != 1 {
+		t.Error("wire", n)
+	}
+	if n := list.Stats().Blocked; n != 3 {
+		t.Error("list", n)
+	}
+
+	// 同名的另一个列表分开统计
+	other, err := ParseBlocklist("p2p", strings.NewReader("a:5.6.7.8-5.6.7.8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBlocklist(other)
+	d.blackList.in("5.6.7.8", 1)
+	if m := d.Metrics().Blocklists; len(m) != 2 || m["p2p"] != 2 ||
+		m["p2p#2"] != 1 {
+		t.Error(m)
+	}
+
+	// ClearAll 不影响 Blocklist
+	d.blackList.ClearAll()
+	if !d.blackList.in("1.2.3.4", 1) {
+		t.Error("cleared")
+	}
+
+	var buf bytes.Buffer
+	if err := d.Metrics().WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if line := `dht_blocklist_blocked_total{list="p2p"} 3`; !strings.Contains(buf.String(), line) {
+		t.Errorf("%q is not in\n%s", line, buf.String())
+	}
+}
@@ -0,0 +1,303 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+dhTrackers.txt 里混着 DHT 路由节点和 udp://.../announce 形式的 UDP tracker，
+GetDhtUdpLists 以前把 tracker 也当成 DHT 节点。CheckBootstrapNodes probes
+every candidate with a KRPC ping and a BEP 15 connect at the same time, the
+nodes answering the ping are asked a find_node as well, and
+WriteBootstrapList writes those alive back, one per line:
+	ip:port                     a DHT node
+	udp://host:port/announce    a UDP tracker
+*/
+
+// BootstrapKind is what a bootstrap candidate turns out to be.
+type BootstrapKind int
+
+const (
+	// BootstrapDead answers neither KRPC nor the UDP tracker protocol.
+	BootstrapDead BootstrapKind = iota
+	// BootstrapDHTNode answers KRPC queries.
+	BootstrapDHTNode
+	// BootstrapUDPTracker answers the BEP 15 connect request.
+	BootstrapUDPTracker
+)
+
+// String returns the name of the kind.
+func (k BootstrapKind) String() string {
+	switch k {
+	case BootstrapDHTNode:
+		return "dht"
+	case BootstrapUDPTracker:
+		return "tracker"
+	}
+	return "dead"
+}
+
+// udpTrackerProtocolID is the magic constant of the BEP 15 connect request.
+const udpTrackerProtocolID = 0x41727101980
+
+// BootstrapCheck is the result of probing a bootstrap candidate.
+type BootstrapCheck struct {
+	// Addr is the host:port of the candidate, without scheme and path.
+	Addr string
+	Kind BootstrapKind
+	// RTT is how long the first answer takes.
+	RTT time.Duration
+	// Nodes is how many nodes a DHT node returns for find_node.
+	Nodes int
+}
+
+/*
+ParseBootstrapCandidate returns the host:port of a line of dhTrackers.txt,
+which is either ip:port or udp://host:port/announce. ok is false for the
+empty lines, comments and the other schemes.
+*/
+func ParseBootstrapCandidate(line string) (addr string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	if strings.Contains(line, "://") {
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme != "udp" {
+			return "", false
+		}
+		line = u.Host
+	}
+
+	host, port, err := net.SplitHostPort(line)
+	if err != nil || host == "" || port == "" {
+		return "", false
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), true
+}
+
+/*
+CheckBootstrapNodes probes the candidates with workers goroutines, each
+probe waits at most timeout for an answer. The candidates are de-duplicated
+by ParseBootstrapCandidate, the invalid ones are dropped. The results are in
+the order of the candidates.
+*/
+func CheckBootstrapNodes(ctx context.Context, candidates []string,
+	timeout time.Duration, workers int) []*BootstrapCheck {
+
+	seen := make(map[string]bool, len(candidates))
+	checks := make([]*BootstrapCheck, 0, len(candidates))
+	for _, line := range candidates {
+		if addr, ok := ParseBootstrapCandidate(line); ok && !seen[addr] {
+			seen[addr] = true
+			checks = append(checks, &BootstrapCheck{Addr: addr})
+		}
+	}
+
+	if workers <= 0 {
+		workers = 1
+	}
+	jobs := make(chan *BootstrapCheck)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				probeBootstrapNode(ctx, check, timeout)
+			}
+		}()
+	}
+
+loop:
+	for _, check := range checks {
+		select {
+		case jobs <- check:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return checks
+}
+
+// probeBootstrapNode fills check.Kind, check.RTT and check.Nodes.
+func probeBootstrapNode(ctx context.Context, check *BootstrapCheck,
+	timeout time.Duration) {
+
+	raddr, err := net.ResolveUDPAddr("udp", check.Addr)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// ctx 取消时让读立即返回
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	id := RandomNodeID().RawString()
+	ping := Encode(makeQuery("pn", pingType,
+		map[string]interface{}{"id": id}, true))
+	trackerTransID := uint32(time.Now().UnixNano())
+	connect := make([]byte, 16)
+	binary.BigEndian.PutUint64(connect[0:], udpTrackerProtocolID)
+	binary.BigEndian.PutUint32(connect[8:], 0)
+	binary.BigEndian.PutUint32(connect[12:], trackerTransID)
+
+	start := time.Now()
+	conn.WriteTo([]byte(ping), raddr)
+	conn.WriteTo(connect, raddr)
+
+	data := make([]byte, 2048)
+	deadline := start.Add(timeout)
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		conn.SetReadDeadline(deadline)
+		n, addr, err := conn.ReadFrom(data)
+		if err != nil {
+			return
+		}
+		if !sameUDPAddr(addr, raddr) {
+			continue
+		}
+
+		if isTrackerConnectResponse(data[:n], trackerTransID) {
+			check.Kind = BootstrapUDPTracker
+			check.RTT = time.Since(start)
+			return
+		}
+		if _, ok := krpcResponse(data[:n], "pn"); ok {
+			check.Kind = BootstrapDHTNode
+			check.RTT = time.Since(start)
+			break
+		}
+	}
+
+	// 能回应 ping 的再问一次 find_node，看是否返回节点
+	findNode := Encode(makeQuery("fn", findNodeType, map[string]interface{}{
+		"id":     id,
+		"target": RandomNodeID().RawString(),
+	}, true))
+	conn.WriteTo([]byte(findNode), raddr)
+
+	deadline = time.Now().Add(timeout)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(deadline)
+		n, addr, err := conn.ReadFrom(data)
+		if err != nil {
+			return
+		}
+		if !sameUDPAddr(addr, raddr) {
+			continue
+		}
+		if r, ok := krpcResponse(data[:n], "fn"); ok {
+			if nodes, ok := r["nodes"].(string); ok {
+				check.Nodes = len(nodes) / 26
+			}
+			return
+		}
+	}
+}
+
+// sameUDPAddr returns whether addr is raddr.
+func sameUDPAddr(addr net.Addr, raddr *net.UDPAddr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && udpAddr.Port == raddr.Port && udpAddr.IP.Equal(raddr.IP)
+}
+
+// isTrackerConnectResponse returns whether data is the BEP 15 connect
+// response of transaction id transID.
+func isTrackerConnectResponse(data []byte, transID uint32) bool {
+	return len(data) >= 16 &&
+		binary.BigEndian.Uint32(data[0:]) == 0 &&
+		binary.BigEndian.Uint32(data[4:]) == transID
+}
+
+// krpcResponse returns the "r" dict of data when it is a response of
+// transaction t with a valid node id.
+func krpcResponse(data []byte, t string) (map[string]interface{}, bool) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, false
+	}
+	v, err := Decode(data)
+	if err != nil {
+		return nil, false
+	}
+	response, err := parseMessage(v)
+	if err != nil || response["t"] != t || response["y"] != "r" {
+		return nil, false
+	}
+	if ParseKey(response, "r", "map") != nil {
+		return nil, false
+	}
+	r := response["r"].(map[string]interface{})
+	if ParseKey(r, "id", "string") != nil || len(r["id"].(string)) != 20 {
+		return nil, false
+	}
+	return r, true
+}
+
+/*
+WriteBootstrapList writes the alive candidates to w in the format of
+dhTrackers.txt, the DHT nodes first, each kind sorted by address.
+*/
+func WriteBootstrapList(w io.Writer, checks []*BootstrapCheck) error {
+	var nodes, trackers []string
+	for _, check := range checks {
+		switch check.Kind {
+		case BootstrapDHTNode:
+			nodes = append(nodes, check.Addr)
+		case BootstrapUDPTracker:
+			trackers = append(trackers, "udp://"+check.Addr+"/announce")
+		}
+	}
+	sort.Strings(nodes)
+	sort.Strings(trackers)
+
+	bw := bufio.NewWriter(w)
+	for _, line := range append(nodes, trackers...) {
+		if _, err := fmt.Fprintln(bw, line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadBootstrapCandidates returns the lines of a dhTrackers.txt formed file.
+func ReadBootstrapCandidates(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := string(bytes.TrimSpace(scanner.Bytes())); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
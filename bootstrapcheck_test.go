@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBootstrapCandidate(t *testing.T) {
+	cases := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"1.2.3.4:6881", "1.2.3.4:6881", true},
+		{" udp://Tracker.Example.com:1337/announce ", "tracker.example.com:1337", true},
+		{"udp://[::1]:80/announce", "[::1]:80", true},
+		{"http://tracker.example.com:80/announce", "", false},
+		{"1.2.3.4", "", false},
+		{"# comment", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		if out, ok := ParseBootstrapCandidate(c.in); out != c.out || ok != c.ok {
+			t.Error(c.in, out, ok)
+		}
+	}
+}
+
+// startTestTracker answers the BEP 15 connect requests.
+func startTestTracker(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		data := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(data)
+			if err != nil {
+				return
+			}
+			if n != 16 || binary.BigEndian.Uint64(data) != udpTrackerProtocolID {
+				continue
+			}
+			resp := make([]byte, 16)
+			copy(resp[4:8], data[12:16])
+			binary.BigEndian.PutUint64(resp[8:], 42)
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn
+}
+
+func TestCheckBootstrapNodes(t *testing.T) {
+	nodes := startTestChain(t, 2)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+
+	tracker := startTestTracker(t)
+	defer tracker.Close()
+
+	dead, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	node := nodes[0].Addr().String()
+	candidates := []string{
+		node,
+		"udp://" + node + "/announce",
+		"udp://" + tracker.LocalAddr().String() + "/announce",
+		dead.LocalAddr().String(),
+		"http://" + node + "/announce",
+	}
+	checks := CheckBootstrapNodes(context.Background(), candidates,
+		time.Second, 4)
+	if len(checks) != 3 {
+		t.Fatal("not de-duplicated", len(checks))
+	}
+
+	want := []BootstrapKind{BootstrapDHTNode, BootstrapUDPTracker, BootstrapDead}
+	for i, check := range checks {
+		if check.Kind != want[i] {
+			t.Error(check.Addr, check.Kind, want[i])
+		}
+	}
+	if checks[0].Nodes != 1 {
+		t.Error("find_node nodes", checks[0].Nodes)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteBootstrapList(buf, checks); err != nil {
+		t.Fatal(err)
+	}
+	out := node + "\nudp://" + tracker.LocalAddr().String() + "/announce\n"
+	if buf.String() != out {
+		t.Error(buf.String())
+	}
+
+	lines, err := ReadBootstrapCandidates(bytes.NewBufferString(out + "\n  \n"))
+	if err != nil || len(lines) != 2 {
+		t.Error(lines, err)
+	}
+}
+
+func TestCheckBootstrapNodesCancel(t *testing.T) {
+	dead, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	checks := CheckBootstrapNodes(ctx, []string{dead.LocalAddr().String()},
+		time.Minute, 1)
+	if time.Since(start) > time.Second*5 || checks[0].Kind != BootstrapDead {
+		t.Error(time.Since(start), checks[0].Kind)
+	}
+}
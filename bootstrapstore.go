@@ -0,0 +1,285 @@
+package dht
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+bootstrapStore remembers the nodes which answered the find_node and ping of
+join and refresh correctly, see query.maintains, so that join tries the
+reliable ones before PrimeNodes. 代替原来写 ~/ips.txt 再用
+upIps.sh 合并到 dhTrackers.txt 的做法。
+The file under Config.StateDir has a line per node:
+	ip:port answered failed last-seen-unix-time
+*/
+
+const (
+	// bootstrapFileName is the name of the file under StateDir.
+	bootstrapFileName = "bootstrap_nodes"
+	// maxBootstrapNodes is how many nodes bootstrapStore keeps.
+	maxBootstrapNodes = 512
+)
+
+// bootstrapNode is a node in bootstrapStore.
+type bootstrapNode struct {
+	addr             string
+	answered, failed int
+	lastSeen         time.Time
+}
+
+// score is the reliability of the node, which is between 0 and 1.
+func (no *bootstrapNode) score() float64 {
+	return float64(no.answered+1) / float64(no.answered+no.failed+2)
+}
+
+// better returns whether no should be tried before other, the ties are broken
+// by address so the order is stable.
+func (no *bootstrapNode) better(other *bootstrapNode) bool {
+	if s1, s2 := no.score(), other.score(); s1 != s2 {
+		return s1 > s2
+	}
+	if !no.lastSeen.Equal(other.lastSeen) {
+		return no.lastSeen.After(other.lastSeen)
+	}
+	return no.addr < other.addr
+}
+
+/*
+bootstrapStore keeps the best maxSize nodes. The worst aren't looked for on
+every new node: up to twice as many are kept, then pruned at once.
+*/
+type bootstrapStore struct {
+	sync.Mutex
+	nodes   map[string]*bootstrapNode
+	maxSize int
+	changed bool
+}
+
+// newBootstrapStore returns a new bootstrapStore pointer.
+func newBootstrapStore(maxSize int) *bootstrapStore {
+	return &bootstrapStore{
+		nodes:   make(map[string]*bootstrapNode),
+		maxSize: maxSize,
+	}
+}
+
+// answered records that the node on addr answers a query at now.
+func (bs *bootstrapStore) answered(addr string, now time.Time) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	no, ok := bs.nodes[addr]
+	if !ok {
+		no = &bootstrapNode{addr: addr}
+		bs.nodes[addr] = no
+	}
+	no.answered++
+	no.lastSeen = now
+	bs.changed = true
+
+	if len(bs.nodes) >= bs.maxSize*2 {
+		bs.prune()
+	}
+}
+
+// failed records that the node on addr doesn't answer, the unknown nodes are
+// ignored.
+func (bs *bootstrapStore) failed(addr string) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	if no, ok := bs.nodes[addr]; ok {
+		no.failed++
+		bs.changed = true
+	}
+}
+
+// prune keeps the best maxSize nodes. bs must be locked.
+func (bs *bootstrapStore) prune() {
+	nodes := make([]*bootstrapNode, 0, len(bs.nodes))
+	for _, no := range bs.nodes {
+		nodes = append(nodes, no)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].better(nodes[j]) })
+
+	for _, no := range nodes[bs.maxSize:] {
+		delete(bs.nodes, no.addr)
+	}
+}
+
+// sorted returns a copy of the best maxSize nodes, the most reliable first.
+func (bs *bootstrapStore) sorted() []bootstrapNode {
+	bs.Lock()
+	nodes := make([]bootstrapNode, 0, len(bs.nodes))
+	for _, no := range bs.nodes {
+		nodes = append(nodes, *no)
+	}
+	bs.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].better(&nodes[j]) })
+	if len(nodes) > bs.maxSize {
+		nodes = nodes[:bs.maxSize]
+	}
+	return nodes
+}
+
+// ranked returns the addresses of the nodes, the most reliable first.
+func (bs *bootstrapStore) ranked() []string {
+	nodes := bs.sorted()
+	addrs := make([]string, len(nodes))
+	for i, no := range nodes {
+		addrs[i] = no.addr
+	}
+	return addrs
+}
+
+// read adds the nodes written by write, the invalid lines are skipped.
+func (bs *bootstrapStore) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+
+		answered, err1 := strconv.Atoi(fields[1])
+		failed, err2 := strconv.Atoi(fields[2])
+		seen, err3 := strconv.ParseInt(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+
+		bs.Lock()
+		if _, ok := bs.nodes[fields[0]]; !ok && len(bs.nodes) < bs.maxSize {
+			bs.nodes[fields[0]] = &bootstrapNode{
+				addr:     fields[0],
+				answered: answered,
+				failed:   failed,
+				lastSeen: time.Unix(seen, 0),
+			}
+		}
+		bs.Unlock()
+	}
+	return scanner.Err()
+}
+
+// write writes the nodes to w, the most reliable first.
+func (bs *bootstrapStore) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, no := range bs.sorted() {
+		if _, err := fmt.Fprintf(bw, "%s %d %d %d\n", no.addr, no.answered,
+			no.failed, no.lastSeen.Unix()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// load reads the nodes from file, a missing file is not an error.
+func (bs *bootstrapStore) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	return bs.read(f)
+}
+
+// save writes the nodes to file if they have changed since the last save.
+func (bs *bootstrapStore) save(file string) error {
+	bs.Lock()
+	changed := bs.changed
+	bs.changed = false
+	bs.Unlock()
+
+	if !changed {
+		return nil
+	}
+	err := bs.writeFile(file)
+	if err != nil {
+		bs.Lock()
+		bs.changed = true
+		bs.Unlock()
+	}
+	return err
+}
+
+// writeFile writes the nodes to file.
+func (bs *bootstrapStore) writeFile(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// 先写临时文件再改名，避免写一半的文件
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := bs.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// bootstrapFile returns the file of the learned bootstrap nodes, "" when
+// StateDir is not set.
+func (dht *DHT) bootstrapFile() string {
+	if dht.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(dht.StateDir, bootstrapFileName)
+}
+
+// saveBootstrapNodes writes the learned bootstrap nodes under StateDir.
+func (dht *DHT) saveBootstrapNodes() {
+	if file := dht.bootstrapFile(); file != "" {
+		if err := dht.bootstrapNodes.save(file); err != nil {
+			dht.Log("save bootstrap nodes: ", err)
+		}
+	}
+}
+
+/*
+bootstrapList returns the addresses join sends find_node to: the learned
+nodes, the most reliable first, then PrimeNodes.
+*/
+func (dht *DHT) bootstrapList() []string {
+	addrs := dht.bootstrapNodes.ranked()
+
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		seen[addr] = true
+	}
+	for _, addr := range dht.PrimeNodes {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// WithStateDir sets the directory the dht keeps its state in.
+func WithStateDir(dir string) Option {
+	return func(config *Config) {
+		config.StateDir = dir
+	}
+}
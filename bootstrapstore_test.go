@@ -0,0 +1,154 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBootstrapStoreRanked(t *testing.T) {
+	bs := newBootstrapStore(3)
+	now := time.Now()
+
+	bs.answered("1.1.1.1:1", now)
+	bs.answered("2.2.2.2:2", now.Add(time.Second))
+	bs.answered("3.3.3.3:3", now)
+	bs.answered("3.3.3.3:3", now)
+	bs.failed("1.1.1.1:1")
+	bs.failed("4.4.4.4:4")
+
+	want := []string{"3.3.3.3:3", "2.2.2.2:2", "1.1.1.1:1"}
+	if got := bs.ranked(); !reflect.DeepEqual(got, want) {
+		t.Fatal(got)
+	}
+
+	// 满了删掉最差的
+	bs.answered("5.5.5.5:5", now)
+	want = []string{"3.3.3.3:3", "2.2.2.2:2", "5.5.5.5:5"}
+	if got := bs.ranked(); !reflect.DeepEqual(got, want) {
+		t.Error(got)
+	}
+}
+
+func TestBootstrapStoreSave(t *testing.T) {
+	bs := newBootstrapStore(maxBootstrapNodes)
+	seen := time.Unix(time.Now().Unix(), 0)
+	bs.answered("1.1.1.1:1", seen)
+	bs.answered("2.2.2.2:2", seen)
+	bs.failed("2.2.2.2:2")
+
+	buf := &bytes.Buffer{}
+	if err := bs.write(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("invalid line\n")
+
+	read := newBootstrapStore(maxBootstrapNodes)
+	if err := read.read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read.sorted(), bs.sorted()) {
+		t.Error(read.sorted(), bs.sorted())
+	}
+
+	file := filepath.Join(t.TempDir(), "state", bootstrapFileName)
+	if err := bs.save(file); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(file)
+	if err := bs.save(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("saved without changes")
+	}
+
+	bs.answered("3.3.3.3:3", seen)
+	if err := bs.save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newBootstrapStore(maxBootstrapNodes)
+	if err := loaded.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.ranked(); !reflect.DeepEqual(got, bs.ranked()) {
+		t.Error(got)
+	}
+
+	if err := loaded.load(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBootstrapList(t *testing.T) {
+	config := newTestConfig()
+	config.PrimeNodes = []string{"1.1.1.1:1", "2.2.2.2:2", "1.1.1.1:1"}
+	d := New(config)
+	d.bootstrapNodes.answered("2.2.2.2:2", time.Now())
+
+	want := []string{"2.2.2.2:2", "1.1.1.1:1"}
+	if got := d.bootstrapList(); !reflect.DeepEqual(got, want) {
+		t.Error(got)
+	}
+}
+
+func TestLearnBootstrapNodes(t *testing.T) {
+	nodes := startTestChain(t, 2)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+	primes := append([]string(nil), nodes[0].PrimeNodes...)
+	learned := func() bool {
+		for _, addr := range nodes[0].bootstrapNodes.ranked() {
+			if addr == nodes[1].Addr().String() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// lookup 的回应不记录
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := nodes[0].FindNode(ctx, nodes[1].NodeID()); err != nil {
+		t.Fatal(err)
+	}
+	if learned() {
+		t.Error("node answering a lookup is learned")
+	}
+
+	// join 的 find_node 有回应就记录
+	nodes[0].Join2addr(nodes[1].Addr().String())
+	for i := 0; i < 100 && !learned(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !learned() {
+		t.Error("node answering join is not learned")
+	}
+	if !reflect.DeepEqual(nodes[0].PrimeNodes, primes) {
+		t.Error("PrimeNodes is changed")
+	}
+}
+
+func TestBootstrapStorePrune(t *testing.T) {
+	bs := newBootstrapStore(2)
+	now := time.Now()
+	for _, addr := range []string{"1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3"} {
+		bs.answered(addr, now)
+		bs.answered(addr, now)
+	}
+	if len(bs.nodes) != 3 || len(bs.ranked()) != 2 {
+		t.Error("pruned early", len(bs.nodes), bs.ranked())
+	}
+
+	// 到两倍时一起删，新的节点分数低
+	bs.answered("4.4.4.4:4", now)
+	want := []string{"1.1.1.1:1", "2.2.2.2:2"}
+	if got := bs.ranked(); len(bs.nodes) != 2 || !reflect.DeepEqual(got, want) {
+		t.Error(len(bs.nodes), got)
+	}
+}
@@ -0,0 +1,241 @@
+package dht
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConfigErrors is returned by Config.Validate, it holds every problem found.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Has returns whether field is one of the invalid fields.
+func (errs ConfigErrors) Has(field string) bool {
+	for _, e := range errs {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Validate checks the fields and their combinations, it returns a ConfigErrors
+reporting all the problems at once, or nil when config is valid.
+*/
+func (config *Config) Validate() error {
+	var errs ConfigErrors
+	check := func(ok bool, field, reason string) {
+		if !ok {
+			errs = append(errs, &ConfigError{field, reason})
+		}
+	}
+
+	if config.LocalNodeId != "" {
+		_, err := ParseNodeID(config.LocalNodeId)
+		check(err == nil, "LocalNodeId",
+			"should be a 20-length raw or 40-length hex string")
+	}
+
+	// 没有ip就推不出安全的id，不悄悄退回随机id
+	if config.SecureNodeID {
+		check(net.ParseIP(config.PublicIp) != nil, "PublicIp",
+			"should be an ip when SecureNodeID is set, eg from ResolvePublicIP")
+	}
+
+	check(config.Mode == StandardMode || config.Mode == CrawlMode,
+		"Mode", "should be StandardMode or CrawlMode")
+	check(config.NodeIDPolicy >= AcceptAnyNodeID &&
+		config.NodeIDPolicy <= RequireSecureNodeID, "NodeIDPolicy",
+		"should be one of AcceptAnyNodeID, PreferSecureNodeID, RequireSecureNodeID")
+	check(config.K > 0, "K", "should be greater than 0")
+	check(config.KBucketSize > 0, "KBucketSize", "should be greater than 0")
+	if config.Mode == StandardMode {
+		check(config.KBucketSize >= config.K,
+			"KBucketSize", "should be no less than K in StandardMode")
+		check(config.NodeExpriedAfter > 0,
+			"NodeExpriedAfter", "should be greater than 0 in StandardMode")
+		check(config.KBucketExpiredAfter > 0,
+			"KBucketExpiredAfter", "should be greater than 0 in StandardMode")
+		check(config.MaxItems > 0,
+			"MaxItems", "should be greater than 0 in StandardMode")
+		check(config.ItemExpiredAfter > 0,
+			"ItemExpiredAfter", "should be greater than 0 in StandardMode")
+	}
+
+	switch config.Network {
+	case "udp", "udp4", "udp6":
+		// PacketConn 已经有地址了
+		if config.PacketConn == nil {
+			_, err := net.ResolveUDPAddr(config.Network, config.Address)
+			check(err == nil, "Address", "should be a `ip:port` address")
+		}
+	default:
+		check(false, "Network", "should be one of udp, udp4, udp6")
+	}
+
+	check(config.PortRange[0] <= config.PortRange[1] &&
+		config.PortRange[0] >= 0 && config.PortRange[1] <= 65535,
+		"PortRange", "should be a valid port range")
+	check(config.CheckKBucketPeriod > 0,
+		"CheckKBucketPeriod", "should be greater than 0")
+	check(config.TokenExpiredAfter > 0,
+		"TokenExpiredAfter", "should be greater than 0")
+	check(config.MaxTransactionCursor > 0,
+		"MaxTransactionCursor", "should be greater than 0")
+	check(config.MaxNodes > 0, "MaxNodes", "should be greater than 0")
+	check(config.BlackListMaxSize > 0,
+		"BlackListMaxSize", "should be greater than 0")
+	check(config.Try > 0, "Try", "should be greater than 0")
+	check(config.PacketJobLimit > 0,
+		"PacketJobLimit", "should be greater than 0")
+	check(config.PacketWorkerLimit > 0,
+		"PacketWorkerLimit", "should be greater than 0")
+	check(config.PacketWorkerLimit <= config.PacketJobLimit,
+		"PacketWorkerLimit", "should be no greater than PacketJobLimit")
+	check(config.RefreshNodeNum > 0,
+		"RefreshNodeNum", "should be greater than 0")
+	check(config.QueryWorkLimit > 0,
+		"QueryWorkLimit", "should be greater than 0")
+	for field, rl := range map[string]RateLimit{
+		"IPRateLimit":       config.IPRateLimit,
+		"QueryRateLimit":    config.QueryRateLimit,
+		"OutboundRateLimit": config.OutboundRateLimit,
+	} {
+		check(rl.valid(), field,
+			"should have Rate 0, or a positive Rate and Burst")
+	}
+	check(config.RateLimitStrikes >= 0,
+		"RateLimitStrikes", "should be no less than 0")
+	for _, s := range config.BlockedIPs {
+		if _, err := parsePrefixes(s); err != nil {
+			check(false, "BlockedIPs", err.Error())
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Clone returns a deep copy of config.
+func (config *Config) Clone() *Config {
+	c := *config
+	c.PrimeNodes = append([]string(nil), config.PrimeNodes...)
+	c.BlockedIPs = append([]string(nil), config.BlockedIPs...)
+	c.AnnouncePeerLists = append([]string(nil), config.AnnouncePeerLists...)
+	c.GetPeerLists = append([]string(nil), config.GetPeerLists...)
+	return &c
+}
+
+/*
+With returns a copy of config with opts applied, config itself is not
+changed, so a shared default config can be reused safely.
+*/
+func (config *Config) With(opts ...Option) *Config {
+	c := config.Clone()
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Option changes a field of Config, see NewStandardConfig and Config.With.
+type Option func(*Config)
+
+// WithAddress sets the `ip:port` address to listen on.
+func WithAddress(address string) Option {
+	return func(config *Config) {
+		config.Address = address
+	}
+}
+
+// WithNetwork sets the network, one of udp, udp4, udp6.
+func WithNetwork(network string) Option {
+	return func(config *Config) {
+		config.Network = network
+	}
+}
+
+// WithPacketConn makes the dht run on conn instead of listening Address.
+func WithPacketConn(conn net.PacketConn) Option {
+	return func(config *Config) {
+		config.PacketConn = conn
+	}
+}
+
+// WithPortRange sets the ports tried when Address can't be listened.
+func WithPortRange(from, to int) Option {
+	return func(config *Config) {
+		config.PortRange = [2]int{from, to}
+	}
+}
+
+/*
+WithMode sets the mode. CrawlMode also sets the crawling defaults, see
+NewCrawlConfig.
+*/
+func WithMode(mode int) Option {
+	return func(config *Config) {
+		config.Mode = mode
+		if mode != CrawlMode {
+			return
+		}
+
+		config.NodeExpriedAfter = 0
+		config.KBucketExpiredAfter = 0
+		config.CheckKBucketPeriod = time.Second * 5
+		config.KBucketSize = maxKBucketSize
+		config.RefreshNodeNum = 256
+		config.OutboundRateLimit = RateLimit{}
+	}
+}
+
+// WithBootstrap replaces the prime nodes used to join the dht network.
+func WithBootstrap(nodes ...string) Option {
+	return func(config *Config) {
+		config.PrimeNodes = append([]string(nil), nodes...)
+	}
+}
+
+// WithK sets K and KBucketSize.
+func WithK(k int) Option {
+	return func(config *Config) {
+		config.K = k
+		if config.Mode == StandardMode {
+			config.KBucketSize = k
+		}
+	}
+}
+
+// WithBlockedIPs adds ips, CIDRs or `start-end` ranges to the blacklist.
+func WithBlockedIPs(ips ...string) Option {
+	return func(config *Config) {
+		config.BlockedIPs = append(config.BlockedIPs, ips...)
+	}
+}
+
+// WithPacketLimits sets PacketJobLimit and PacketWorkerLimit.
+func WithPacketLimits(jobs, workers int) Option {
+	return func(config *Config) {
+		config.PacketJobLimit = jobs
+		config.PacketWorkerLimit = workers
+	}
+}
+
+// WithLogger sets the logger, nil disables logging.
+func WithLogger(logger *log.Logger) Option {
+	return func(config *Config) {
+		config.Log = logger
+	}
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	if err := newTestConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig().With(
+		WithNetwork("tcp"),
+		WithPacketLimits(8, 16),
+		WithK(0),
+	)
+	config.CheckKBucketPeriod = 0
+
+	err := config.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{
+		"Network", "PacketWorkerLimit", "K", "CheckKBucketPeriod"} {
+		if !errs.Has(field) {
+			t.Error(field, err)
+		}
+	}
+
+	config = newTestConfig()
+	config.KBucketSize = config.K - 1
+	if err := config.Validate(); err == nil {
+		t.Fail()
+	}
+
+	// KBucketSize has no limit in CrawlMode.
+	if err := config.With(WithMode(CrawlMode)).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWith(t *testing.T) {
+	defaults := newTestConfig()
+	defaults.PrimeNodes = []string{"1.1.1.1:6881"}
+
+	config := defaults.With(
+		WithAddress("127.0.0.1:6881"),
+		WithMode(CrawlMode),
+		WithBootstrap("2.2.2.2:6881"),
+		WithBlockedIPs("3.3.3.3"),
+	)
+
+	if config.Address != "127.0.0.1:6881" || config.Mode != CrawlMode ||
+		config.KBucketSize != maxKBucketSize ||
+		config.CheckKBucketPeriod != time.Second*5 ||
+		config.PrimeNodes[0] != "2.2.2.2:6881" ||
+		len(config.BlockedIPs) != 1 {
+		t.Error(config)
+	}
+
+	// the defaults are not changed
+	if defaults.Address != "127.0.0.1:0" || defaults.Mode != StandardMode ||
+		defaults.PrimeNodes[0] != "1.1.1.1:6881" ||
+		len(defaults.BlockedIPs) != 0 {
+		t.Error(defaults)
+	}
+}
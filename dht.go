@@ -3,15 +3,15 @@
 package dht
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"log"
 	"math"
 	"net"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +20,8 @@ const (
 	StandardMode = iota
 	// CrawlMode for crawling the dht network.值为1
 	CrawlMode
-	// 关闭记录成功解析的ip地址
-	bCloseRcdIps = true
+	// for crawling mode, we put all nodes in one bucket
+	maxKBucketSize = math.MaxInt32
 )
 
 var (
@@ -31,21 +31,54 @@ var (
 	// OnGetPeersResponseNotSet is not set when call dht.GetPeers.
 	ErrOnGetPeersResponseNotSet = errors.New("OnGetPeersResponse is not set")
 	ErrOnAnnouncePeerNotSet     = errors.New("OnAnnouncePeer is not set")
+	// ErrRunning is the error when Start or Run is called on a running DHT.
+	ErrRunning = errors.New("dht is already running")
 )
 
+// DefaultPortRange is the port range BT clients usually listen on.
+var DefaultPortRange = [2]int{6881, 6889}
+
 // Config represents the configure of dht.
 type Config struct {
-	// 本地节点id
+	// 本地节点id, the 40-length hex or 20-length raw id. If empty, it is
+	// loaded from NodeIDFile or generated randomly, NewDHT doesn't change it,
+	// see DHT.NodeID for the id in use.
 	LocalNodeId string
+	// the file node id is loaded from and saved to, empty means the id is not
+	// kept between restarts
+	NodeIDFile string
+	// the file the routing table is saved to on Stop and loaded from on Run,
+	// so a restarted node pings the nodes it knew instead of PrimeNodes.
+	// Empty means the routing table is not kept between restarts
+	RoutingTableFile string
+	// the directory the dht keeps its state in, eg the nodes learned to
+	// bootstrap from. Empty means the state is not kept between restarts
+	StateDir string
+	// derive the node id from PublicIp, see BEP 42. PublicIp must be set,
+	// eg by ResolvePublicIP
+	SecureNodeID bool
+	// AcceptAnyNodeID, PreferSecureNodeID or RequireSecureNodeID
+	NodeIDPolicy int
 	// in mainline dht, k = 8
 	K int
 	// for crawling mode, we put all nodes in one bucket, so KBucketSize may
 	// not be K
 	KBucketSize int
-	// candidates are udp, udp4, udp6
+	// candidates are udp, udp4, udp6. udp on an unspecified address, eg ":0",
+	// runs ipv4 and ipv6 together, see BEP 32
 	Network string
 	// format is `ip:port`
 	Address string
+	// when Address can't be listened, try the ports from PortRange[0] to
+	// PortRange[1] on the same ip in turn, eg DefaultPortRange. {0, 0}
+	// disables it.
+	PortRange [2]int
+	// PacketConn is the conn the dht runs on instead of listening Address,
+	// eg a socket shared with uTP or an in-memory conn in tests. Its
+	// addresses should be *net.UDPAddr or `ip:port`. Stop neither closes
+	// it nor touches its deadlines, the packets read while stopped are
+	// dropped. Closing it ends the read loop.
+	PacketConn net.PacketConn
 	// the prime nodes through which we can join in dht network
 	PrimeNodes []string
 	// the kbucket expired duration
@@ -54,30 +87,58 @@ type Config struct {
 	NodeExpriedAfter time.Duration
 	// how long it checks whether the bucket is expired
 	CheckKBucketPeriod time.Duration
-	// peer token expired duration
+	// peer token expired duration, the secret of tokens is changed every
+	// half of it, see BEP 5
 	TokenExpiredAfter time.Duration
+	// how many BEP 44 items are stored for other nodes, and how long they
+	// are kept after put
+	MaxItems         int
+	ItemExpiredAfter time.Duration
 	// the max transaction id
 	MaxTransactionCursor uint64
 	// how many nodes routing table can hold
 	MaxNodes int
 	// callback when got get_peers request
+	//
+	// Deprecated: use DHT.Subscribe(EventGetPeersQuery). The callbacks are
+	// still called synchronously by the packet workers, like before.
 	OnGetPeers func(string, string, int)
 	// callback when receive get_peers response
+	//
+	// Deprecated: use DHT.Subscribe(EventPeerFound).
 	OnGetPeersResponse func(string, *Peer)
 	// callback when got announce_peer request
+	//
+	// Deprecated: use DHT.Subscribe(EventAnnouncePeer).
 	OnAnnouncePeer func(string, string, int)
-	// blcoked ips
+	// blcoked ips, CIDRs like 10.0.0.0/8 or ranges like 1.2.3.0-1.2.3.9
 	BlockedIPs []string
+	// keep the nodes on the private, loopback, multicast and other
+	// unroutable ranges out of the routing table, see bogons. The packets
+	// from them are still handled.
+	BlockBogons bool
 	// blacklist size
 	BlackListMaxSize int
 	// StandardMode or CrawlMode
 	Mode int
+	// ReadOnly sends ro=1 in queries and doesn't answer queries, for the
+	// nodes behind a strict NAT or on mobile, see BEP 43
+	ReadOnly bool
 	// the times it tries when send fails
 	Try int
 	// the size of packet need to be dealt with
 	PacketJobLimit int
 	// the size of packet handler
 	PacketWorkerLimit int
+	// the packets allowed from a single ip, see RateLimit
+	IPRateLimit RateLimit
+	// the queries of each type allowed from a single ip
+	QueryRateLimit RateLimit
+	// the queries sent by the dht, they wait when it's used up
+	OutboundRateLimit RateLimit
+	// an ip exceeding IPRateLimit or QueryRateLimit so many times is
+	// blacklisted, 0 means never
+	RateLimitStrikes int
 	// the nodes num to be fresh in a kbucket
 	RefreshNodeNum int
 	// 发布的资源信息
@@ -85,11 +146,15 @@ type Config struct {
 	GetPeerLists      []string
 	StunList          StunList
 	PublicIp          string
-	QueryWorkLimit    int
-	Log               *log.Logger
+	// discovers PublicIp, nil means no discovery, see ResolvePublicIP
+	PublicIPResolver PublicIPResolver
+	QueryWorkLimit   int
+	Log              *log.Logger
 }
 
 var (
+	// LocalNodeId is the infohash the samples announce to find each other,
+	// it isn't used as node id, see Config.LocalNodeId.
 	LocalNodeId = hex.EncodeToString([]byte("https://ee.51pwn.com"))[:20]
 	g_nX        = 1
 )
@@ -98,6 +163,7 @@ var (
 NewStandardConfig returns a Config pointer with default values.
 default:
 	BlackListMaxSize:     65536
+	BlockBogons: false，为 true 时私有、保留地址的节点不进路由表
 	MaxTransactionCursor:math.MaxUint32
 	Address:    ":0"
 	Network:     "udp4",
@@ -107,12 +173,18 @@ default:
 	KBucketExpiredAfter、NodeExpriedAfter：15分钟
 	CheckKBucketPeriod：30秒
 	TokenExpiredAfter：10分钟
+	// 每个ip每秒20个数据包，每种查询每秒5个，超限200次加入黑名单
+	IPRateLimit:       {Rate: 20, Burst: 100}
+	QueryRateLimit:    {Rate: 5, Burst: 20}
+	OutboundRateLimit: {Rate: 1000, Burst: 2000}
+	RateLimitStrikes:  200
+opts are applied at last, eg NewStandardConfig(WithAddress(":6881")).
+It does no network I/O, the public ip is discovered by ResolvePublicIP.
 
 */
-func NewStandardConfig() *Config {
+func NewStandardConfig(opts ...Option) *Config {
 	var xx *Config
 	xx = &Config{
-		LocalNodeId: LocalNodeId,
 		K:           8,
 		KBucketSize: 8,
 		Network:     "udp4",
@@ -127,15 +199,22 @@ func NewStandardConfig() *Config {
 		CheckKBucketPeriod: time.Duration(time.Second * 30),
 		// token有效期10分钟
 		TokenExpiredAfter:    time.Duration(time.Minute * 10),
+		MaxItems:             1000,
+		ItemExpiredAfter:     time.Duration(time.Hour * 2),
 		MaxTransactionCursor: math.MaxUint32,
 		// default 5000
 		MaxNodes:          50000 * g_nX,
 		BlockedIPs:        make([]string, 0),
+		BlockBogons:       false,
 		BlackListMaxSize:  65536,
 		Try:               2,
 		Mode:              StandardMode,
 		PacketJobLimit:    1024 * g_nX,
 		PacketWorkerLimit: 256 * g_nX,
+		IPRateLimit:       RateLimit{Rate: 20, Burst: 100},
+		QueryRateLimit:    RateLimit{Rate: 5, Burst: 20},
+		OutboundRateLimit: RateLimit{Rate: 1000 * float64(g_nX), Burst: 2000 * g_nX},
+		RateLimitStrikes:  200,
 		RefreshNodeNum:    8 * g_nX,
 		StunList:          StunList{},
 		// 避免query太多导致cpu太高
@@ -143,19 +222,10 @@ func NewStandardConfig() *Config {
 		Log:            log.New(os.Stdout, "", 5),
 	}
 	xx.PrimeNodes = xx.StunList.GetDhtUdpLists()
-	// fmt.Printf("start get IP ")
-	// ip, port := xx.StunList.GetSelfPublicIpPort()
-	ip, port := xx.StunList.GetSelfPublicIpPort()
-
-	// Nat 后的port
-	xx.Address = fmt.Sprintf(":%d", port)
-	if "" != ip {
-		xx.PublicIp = ip
-		if nil != xx.Log {
-			xx.Log.Println("your public IP is ", ip, " port ", port)
-		}
-	}
 
+	for _, opt := range opts {
+		opt(xx)
+	}
 	return xx
 }
 
@@ -166,33 +236,59 @@ NewCrawlConfig returns a config in crawling mode.
 2、监测kbucket周期5秒
 3、当前node为空节点
 4、当前配置从 NewStandardConfig 获得模版后再进行修改的配置
+5、发出的查询不限速，OutboundRateLimit 为0
+opts are applied after the crawling defaults.
 */
-func NewCrawlConfig() *Config {
-	config := NewStandardConfig()
-	config.NodeExpriedAfter = 0
-	config.KBucketExpiredAfter = 0
-	config.CheckKBucketPeriod = time.Second * 5
-	config.KBucketSize = math.MaxInt32
+func NewCrawlConfig(opts ...Option) *Config {
 	// 空节点模式用于做爬虫专用
-	config.Mode = CrawlMode
-	config.RefreshNodeNum = 256
-
-	return config
+	return NewStandardConfig(append([]Option{WithMode(CrawlMode)}, opts...)...)
 }
 
 // DHT represents a DHT node.
 type DHT struct {
 	*Config
 	node               *node
-	conn               *net.UDPConn
+	conn               net.PacketConn
 	routingTable       *routingTable
+	routingTable6      *routingTable
 	transactionManager *transactionManager
 	peersManager       *peersManager
 	tokenManager       *tokenManager
+	itemStore          *itemStore
 	blackList          *blackList
-	Ready              bool
-	packets            chan packet
-	workerTokens       chan struct{}
+	ipVoter            *ipVoter
+	clock              clock
+	// bogons is nil unless BlockBogons is set
+	bogons *prefixTree
+	// the nodes imported before Run, see ImportRoutingTable
+	savedNodes []*node
+	// the nodes answering our queries, join tries them first
+	bootstrapNodes *bootstrapStore
+	// the counters of Metrics
+	metrics *metrics
+	// the subscribers of Subscribe
+	events *eventBus
+	// the limits of the inbound packets and the outbound queries
+	ipLimiter *ipLimiter
+	outbound  *outboundLimiter
+	Ready     bool
+	// the ip families the dht runs, see setFamilies
+	ipv4, ipv6   bool
+	packets      chan packet
+	workerTokens chan struct{}
+	// closing is closed when the node begins to stop, done is closed once
+	// every background goroutine has returned.
+	closing chan struct{}
+	done    chan struct{}
+	running bool
+	// starting is set while init is listening, before running
+	starting bool
+	// reading is the PacketConn whose reader is running, see listen
+	reading net.PacketConn
+	runMu   sync.RWMutex
+	wg      sync.WaitGroup
+	// publicIPMu guards PublicIp, which is learned while running
+	publicIPMu sync.RWMutex
 }
 
 func (dht *DHT) Log(args ...interface{}) {
@@ -204,54 +300,134 @@ func (dht *DHT) Log(args ...interface{}) {
 /*
 New returns a DHT pointer. If config is nil, then config will be set to
 the default config.
+It panics when NewDHT returns an error.
+*/
+func New(config *Config) *DHT {
+	d, err := NewDHT(config)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+/*
+NewDHT returns a DHT pointer. If config is nil, then config will be set to
+the default config.
 注意：
-1、创建了一个随机id的节点
+1、节点id见 DHT.NodeID，config 不会被修改，可以给多个节点用
 workerTokens满了，数量等于 PacketWorkerLimit时，数据就丢弃
+It returns the ConfigErrors of config.Validate, or a *NodeIDError when
+config is invalid.
 */
-func New(config *Config) *DHT {
+func NewDHT(config *Config) (*DHT, error) {
 	if config == nil {
 		config = NewStandardConfig()
 	}
 
-	if "" == config.LocalNodeId {
-		config.LocalNodeId = LocalNodeId
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
-	// node, err := newNode(config.LocalNodeId, config.Network, config.Address)
+
 	// 每个节点id全球唯一，写死了要出问题
-	node, err := newNode(randomString(20), config.Network, config.Address)
+	id, err := config.nodeID()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	node, err := newNode(id.RawString(), config.Network, config.Address)
+	if err != nil {
+		return nil, &ConfigError{"Address", err.Error()}
 	}
 
 	d := &DHT{
-		Config:       config,
-		node:         node,
-		blackList:    newBlackList(config.BlackListMaxSize),
-		packets:      make(chan packet, config.PacketJobLimit),
-		workerTokens: make(chan struct{}, config.PacketWorkerLimit),
+		Config:         config,
+		node:           node,
+		blackList:      newBlackList(config.BlackListMaxSize),
+		ipVoter:        newIPVoter(),
+		clock:          realClock{},
+		bootstrapNodes: newBootstrapStore(maxBootstrapNodes),
+		metrics:        newMetrics(),
+		events:         newEventBus(),
+		outbound:       &outboundLimiter{limit: config.OutboundRateLimit},
+		packets:        make(chan packet, config.PacketJobLimit),
+		workerTokens:   make(chan struct{}, config.PacketWorkerLimit),
 	}
+	d.ipLimiter = newIPLimiter(config.IPRateLimit, config.QueryRateLimit,
+		config.RateLimitStrikes)
 
-	for _, ip := range config.BlockedIPs {
-		d.blackList.insert(ip, -1)
+	d.initBlackList()
+	if config.BlockBogons {
+		d.bogons = newBogonTree()
 	}
-	d.self2black()
-	return d
+	d.blackList.inserted = func(ip string, port int) {
+		d.events.publish(BlacklistedEvent{IP: ip, Port: port})
+	}
+
+	if file := d.bootstrapFile(); file != "" {
+		if err := d.bootstrapNodes.load(file); err != nil {
+			d.Log("load bootstrap nodes: ", err)
+		}
+	}
+	return d, nil
+}
+
+// initBlackList blocks BlockedIPs and the ips of itself.
+func (dht *DHT) initBlackList() {
+	for _, s := range dht.BlockedIPs {
+		// Validate 已经检查过了
+		prefixes, _ := parsePrefixes(s)
+		dht.blackList.block(prefixes...)
+	}
+	dht.self2black()
 }
 
-// 本地ip都加入黑名单不处理
+// isBogon returns whether ip is one of the bogons kept out of the routing
+// table by BlockBogons.
+func (dht *DHT) isBogon(ip net.IP) bool {
+	if dht.bogons == nil {
+		return false
+	}
+	_, ok := dht.bogons.lookup(ip)
+	return ok
+}
+
+// 本地ip和public ip都加入黑名单不处理，避免和自己通讯
 func (dht *DHT) self2black() {
-	//
-	go func() {
-		for _, ip := range getLocalIPs() {
-			dht.blackList.insert(ip, -1)
+	ips := getLocalIPs()
+	if ip := dht.publicIP(); "" != ip {
+		ips = append(ips, ip)
+	}
+	for _, ip := range ips {
+		if ip := net.ParseIP(ip); ip != nil {
+			dht.blackList.block(hostPrefix(ip))
 		}
+	}
+}
 
-		// 不明白把自己加入黑名单干什么
-		ip, err := getRemoteIP()
-		if err != nil {
-			dht.blackList.insert(ip, -1)
-		}
-	}()
+// publicIP returns PublicIp.
+func (dht *DHT) publicIP() string {
+	dht.publicIPMu.RLock()
+	defer dht.publicIPMu.RUnlock()
+
+	return dht.PublicIp
+}
+
+/*
+setPublicIP changes PublicIp, it returns the old one. With SecureNodeID, the
+node id is kept for the running node and a mismatch with ip is logged, the
+next NewDHT derives a new one.
+*/
+func (dht *DHT) setPublicIP(ip string) string {
+	dht.publicIPMu.Lock()
+	old := dht.PublicIp
+	dht.PublicIp = ip
+	dht.publicIPMu.Unlock()
+
+	if dht.SecureNodeID && !IsSecureNodeID(dht.NodeID(), net.ParseIP(ip)) {
+		dht.Log("node id is not BEP 42 compliant for the public ip ", ip,
+			", restart to derive a new one")
+	}
+	return old
 }
 
 // IsStandardMode returns whether mode is StandardMode.
@@ -271,8 +447,9 @@ init initializes global varables.
 3、初始化peers管理器
 4、初始化token管理器
 5、初始化KRPC transaction管理器，运行，运行等于在定义的间隔时间内不停的query
+6、Address 被占用时，依次尝试 PortRange 中的端口
 */
-func (dht *DHT) init() {
+func (dht *DHT) init() error {
 	// 下面的注释打开后，内存开销过大
 	// nLen := len(dht.Config.PrimeNodes)
 	// if nLen > dht.Config.PacketWorkerLimit {
@@ -285,109 +462,218 @@ func (dht *DHT) init() {
 	// 	dht.Config.BlackListMaxSize = nLen + 8
 	// }
 
-	listener, err := net.ListenPacket(dht.Network, dht.Address)
+	// 先占住，同时调用的 Start 只有一个能继续
+	dht.runMu.Lock()
+	if dht.running || dht.starting {
+		dht.runMu.Unlock()
+		return ErrRunning
+	}
+	dht.starting = true
+	dht.runMu.Unlock()
+
+	listener, err := dht.listenPacket()
 	if err != nil {
-		panic(err)
+		dht.runMu.Lock()
+		dht.starting = false
+		dht.runMu.Unlock()
+		return err
 	}
 
-	dht.conn = listener.(*net.UDPConn)
+	dht.conn = listener
+	dht.setFamilies(dht.conn.LocalAddr())
 	dht.routingTable = newRoutingTable(dht.KBucketSize, dht)
+	dht.routingTable6 = newRoutingTable(dht.KBucketSize, dht)
 	dht.peersManager = newPeersManager(dht)
-	dht.tokenManager = newTokenManager(dht.TokenExpiredAfter, dht)
+	dht.tokenManager = newTokenManager(dht.TokenExpiredAfter, dht.clock)
+	dht.itemStore = newItemStore(dht.MaxItems, dht.ItemExpiredAfter,
+		dht.clock)
 	dht.transactionManager = newTransactionManager(
 		dht.MaxTransactionCursor, dht)
 
-	go dht.transactionManager.run()
-	go dht.tokenManager.clear()
-	go dht.blackList.clear()
+	dht.runMu.Lock()
+	dht.closing = make(chan struct{})
+	dht.done = make(chan struct{})
+	dht.running = true
+	dht.starting = false
+	dht.Ready = true
+	dht.runMu.Unlock()
+
+	dht.spawn(dht.transactionManager.run)
+	dht.spawn(func() { dht.blackList.clear(dht.closing) })
+	dht.spawn(func() { dht.itemStore.clear(dht.closing) })
+	return nil
 }
 
-func (dht *DHT) getIps(domain string) {
-	a := strings.Split(domain, ":")
-	ips, _ := net.LookupIP(a[0])
-	for _, ip := range ips {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			s11 := fmt.Sprintf("%v:%s\n", ipv4, a[1])
-			dht.appendIps2DhtTracker(s11, "/ips.txt")
-			// fmt.Println(s11)
-			// fmt.Println(string(ipv4) + ":" + a[1])
+/*
+listenPacket listens on Address. If it fails, it tries the ports in
+PortRange one by one and returns a *BindError when all of them fail.
+It returns PacketConn instead when it's set.
+*/
+func (dht *DHT) listenPacket() (net.PacketConn, error) {
+	if dht.PacketConn != nil {
+		return dht.PacketConn, nil
+	}
+
+	addresses := []string{dht.Address}
+
+	if dht.PortRange[1] > 0 {
+		host, _, err := net.SplitHostPort(dht.Address)
+		if err != nil {
+			return nil, &ConfigError{"Address", err.Error()}
+		}
+
+		for port := dht.PortRange[0]; port <= dht.PortRange[1]; port++ {
+			addresses = append(addresses, genAddress(host, port))
+		}
+	}
+
+	var err error
+	for _, address := range addresses {
+		var listener net.PacketConn
+		if listener, err = net.ListenPacket(dht.Network, address); err == nil {
+			return listener, nil
 		}
 	}
+
+	return nil, &BindError{dht.Network, addresses, err}
 }
 
-// 记录更多DHT Tracker ip:port 为下一版本提供更多加速的动力
-func (dht *DHT) appendIps2DhtTracker(s string, fileName string) {
-	if bCloseRcdIps {
-		return
+// Addr returns the local address the dht listens on, or nil when it is not
+// running.
+func (dht *DHT) Addr() net.Addr {
+	dht.runMu.RLock()
+	defer dht.runMu.RUnlock()
+
+	if !dht.running {
+		return nil
 	}
-	var n = -1
-	if "" == fileName {
-		fileName = "/ips.txt"
+	return dht.conn.LocalAddr()
+}
+
+/*
+spawn runs f in a new goroutine which Stop waits for.
+节点已经在停止时不再启动，返回false
+*/
+func (dht *DHT) spawn(f func()) bool {
+	dht.runMu.RLock()
+	defer dht.runMu.RUnlock()
+
+	if !dht.running {
+		return false
 	}
-	n = dht.Config.StunList.SliceIndex(s, dht.Config.PrimeNodes)
-	dirname, err := os.UserHomeDir()
-	if err != nil {
-		return
+
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// isClosing returns whether the node is stopping or stopped.
+func (dht *DHT) isClosing() bool {
+	dht.runMu.RLock()
+	defer dht.runMu.RUnlock()
+
+	return !dht.running
+}
+
+/*
+shutdown tells every goroutine to quit and closes the udp conn, so the
+blocked reader returns. It returns the chan closed when all of them have
+finished, or nil if the node is not running.
+*/
+func (dht *DHT) shutdown() chan struct{} {
+	dht.runMu.Lock()
+	defer dht.runMu.Unlock()
+
+	if !dht.running {
+		return nil
 	}
-	// n = SliceIndex(s, dht.Config.PrimeNodes)
-	// fmt.Println(n, " ", s)
-	if -1 == n || fileName != "/ips.txt" {
-		szNmae := dirname + fileName
-		// fmt.Println("appendIps2DhtTracker ", szNmae, " start ")
-		dht.Config.PrimeNodes = append(dht.Config.PrimeNodes, s)
-		file, err := os.OpenFile(szNmae, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			// fmt.Println(err)
-			return
+
+	dht.running = false
+	dht.Ready = false
+	close(dht.closing)
+	// 调用者的conn不关闭，它的 reader 继续读但丢弃数据包，见 listen
+	if dht.PacketConn == nil {
+		dht.conn.Close()
+	}
+
+	return dht.done
+}
+
+/*
+wait blocks until all goroutines return, then drops the queued packets and
+saves the routing table to RoutingTableFile and the learned bootstrap nodes
+under StateDir.
+*/
+func (dht *DHT) wait() {
+	dht.wg.Wait()
+
+	for {
+		select {
+		case <-dht.packets:
+			continue
+		default:
 		}
-		defer file.Close()
-		file.Write([]byte(s + "\n"))
-		// fmt.Println("appendIps2DhtTracker ", szNmae, " ", s, n)
+		break
 	}
+
+	if err := dht.saveRoutingTable(); err != nil {
+		dht.Log("save routing table: ", err)
+	}
+	dht.saveBootstrapNodes()
+	close(dht.done)
 }
 
 // 网络切换时，外部ip发生变化，得重新来
-// 每10秒执行一次
+// 每10秒执行一次，没有设置 PublicIPResolver 时不检查
 func (dht *DHT) checkPublicIp() bool {
-	ip, _ := dht.Config.StunList.GetSelfPublicIpPort()
-	// ip, err := getRemoteIP()
-	// dht.Log("start checkPublicIp", ip, dht.Config.PublicIp)
-	// if nil == err && ip != dht.Config.PublicIp {
-	if "" != ip && ip != dht.Config.PublicIp {
-		dht.Log("ip is changed new: ", ip, " old: ", dht.Config.PublicIp, " now clearn all blackList")
+	if dht.PublicIPResolver == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	ip, _, err := dht.PublicIPResolver.PublicIP(ctx)
+	if nil == err && ip != dht.publicIP() {
+		old := dht.setPublicIP(ip)
+		dht.Log("ip is changed new: ", ip, " old: ", old, " now clearn all blackList")
 		dht.blackList.ClearAll()
-		dht.self2black()
-		dht.Config.PublicIp = ip
+		dht.initBlackList()
 		return true
 	}
 	return false
 }
 
 func (dht *DHT) Join2addr(addr string) {
-	if "" == dht.Config.PublicIp || -1 == strings.Index(addr, dht.Config.PublicIp) {
-		raddr, err := net.ResolveUDPAddr(dht.Network, addr)
-		if err == nil {
-			dht.transactionManager.findNode(
-				&node{addr: raddr},
-				dht.node.id.RawString(),
-			)
-		}
+	raddr, err := net.ResolveUDPAddr(dht.resolveNetwork(), addr)
+	if err != nil {
+		return
+	}
+	// 不和自己通讯
+	if ip := dht.publicIP(); "" == ip || !raddr.IP.Equal(net.ParseIP(ip)) {
+		dht.transactionManager.findNode(
+			&node{addr: raddr},
+			dht.node.id.RawString(),
+		)
 	}
 }
 
 /*
 不断加入相邻、活跃、有效节点（加入DHT）
-join makes current node join the dht network.
+join makes current node join the dht network. It sends find_node to the
+learned bootstrap nodes, the most reliable first, then to PrimeNodes.
 */
 func (dht *DHT) join() {
 	wg := &sync.WaitGroup{}
-	// 限制 4096 个并发
-	// len(dht.PrimeNodes)
+	// 限制 128 个并发
 	ch := make(chan struct{}, 128)
-	// ch := make(chan struct{}, len(dht.Config.PrimeNodes))
-	// fmt.Println(len(dht.PrimeNodes))
-	// s1 := strconv.Itoa(len(dht.PrimeNodes))
-	for _, addr := range dht.PrimeNodes {
+	for _, addr := range dht.bootstrapList() {
+		if dht.isClosing() {
+			break
+		}
 		wg.Add(1)
 		ch <- struct{}{}
 		go func(addr string) {
@@ -396,26 +682,6 @@ func (dht *DHT) join() {
 				<-ch
 			}()
 			dht.Join2addr(addr)
-			// raddr, err := net.ResolveUDPAddr(dht.Network, addr)
-			// // if err != nil {
-			// // 	// fmt.Println("error: ", addr, err)
-			// // 	return
-			// // }
-			// if err == nil {
-			// 	// go dht.appendIps2DhtTracker(raddr.String(), "/chinaOk.txt")
-			// 	// 转换 域名为ip提高效率
-			// 	if ok, _ := regexp.Match(`^[0-9\.:]+$`, []byte(addr)); ok {
-			// 		// fmt.Println(addr)
-			// 	} else if bCloseRcdIps {
-			// 		fmt.Println(addr)
-			// 		dht.getIps(addr)
-			// 	}
-			// 	// NOTE: Temporary node has NOT node id.
-			// 	dht.transactionManager.findNode(
-			// 		&node{addr: raddr},
-			// 		dht.node.id.RawString(),
-			// 	)
-			// }
 		}(addr)
 	}
 	wg.Wait()
@@ -423,19 +689,88 @@ func (dht *DHT) join() {
 
 /*
 always from listen receives message from udp.
+conn 关闭后退出，packets 满了就丢弃，和 handle 的 workerTokens 一样。
+Stop can't end the reads of PacketConn without closing it or setting its
+deadline, so its reader isn't waited for: one reader per conn outlives Stop,
+drops the packets until the next Start and returns when the caller closes
+the conn.
 */
 func (dht *DHT) listen() {
+	if dht.PacketConn == nil {
+		conn := dht.conn
+		dht.spawn(func() { dht.read(conn) })
+		return
+	}
+
+	dht.runMu.Lock()
+	defer dht.runMu.Unlock()
+
+	conn := dht.PacketConn
+	if dht.reading == conn {
+		return
+	}
+	dht.reading = conn
 	go func() {
-		buff := make([]byte, 8192)
-		for {
-			n, raddr, err := dht.conn.ReadFromUDP(buff)
-			if err == nil {
-				dht.packets <- packet{buff[:n], raddr}
-			}
+		dht.read(conn)
+
+		dht.runMu.Lock()
+		if dht.reading == conn {
+			dht.reading = nil
 		}
+		dht.runMu.Unlock()
 	}()
 }
 
+// readRetryDelay is the wait after a read error other than a closed conn.
+const readRetryDelay = time.Millisecond * 50
+
+// read reads conn until it is closed, the other errors are retried later
+// instead of spinning.
+func (dht *DHT) read(conn net.PacketConn) {
+	buff := make([]byte, 8192)
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(readRetryDelay)
+			continue
+		}
+		raddr, err := toUDPAddr(addr)
+		if err != nil {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buff[:n])
+		dht.deliver(packet{data, raddr})
+	}
+}
+
+// deliver queues pkt for handle, it's dropped when the dht isn't running or
+// packets is full.
+func (dht *DHT) deliver(pkt packet) {
+	dht.runMu.RLock()
+	defer dht.runMu.RUnlock()
+
+	if !dht.running {
+		return
+	}
+	atomic.AddUint64(&dht.metrics.packetsReceived, 1)
+	select {
+	case dht.packets <- pkt:
+	default:
+		dht.metrics.packetsDropped.inc(dropQueue)
+	}
+}
+
+// NodeID returns the id of the dht node.
+func (dht *DHT) NodeID() (id NodeID) {
+	copy(id[:], dht.node.id.RawString())
+	return
+}
+
 // id returns a id near to target if target is not null, otherwise it returns
 // the dht's node id.
 func (dht *DHT) id(target string) string {
@@ -445,19 +780,6 @@ func (dht *DHT) id(target string) string {
 	return target[:15] + dht.node.id.RawString()[15:]
 }
 
-// publish resource one time
-func (dht *DHT) doAnnouncePeer() {
-	for _, infoHash := range dht.AnnouncePeerLists {
-		// 相邻节点
-		neighbors := dht.routingTable.GetNeighbors(
-			newBitmapFromString(infoHash), dht.routingTable.Len())
-		// no.id.RawString()
-		for _, no := range neighbors {
-			dht.transactionManager.announcePeer(no, infoHash, 1, no.addr.Port, dht.tokenManager.token(no.addr))
-		}
-	}
-}
-
 // remove publish peer
 func (dht *DHT) RemoveAnnouncePeer(infoHash string) bool {
 	for i, key := range dht.AnnouncePeerLists {
@@ -470,16 +792,16 @@ func (dht *DHT) RemoveAnnouncePeer(infoHash string) bool {
 }
 
 /*
-1、通过infoHash 通知相邻节点，我提供、有某资源的下载、关注infoHash的种子文件
-2、这个过程只是通知当前内存中得到的相邻节点
-3、通过config.OnAnnouncePeer得到反馈
-4、加到发布的列表中，定时器进行发布，不仅仅是一次，每10秒执行一次
+1、通过infoHash 通知离infoHash最近的节点，我提供、有某资源的下载、关注infoHash的种子文件
+2、在后台用 Announce 发布，端口是dht的udp端口（implied_port），要知道结果就用 Announce
+3、通过 Subscribe(EventAnnouncePeer) 或 config.OnAnnouncePeer 得到反馈
+4、加到发布的列表中，定时器进行发布，不仅仅是一次，每 announceInterval 执行一次
 */
 func (dht *DHT) AnnouncePeer(infoHash string) error {
 	if !dht.Ready {
 		return ErrNotReady
 	}
-	if dht.OnAnnouncePeer == nil {
+	if dht.OnAnnouncePeer == nil && !dht.events.wants(EventAnnouncePeer) {
 		return ErrOnAnnouncePeerNotSet
 	}
 	if len(infoHash) == 40 {
@@ -493,7 +815,7 @@ func (dht *DHT) AnnouncePeer(infoHash string) error {
 	if -1 == dht.Config.StunList.SliceIndex(infoHash, dht.AnnouncePeerLists) {
 		dht.AnnouncePeerLists = append(dht.AnnouncePeerLists, infoHash)
 	}
-	dht.doAnnouncePeer()
+	dht.announceInBackground(infoHash)
 
 	return nil
 }
@@ -504,14 +826,18 @@ GetPeers 向相邻节点发起匿名 infohash查询
 注意：
    1、这种查询使用时需要间隔时间不停查询，直到有结果
    2、这里只是向当前内存路由表中临近的节点发起一次 get_peers 查询，没有查到是不管的
-   3、通过OnGetPeersResponse 获取结果
+   3、通过 Subscribe(EventPeerFound) 或 OnGetPeersResponse 获取结果
+   4、只有 Config.GetPeerLists 中的infohash会每10秒重新查询
+
+Deprecated: use FindPeers, which looks up the closest nodes and returns the
+peers to the caller.
 */
 func (dht *DHT) GetPeers(infoHash string) error {
 	if !dht.Ready {
 		return ErrNotReady
 	}
 
-	if dht.OnGetPeersResponse == nil {
+	if dht.OnGetPeersResponse == nil && !dht.events.wants(EventPeerFound) {
 		return ErrOnGetPeersResponseNotSet
 	}
 
@@ -523,28 +849,33 @@ func (dht *DHT) GetPeers(infoHash string) error {
 		infoHash = string(data)
 	}
 	// 相邻节点
-	neighbors := dht.routingTable.GetNeighbors(
-		newBitmapFromString(infoHash), dht.routingTable.Len())
+	neighbors := dht.getNeighbors(
+		newBitmapFromString(infoHash), dht.tablesLen())
 
 	for _, no := range neighbors {
 		dht.transactionManager.getPeers(no, infoHash)
 	}
-	if -1 == dht.Config.StunList.SliceIndex(infoHash, dht.GetPeerLists) {
-		dht.GetPeerLists = append(dht.GetPeerLists, infoHash)
-	}
 
 	return nil
 }
 
 // 1、执行所有想获取的infoHash信息
-// 2、通过OnGetPeersResponse 回调获取结果
+// 2、通过 Subscribe(EventPeerFound) 或 OnGetPeersResponse 回调获取结果
 func (dht *DHT) DoAllGetPeers() {
 	for _, v := range dht.GetPeerLists {
 		dht.GetPeers(v)
 	}
 }
-func (dht *DHT) Stop() {
 
+/*
+Stop stops the dht: it closes the udp conn, cancels the transactions in
+flight, ends every background goroutine and returns once all of them have
+finished. The dht can be started again by Run afterwards.
+*/
+func (dht *DHT) Stop() {
+	if done := dht.shutdown(); done != nil {
+		<-done
+	}
 }
 
 /*
@@ -555,19 +886,58 @@ Run starts the dht.
 4、路由表的时候，继续加入joinDHT网络
 5、transaction管理表 为空（size==0）的时候，刷新路由表生命周期
 6、每CheckKBucketPeriod（30）秒执行一次join 加入DHT网络
+Run blocks until Stop is called. It panics when the dht can't be started,
+use Start or RunContext to get the error instead.
 */
 func (dht *DHT) Run() {
-	dht.init()
+	if err := dht.RunContext(context.Background()); err != nil {
+		panic(err)
+	}
+}
 
-	dht.listen()
-	go dht.join()
+/*
+RunContext is like Run, but it also stops the dht when ctx is done. It
+returns ctx.Err() in that case and nil when Stop is called. The error of
+starting, eg a *BindError, is returned at once.
+*/
+func (dht *DHT) RunContext(ctx context.Context) error {
+	if err := dht.init(); err != nil {
+		return err
+	}
+	return dht.loop(ctx)
+}
 
-	dht.Ready = true
+/*
+Start starts the dht in background and returns once the udp conn is
+listened. Call Stop to stop it.
+*/
+func (dht *DHT) Start() error {
+	if err := dht.init(); err != nil {
+		return err
+	}
+
+	go dht.loop(context.Background())
+	return nil
+}
+
+// loop handles the packets and the tickers until the dht stops.
+func (dht *DHT) loop(ctx context.Context) error {
+	defer dht.wait()
+
+	dht.listen()
+	dht.spawn(dht.bootstrap)
 
 	var pkt packet
-	tick := time.Tick(dht.CheckKBucketPeriod)
+	tick := time.NewTicker(dht.CheckKBucketPeriod)
+	defer tick.Stop()
 
-	tick1 := time.Tick(time.Duration(time.Second * 10))
+	tick1 := time.NewTicker(time.Duration(time.Second * 10))
+	defer tick1.Stop()
+
+	announceTick := time.NewTicker(announceInterval)
+	defer announceTick.Stop()
+	// 路由表有节点后先发布一次
+	announced := false
 	// //创建监听退出chan
 	// c := make(chan os.Signal)
 	// //监听指定信号 ctrl+c kill
@@ -582,26 +952,41 @@ func (dht *DHT) Run() {
 		// 		dht.Stop()
 		// 		os.Exit(0)
 		// 	}
+		case <-ctx.Done():
+			dht.shutdown()
+			return ctx.Err()
+		case <-dht.closing:
+			return nil
 		case pkt = <-dht.packets:
 			{
 				handle(dht, pkt)
 			}
-		case <-tick1:
+		case <-tick1.C:
 			{
-				dht.checkPublicIp()
-				// 发布
-				go dht.doAnnouncePeer()
+				dht.spawn(func() { dht.checkPublicIp() })
 				// 获取
-				go dht.DoAllGetPeers()
+				dht.spawn(dht.DoAllGetPeers)
+				if !announced && dht.tablesLen() > 0 {
+					announced = true
+					dht.doAnnouncePeer()
+				}
 			}
+		// 发布
+		case <-announceTick.C:
+			dht.doAnnouncePeer()
 		// 每30秒执行一次
-		case <-tick:
+		case <-tick.C:
 			{
-				if dht.routingTable.Len() == 0 {
+				if dht.tablesLen() == 0 {
 					dht.join()
 				} else if dht.transactionManager.len() == 0 {
-					go dht.routingTable.Fresh()
+					for _, rt := range dht.tables() {
+						dht.spawn(rt.Fresh)
+					}
 				}
+				dht.spawn(dht.saveBootstrapNodes)
+				dht.ipLimiter.clean(dht.clock.Now())
+				dht.peersManager.expireScrapes(dht.clock.Now())
 			}
 		}
 	}
@@ -24,15 +24,16 @@ func NewMyTick(interval int, f Fn) *MyTicker {
 }
 
 func (t *MyTicker) Stop() {
+	t.MyTick.Stop()
 	close(t.stop)
 }
 
-// 启动定时器需要执行的任务
+// 启动定时器需要执行的任务，Stop 后返回
 func (t *MyTicker) Start() {
 	for {
 		select {
 		case <-t.stop:
-			break
+			return
 		case <-t.MyTick.C:
 			t.Runner()
 		}
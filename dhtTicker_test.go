@@ -1,15 +1,14 @@
 package dht
 
 import (
-	"fmt"
 	"testing"
 )
 
-func Test1() {
-	fmt.Println("test")
-}
 func TestMyTick(t *testing.T) {
-
-	x := NewMyTick(3, Test1)
+	var x *MyTicker
+	x = NewMyTick(1, func() {
+		t.Log("test")
+		x.Stop()
+	})
 	x.Start()
 }
@@ -0,0 +1,397 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns a standard config which does no network I/O.
+func newTestConfig() *Config {
+	return &Config{
+		K:                    8,
+		KBucketSize:          8,
+		Network:              "udp4",
+		Address:              "127.0.0.1:0",
+		NodeExpriedAfter:     time.Minute * 15,
+		KBucketExpiredAfter:  time.Minute * 15,
+		CheckKBucketPeriod:   time.Second * 30,
+		TokenExpiredAfter:    time.Minute * 10,
+		MaxItems:             64,
+		ItemExpiredAfter:     time.Hour * 2,
+		MaxTransactionCursor: math.MaxUint32,
+		MaxNodes:             5000,
+		BlackListMaxSize:     256,
+		Try:                  2,
+		Mode:                 StandardMode,
+		PacketJobLimit:       64,
+		PacketWorkerLimit:    16,
+		RefreshNodeNum:       8,
+		QueryWorkLimit:       16,
+	}
+}
+
+// waitReady waits until d is ready or fails the test.
+func waitReady(t *testing.T, d *DHT) {
+	for i := 0; i < 100; i++ {
+		if !d.isClosing() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("dht is not ready")
+}
+
+func TestStop(t *testing.T) {
+	d := New(newTestConfig())
+
+	for i := 0; i < 2; i++ {
+		done := make(chan struct{})
+		go func() {
+			d.Run()
+			close(done)
+		}()
+		waitReady(t, d)
+
+		d.Stop()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("Run does not return after Stop")
+		}
+
+		if d.Ready || !d.isClosing() {
+			t.Fail()
+		}
+	}
+
+	// Stop on a stopped dht returns immediately.
+	d.Stop()
+}
+
+func TestRunContext(t *testing.T) {
+	d := New(newTestConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- d.RunContext(ctx)
+	}()
+	waitReady(t, d)
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("RunContext does not return after cancel")
+	}
+}
+
+func TestNewDHTInvalidConfig(t *testing.T) {
+	config := newTestConfig()
+	config.Network = "tcp"
+
+	if _, err := NewDHT(config); err == nil {
+		t.Fail()
+	} else if errs, ok := err.(ConfigErrors); !ok || !errs.Has("Network") {
+		t.Error(err)
+	}
+
+	config = newTestConfig()
+	config.PortRange = [2]int{6889, 6881}
+	if _, err := NewDHT(config); err == nil {
+		t.Fail()
+	}
+}
+
+func TestStartBindError(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	config := newTestConfig()
+	config.Address = conn.LocalAddr().String()
+	d, err := NewDHT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Start()
+	if e, ok := err.(*BindError); !ok || len(e.Addresses) != 1 {
+		t.Fatal(err)
+	}
+	// Stop on a dht never started returns immediately.
+	d.Stop()
+}
+
+func TestStartPortRange(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a port which is free now
+	free, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	config := newTestConfig()
+	config.Address = conn.LocalAddr().String()
+	config.PortRange = [2]int{port, port}
+	d, err := NewDHT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	if d.Addr().(*net.UDPAddr).Port != port {
+		t.Error(d.Addr())
+	}
+	if err := d.Start(); err != ErrRunning {
+		t.Error(err)
+	}
+}
+
+// countingConn is a net.PacketConn which is not a *net.UDPConn.
+type countingConn struct {
+	net.PacketConn
+	writes    int32
+	deadlines int32
+}
+
+func (c *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *countingConn) SetDeadline(t time.Time) error {
+	atomic.AddInt32(&c.deadlines, 1)
+	return c.PacketConn.SetDeadline(t)
+}
+
+func (c *countingConn) SetReadDeadline(t time.Time) error {
+	atomic.AddInt32(&c.deadlines, 1)
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *countingConn) SetWriteDeadline(t time.Time) error {
+	atomic.AddInt32(&c.deadlines, 1)
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+func TestPacketConn(t *testing.T) {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	conn := &countingConn{PacketConn: udp}
+
+	d := New(newTestConfig().With(WithPacketConn(conn)))
+	peer := New(newTestConfig())
+	for _, n := range []*DHT{d, peer} {
+		n.blackList.ClearAll()
+	}
+	if err := peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Stop()
+
+	for i := 0; i < 2; i++ {
+		if err := d.Start(); err != nil {
+			t.Fatal(i, err)
+		}
+		if d.Addr().String() != udp.LocalAddr().String() {
+			t.Fatal("addr", d.Addr())
+		}
+
+		no, _ := newNode(peer.node.id.RawString(), "udp4", peer.Addr().String())
+		d.routingTable.Insert(no)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		addr, err := d.FindNode(ctx, peer.NodeID())
+		cancel()
+		if err != nil || addr.String() != peer.Addr().String() {
+			t.Fatal(i, addr, err)
+		}
+
+		// Stop 不关闭调用者的conn，可以再次启动
+		d.Stop()
+		if _, err := udp.WriteTo([]byte("x"), peer.Addr()); err != nil {
+			t.Fatal("conn is closed", err)
+		}
+	}
+
+	if atomic.LoadInt32(&conn.writes) == 0 {
+		t.Error("conn is not used")
+	}
+	// 调用者的conn的超时不动
+	if n := atomic.LoadInt32(&conn.deadlines); n != 0 {
+		t.Error("deadlines", n)
+	}
+}
+
+// slowConn makes Start slow, so that concurrent Starts overlap.
+type slowConn struct {
+	net.PacketConn
+}
+
+func (c slowConn) LocalAddr() net.Addr {
+	time.Sleep(time.Millisecond * 50)
+	return c.PacketConn.LocalAddr()
+}
+
+func TestConcurrentStart(t *testing.T) {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	d := New(newTestConfig().With(WithPacketConn(slowConn{udp})))
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- d.Start() }()
+	}
+
+	started := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			started++
+		} else if err != ErrRunning {
+			t.Error(err)
+		}
+	}
+	if started != 1 {
+		t.Error("started", started)
+	}
+	d.Stop()
+
+	// 启动失败后可以再次启动
+	d = New(newTestConfig().With(WithAddress(udp.LocalAddr().String())))
+	if err := d.Start(); err == nil {
+		t.Fatal("address in use")
+	}
+	d.Address = "127.0.0.1:0"
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	d.Stop()
+}
+
+// errConn is a net.PacketConn whose reads fail until it is closed.
+type errConn struct {
+	net.PacketConn
+	reads  int32
+	closed int32
+}
+
+func (c *errConn) ReadFrom([]byte) (int, net.Addr, error) {
+	atomic.AddInt32(&c.reads, 1)
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return 0, nil, net.ErrClosed
+	}
+	return 0, nil, errors.New("connection refused")
+}
+
+func (c *errConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func TestPacketConnClosed(t *testing.T) {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	conn := &errConn{PacketConn: udp}
+	d := New(newTestConfig().With(WithPacketConn(conn)))
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	d.Stop()
+
+	// 读出错时不空转
+	time.Sleep(readRetryDelay * 4)
+	if n := atomic.LoadInt32(&conn.reads); n > 8 {
+		t.Error("reads", n)
+	}
+
+	// 调用者关闭conn后 reader 退出
+	conn.Close()
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		d.runMu.RLock()
+		reading := d.reading
+		d.runMu.RUnlock()
+		if reading == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("still reading")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestKBucketFreshClock(t *testing.T) {
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	clock := newFakeClock()
+	d := New(newTestConfig())
+	d.clock = clock
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	d.blackList.ClearAll()
+
+	no, err := newNode(randomString(20), "udp4", peer.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	no.lastActiveTime = clock.Now()
+	d.routingTable.Insert(no)
+	_, bucket := d.routingTable.GetNodeKBucktByID(no.id)
+
+	pinged := func(wait time.Duration) bool {
+		buff := make([]byte, 1024)
+		peer.SetReadDeadline(time.Now().Add(wait))
+		_, _, err := peer.ReadFrom(buff)
+		return err == nil
+	}
+
+	// 按 dht 的时钟还没过期，不 ping
+	bucket.Fresh(d)
+	if pinged(time.Millisecond * 300) {
+		t.Fatal("fresh node is pinged")
+	}
+
+	clock.Add(d.NodeExpriedAfter + time.Second)
+	bucket.Fresh(d)
+	if !pinged(time.Second * 5) {
+		t.Error("expired node is not pinged")
+	}
+}
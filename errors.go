@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"fmt"
+)
+
+/*
+BindError is returned by Start and RunContext when the udp conn can't be
+listened on Config.Address, nor on any port of Config.PortRange.
+常见的是 address already in use
+*/
+type BindError struct {
+	Network string
+	// Addresses are all the addresses tried, in order.
+	Addresses []string
+	// Err is the error of the last try.
+	Err error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("dht: can't listen %s %v: %v", e.Network, e.Addresses, e.Err)
+}
+
+// Unwrap returns the error of the last try.
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError reports a Config field holding an invalid value.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("dht: invalid config %s: %s", e.Field, e.Reason)
+}
+
+// NodeIDError reports a node id which is not a 20-byte string.
+type NodeIDError struct {
+	ID     string
+	Reason string
+}
+
+func (e *NodeIDError) Error() string {
+	return fmt.Sprintf("dht: invalid node id %q: %s", e.ID, e.Reason)
+}
+
+/*
+KRPCError is an error message sent by a remote node, eg the BEP 44 errors
+returned by Put.
+*/
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("dht: krpc error %d: %s", e.Code, e.Message)
+}
+
+// parseKRPCError returns the error in the `e` field of a error message.
+func parseKRPCError(response map[string]interface{}) *KRPCError {
+	if err := ParseKey(response, "e", "list"); err != nil {
+		return nil
+	}
+
+	e := response["e"].([]interface{})
+	if len(e) != 2 {
+		return nil
+	}
+
+	code, _ := e[0].(int)
+	msg, _ := e[1].(string)
+	return &KRPCError{code, msg}
+}
@@ -0,0 +1,247 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+事件订阅：和 OnGetPeers、OnGetPeersResponse、OnAnnouncePeer 这些在处理数据包
+时同步调用的回调并存，可以有多个订阅者，慢的订阅者也不会阻塞数据包的处理。
+	events := d.Subscribe(dht.EventAnnouncePeer, dht.EventPeerFound)
+	for e := range events {
+		switch e := e.(type) {
+		case dht.AnnouncePeerEvent:
+			...
+		}
+	}
+Each subscriber has a buffer of eventBufferSize events, the events are
+dropped when it's full and counted in Metrics.EventsDropped.
+*/
+
+// eventBufferSize is the buffer size of a subscriber.
+const eventBufferSize = 1024
+
+// EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// EventGetPeersQuery is the kind of GetPeersQueryEvent.
+	EventGetPeersQuery EventKind = iota
+	// EventAnnouncePeer is the kind of AnnouncePeerEvent.
+	EventAnnouncePeer
+	// EventPeerFound is the kind of PeerFoundEvent.
+	EventPeerFound
+	// EventNodeAdded is the kind of NodeAddedEvent.
+	EventNodeAdded
+	// EventNodeEvicted is the kind of NodeEvictedEvent.
+	EventNodeEvicted
+	// EventBlacklisted is the kind of BlacklistedEvent.
+	EventBlacklisted
+	// EventPingQuery is the kind of PingQueryEvent.
+	EventPingQuery
+	// EventFindNodeQuery is the kind of FindNodeQueryEvent.
+	EventFindNodeQuery
+
+	numEventKinds
+)
+
+// Event is one of the *Event types, the concrete type is told by Kind.
+type Event interface {
+	Kind() EventKind
+}
+
+// GetPeersQueryEvent is published when a node queries get_peers.
+type GetPeersQueryEvent struct {
+	// InfoHash is the raw 20 bytes info hash.
+	InfoHash string
+	Addr     *net.UDPAddr
+}
+
+// AnnouncePeerEvent is published when a node announces with a valid token.
+type AnnouncePeerEvent struct {
+	// InfoHash is the raw 20 bytes info hash.
+	InfoHash string
+	// Addr is where the query comes from, Port is the announced port.
+	Addr *net.UDPAddr
+	Port int
+	Seed bool
+}
+
+// PeerFoundEvent is published for each peer in the get_peers responses
+// to GetPeers.
+type PeerFoundEvent struct {
+	// InfoHash is the raw 20 bytes info hash.
+	InfoHash string
+	Peer     *Peer
+}
+
+// NodeAddedEvent is published when a new node is put into the routing table.
+type NodeAddedEvent struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// NodeEvictedEvent is published when a node is removed from the routing
+// table.
+type NodeEvictedEvent struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// BlacklistedEvent is published when an ip is put into the blacklist, Port
+// is -1 when the whole ip is blocked.
+type BlacklistedEvent struct {
+	IP   string
+	Port int
+}
+
+// PingQueryEvent is published when a node queries ping.
+type PingQueryEvent struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// FindNodeQueryEvent is published when a node queries find_node.
+type FindNodeQueryEvent struct {
+	ID     NodeID
+	Target NodeID
+	Addr   *net.UDPAddr
+}
+
+// Kind returns EventGetPeersQuery.
+func (GetPeersQueryEvent) Kind() EventKind { return EventGetPeersQuery }
+
+// Kind returns EventAnnouncePeer.
+func (AnnouncePeerEvent) Kind() EventKind { return EventAnnouncePeer }
+
+// Kind returns EventPeerFound.
+func (PeerFoundEvent) Kind() EventKind { return EventPeerFound }
+
+// Kind returns EventNodeAdded.
+func (NodeAddedEvent) Kind() EventKind { return EventNodeAdded }
+
+// Kind returns EventNodeEvicted.
+func (NodeEvictedEvent) Kind() EventKind { return EventNodeEvicted }
+
+// Kind returns EventBlacklisted.
+func (BlacklistedEvent) Kind() EventKind { return EventBlacklisted }
+
+// Kind returns EventPingQuery.
+func (PingQueryEvent) Kind() EventKind { return EventPingQuery }
+
+// Kind returns EventFindNodeQuery.
+func (FindNodeQueryEvent) Kind() EventKind { return EventFindNodeQuery }
+
+// subscriber is a channel and the kinds it wants.
+type subscriber struct {
+	ch    chan Event
+	kinds [numEventKinds]bool
+}
+
+// eventBus sends the events to the subscribers without blocking.
+type eventBus struct {
+	// dropped is first to be 64-bit aligned for atomic
+	dropped uint64
+	sync.RWMutex
+	subscribers map[<-chan Event]*subscriber
+	// wanted counts the subscribers of each kind, so publishing an event
+	// nobody wants costs nothing
+	wanted [numEventKinds]int32
+}
+
+// newEventBus returns a new eventBus pointer.
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[<-chan Event]*subscriber)}
+}
+
+// subscribe adds a subscriber of kinds, all the kinds when it's empty.
+func (eb *eventBus) subscribe(kinds []EventKind) <-chan Event {
+	sub := &subscriber{ch: make(chan Event, eventBufferSize)}
+	for kind := EventKind(0); kind < numEventKinds; kind++ {
+		sub.kinds[kind] = len(kinds) == 0
+	}
+	for _, kind := range kinds {
+		if kind >= 0 && kind < numEventKinds {
+			sub.kinds[kind] = true
+		}
+	}
+
+	eb.Lock()
+	defer eb.Unlock()
+
+	eb.subscribers[sub.ch] = sub
+	eb.count(sub, 1)
+	return sub.ch
+}
+
+// unsubscribe removes the subscriber of ch and closes ch.
+func (eb *eventBus) unsubscribe(ch <-chan Event) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	if sub, ok := eb.subscribers[ch]; ok {
+		delete(eb.subscribers, ch)
+		eb.count(sub, -1)
+		close(sub.ch)
+	}
+}
+
+// count adds delta to wanted of the kinds of sub, eb must be locked.
+func (eb *eventBus) count(sub *subscriber, delta int32) {
+	for kind, ok := range sub.kinds {
+		if ok {
+			atomic.AddInt32(&eb.wanted[kind], delta)
+		}
+	}
+}
+
+// wants returns whether any subscriber wants kind.
+func (eb *eventBus) wants(kind EventKind) bool {
+	return atomic.LoadInt32(&eb.wanted[kind]) > 0
+}
+
+// publish sends e to the subscribers of its kind, it's dropped for those
+// whose buffer is full.
+func (eb *eventBus) publish(e Event) {
+	if !eb.wants(e.Kind()) {
+		return
+	}
+
+	eb.RLock()
+	defer eb.RUnlock()
+
+	for _, sub := range eb.subscribers {
+		if !sub.kinds[e.Kind()] {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddUint64(&eb.dropped, 1)
+		}
+	}
+}
+
+/*
+Subscribe returns a channel of the events of kinds, all the kinds when
+none is given. The events are dropped when the subscriber doesn't keep up,
+see Metrics.EventsDropped. The channel is closed by Unsubscribe, it stays
+open across Stop and Run.
+*/
+func (dht *DHT) Subscribe(kinds ...EventKind) <-chan Event {
+	return dht.events.subscribe(kinds)
+}
+
+// Unsubscribe stops sending events to ch, which is returned by Subscribe,
+// and closes it.
+func (dht *DHT) Unsubscribe(ch <-chan Event) {
+	dht.events.unsubscribe(ch)
+}
+
+// rawNodeID returns the NodeID of the raw 20 bytes id.
+func rawNodeID(raw string) (id NodeID) {
+	copy(id[:], raw)
+	return
+}
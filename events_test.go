@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitEvent returns the next event of kind in ch or fails the test, the
+// other events are skipped.
+func waitEvent(t *testing.T, ch <-chan Event, kind EventKind) Event {
+	t.Helper()
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case e := <-ch:
+			if e.Kind() == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("no event", kind)
+		}
+	}
+}
+
+// startQuerier returns a started dht and a conn to send queries to it.
+func startQuerier(t *testing.T, config *Config) (*DHT, *net.UDPConn) {
+	d := New(config)
+	d.blackList.ClearAll()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, conn
+}
+
+// announceFrom queries get_peers and announces infoHash with the token.
+func announceFrom(t *testing.T, conn *net.UDPConn, d *DHT, id,
+	infoHash string) {
+
+	resp := queryFrom(t, conn, d, getPeersType, map[string]interface{}{
+		"id": id, "info_hash": infoHash}, false)
+	r, _ := resp["r"].(map[string]interface{})
+	token, _ := r["token"].(string)
+	queryFrom(t, conn, d, announcePeerType, map[string]interface{}{
+		"id": id, "info_hash": infoHash, "port": 1234, "token": token,
+		"seed": 1}, false)
+}
+
+func TestSubscribeQueries(t *testing.T) {
+	d, conn := startQuerier(t, newTestConfig())
+	defer d.Stop()
+	defer conn.Close()
+
+	events := d.Subscribe(EventPingQuery, EventFindNodeQuery,
+		EventGetPeersQuery, EventAnnouncePeer)
+	defer d.Unsubscribe(events)
+
+	id, target, infoHash := randomString(20), randomString(20), randomString(20)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	queryFrom(t, conn, d, pingType, map[string]interface{}{"id": id}, false)
+	if e, ok := waitEvent(t, events, EventPingQuery).(PingQueryEvent); !ok ||
+		e.ID != rawNodeID(id) || e.Addr.Port != port {
+		t.Error(e)
+	}
+
+	queryFrom(t, conn, d, findNodeType, map[string]interface{}{
+		"id": id, "target": target}, false)
+	if e, ok := waitEvent(t, events, EventFindNodeQuery).(FindNodeQueryEvent); !ok ||
+		e.Target != rawNodeID(target) {
+		t.Error(e)
+	}
+
+	announceFrom(t, conn, d, id, infoHash)
+	if e, ok := waitEvent(t, events, EventGetPeersQuery).(GetPeersQueryEvent); !ok ||
+		e.InfoHash != infoHash || e.Addr.Port != port {
+		t.Error(e)
+	}
+	if e, ok := waitEvent(t, events, EventAnnouncePeer).(AnnouncePeerEvent); !ok ||
+		e.InfoHash != infoHash || e.Port != 1234 || !e.Seed {
+		t.Error(e)
+	}
+}
+
+func TestSubscribeNodes(t *testing.T) {
+	d := New(newTestConfig())
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	events := d.Subscribe(EventNodeAdded, EventNodeEvicted, EventBlacklisted)
+	no, _ := newNode(randomString(20), "udp4", "1.2.3.4:5")
+	d.routingTable.Insert(no)
+	if e, ok := waitEvent(t, events, EventNodeAdded).(NodeAddedEvent); !ok ||
+		e.ID != rawNodeID(no.id.RawString()) || e.Addr.String() != "1.2.3.4:5" {
+		t.Error(e)
+	}
+	// 已有的节点不再发布
+	d.routingTable.Insert(no)
+
+	d.blackList.insert("1.2.3.4", 5)
+	d.removeByAddr(no.addr)
+	if e, ok := waitEvent(t, events, EventBlacklisted).(BlacklistedEvent); !ok ||
+		e.IP != "1.2.3.4" || e.Port != 5 {
+		t.Error(e)
+	}
+	if e, ok := waitEvent(t, events, EventNodeEvicted).(NodeEvictedEvent); !ok ||
+		e.ID != rawNodeID(no.id.RawString()) {
+		t.Error(e)
+	}
+
+	d.Unsubscribe(events)
+	if _, ok := <-events; ok {
+		t.Error("not closed")
+	}
+}
+
+func TestSubscribePromoted(t *testing.T) {
+	d := New(newTestConfig())
+	rt := newRoutingTable(8, d)
+	events := d.Subscribe(EventNodeAdded, EventNodeEvicted)
+	defer d.Unsubscribe(events)
+
+	no, _ := newNode(randomString(20), "udp4", "1.2.3.4:5")
+	candidate, _ := newNode(randomString(20), "udp4", "1.2.3.5:6")
+	rt.Insert(no)
+	waitEvent(t, events, EventNodeAdded)
+
+	_, bucket := rt.GetNodeKBucktByID(no.id)
+	bucket.candidates.Push(candidate.id.RawString(), candidate)
+	rt.Remove(no.id)
+	if e, ok := waitEvent(t, events, EventNodeEvicted).(NodeEvictedEvent); !ok ||
+		e.ID != rawNodeID(no.id.RawString()) {
+		t.Error(e)
+	}
+	if e, ok := waitEvent(t, events, EventNodeAdded).(NodeAddedEvent); !ok ||
+		e.ID != rawNodeID(candidate.id.RawString()) {
+		t.Error(e)
+	}
+	if _, ok := rt.GetNodeByAddress(candidate.addr.String()); !ok {
+		t.Error("promoted node is not in the routing table")
+	}
+}
+
+func TestSubscribeDropped(t *testing.T) {
+	d := New(newTestConfig())
+	all := d.Subscribe()
+	pings := d.Subscribe(EventPingQuery)
+
+	for i := 0; i < eventBufferSize+1; i++ {
+		d.events.publish(BlacklistedEvent{IP: "1.2.3.4", Port: i})
+	}
+	if len(pings) != 0 || len(all) != eventBufferSize {
+		t.Error(len(pings), len(all))
+	}
+	if n := d.Metrics().EventsDropped; n != 1 {
+		t.Error("dropped", n)
+	}
+
+	d.Unsubscribe(all)
+	d.Unsubscribe(pings)
+	if d.events.wants(EventBlacklisted) || d.events.wants(EventPingQuery) {
+		t.Error("still wanted")
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	announced := make(chan string, 1)
+	config := newTestConfig()
+	config.OnAnnouncePeer = func(infoHash, ip string, port int) {
+		announced <- infoHash
+	}
+	d, conn := startQuerier(t, config)
+	defer d.Stop()
+	defer conn.Close()
+
+	infoHash := randomString(20)
+	announceFrom(t, conn, d, randomString(20), infoHash)
+
+	select {
+	case h := <-announced:
+		if h != infoHash {
+			t.Error(h)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("OnAnnouncePeer is not called")
+	}
+}
@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// storedItem is an item in itemStore.
+type storedItem struct {
+	target     string
+	item       *Item
+	updateTime time.Time
+}
+
+/*
+itemStore keeps the BEP 44 items put by other nodes. Items expire after
+expiredAfter if nobody puts them again, when it is full the oldest one is
+removed.
+*/
+type itemStore struct {
+	sync.Mutex
+	items        *keyedDeque
+	maxSize      int
+	expiredAfter time.Duration
+	clock        clock
+}
+
+// newItemStore returns a new itemStore pointer.
+func newItemStore(maxSize int, expiredAfter time.Duration, c clock) *itemStore {
+	return &itemStore{
+		items:        newKeyedDeque(),
+		maxSize:      maxSize,
+		expiredAfter: expiredAfter,
+		clock:        c,
+	}
+}
+
+// get returns the item whose target is target.
+func (s *itemStore) get(target string) (*Item, bool) {
+	e, ok := s.items.Get(target)
+	if !ok {
+		return nil, false
+	}
+
+	stored := e.Value.(*storedItem)
+	if s.clock.Now().Sub(stored.updateTime) > s.expiredAfter {
+		return nil, false
+	}
+	return stored.item, true
+}
+
+/*
+put stores item whose target is target. For mutable items, the seq should
+not go backwards, and when cas is not nil it must be the seq stored now.
+It returns a *KRPCError with the BEP 44 error code when item is refused.
+*/
+func (s *itemStore) put(target string, item *Item, cas *int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if old, ok := s.get(target); ok && item.Mutable() {
+		if cas != nil && *cas != old.Seq {
+			return &KRPCError{casMismatchError, "CAS mismatch"}
+		}
+		if item.Seq < old.Seq || item.Seq == old.Seq &&
+			Encode(item.V) != Encode(old.V) {
+			return &KRPCError{seqTooSmallError,
+				"sequence number less than current"}
+		}
+	}
+
+	if !s.items.HasKey(target) && s.items.Len() >= s.maxSize {
+		s.items.Remove(s.items.Front())
+	}
+	s.items.Push(target, &storedItem{target, item, s.clock.Now()})
+	return nil
+}
+
+// len returns the number of items.
+func (s *itemStore) len() int {
+	return s.items.Len()
+}
+
+// clear removes expired items until stop is closed.
+func (s *itemStore) clear(stop <-chan struct{}) {
+	tick := time.NewTicker(time.Minute * 5)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
+		now := s.clock.Now()
+		targets := make([]string, 0, 100)
+		for e := range s.items.Iter() {
+			stored := e.Value.(*storedItem)
+			if now.Sub(stored.updateTime) > s.expiredAfter {
+				targets = append(targets, stored.target)
+			}
+		}
+
+		// 期间可能又被 put 了
+		s.Lock()
+		for _, target := range targets {
+			if _, ok := s.get(target); !ok {
+				s.items.Delete(target)
+			}
+		}
+		s.Unlock()
+	}
+}
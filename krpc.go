@@ -1,10 +1,12 @@
 package dht
 
 import (
+	"crypto/sha1"
 	"errors"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +30,9 @@ const (
 	findNodeType     = "find_node"
 	getPeersType     = "get_peers"
 	announcePeerType = "announce_peer"
+	// BEP 44
+	getType = "get"
+	putType = "put"
 )
 
 const (
@@ -43,82 +48,101 @@ type packet struct {
 	raddr *net.UDPAddr
 }
 
-// token represents the token when response getPeers request.
-type token struct {
-	data       string
-	createTime time.Time
-}
-
-// tokenManager managers the tokens.
+/*
+tokenManager makes the tokens of get_peers and get responses, see BEP 5.
+token 是 SHA-1(ip + secret)，secret 每 expiredAfter/2 更换一次，当前和上一个secret
+生成的token都有效，不需要为每个ip保存状态
+*/
 type tokenManager struct {
-	*syncedMap
-	expiredAfter time.Duration
-	dht          *DHT
+	sync.Mutex
+	secret, prevSecret string
+	rotateTime         time.Time
+	expiredAfter       time.Duration
+	clock              clock
 }
 
 // newTokenManager returns a new tokenManager.
-func newTokenManager(expiredAfter time.Duration, dht *DHT) *tokenManager {
+func newTokenManager(expiredAfter time.Duration, c clock) *tokenManager {
 	return &tokenManager{
-		syncedMap:    newSyncedMap(),
+		secret:       randomString(20),
+		prevSecret:   randomString(20),
+		rotateTime:   c.Now(),
 		expiredAfter: expiredAfter,
-		dht:          dht,
+		clock:        c,
 	}
 }
 
-// token returns a token. If it doesn't exist or is expired, it will add a
-// new token.
-func (tm *tokenManager) token(addr *net.UDPAddr) string {
-	v, ok := tm.Get(addr.IP.String())
-	tk, _ := v.(token)
-
-	if !ok || time.Now().Sub(tk.createTime) > tm.expiredAfter {
-		tk = token{
-			data:       randomString(5),
-			createTime: time.Now(),
-		}
+// secrets rotates the secret when it's time, and returns the current and
+// previous secrets.
+func (tm *tokenManager) secrets(now time.Time) (secret, prevSecret string) {
+	tm.Lock()
+	defer tm.Unlock()
 
-		tm.Set(addr.IP.String(), tk)
+	period := tm.expiredAfter / 2
+	if d := now.Sub(tm.rotateTime); d >= period*2 {
+		tm.secret, tm.prevSecret = randomString(20), randomString(20)
+		tm.rotateTime = now
+	} else if d >= period {
+		tm.secret, tm.prevSecret = randomString(20), tm.secret
+		tm.rotateTime = now
 	}
-
-	return tk.data
+	return tm.secret, tm.prevSecret
 }
 
-// clear removes expired tokens.
-func (tm *tokenManager) clear() {
-	for _ = range time.Tick(time.Minute * 3) {
-		keys := make([]interface{}, 0, 100)
+// makeToken returns the token of ip made with secret.
+func makeToken(ip net.IP, secret string) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 
-		for item := range tm.Iter() {
-			if time.Now().Sub(item.val.(token).createTime) > tm.expiredAfter {
-				keys = append(keys, item.key)
-			}
-		}
+	hash := sha1.Sum(append(append([]byte(nil), ip...), secret...))
+	return string(hash[:])
+}
 
-		tm.DeleteMulti(keys)
-	}
+// token returns the token of addr.
+func (tm *tokenManager) token(addr *net.UDPAddr) string {
+	secret, _ := tm.secrets(tm.clock.Now())
+	return makeToken(addr.IP, secret)
 }
 
-// check returns whether the token is valid.
+// check returns whether the token is made for addr with the current or the
+// previous secret.
 func (tm *tokenManager) check(addr *net.UDPAddr, tokenString string) bool {
-	key := addr.IP.String()
-	v, ok := tm.Get(key)
-	tk, _ := v.(token)
+	secret, prevSecret := tm.secrets(tm.clock.Now())
+	return tokenString == makeToken(addr.IP, secret) ||
+		tokenString == makeToken(addr.IP, prevSecret)
+}
 
-	if ok {
-		tm.Delete(key)
-	}
+// token returns the token of addr, it's counted in Metrics.
+func (dht *DHT) token(addr *net.UDPAddr) string {
+	atomic.AddUint64(&dht.metrics.tokensIssued, 1)
+	return dht.tokenManager.token(addr)
+}
 
-	return ok && tokenString == tk.data
+// checkToken returns whether tokenString is made for addr, the failures are
+// counted in Metrics.
+func (dht *DHT) checkToken(addr *net.UDPAddr, tokenString string) bool {
+	if dht.tokenManager.check(addr, tokenString) {
+		return true
+	}
+	atomic.AddUint64(&dht.metrics.tokenCheckFailures, 1)
+	return false
 }
 
-// makeQuery returns a query-formed data.
-func makeQuery(t, q string, a map[string]interface{}) map[string]interface{} {
-	return map[string]interface{}{
+// makeQuery returns a query-formed data, with ro=1 when readOnly is set.
+func makeQuery(t, q string, a map[string]interface{},
+	readOnly bool) map[string]interface{} {
+
+	data := map[string]interface{}{
 		"t": t,
 		"y": "q",
 		"q": q,
 		"a": a,
 	}
+	if readOnly {
+		data["ro"] = 1
+	}
+	return data
 }
 
 // makeResponse returns a response-formed data.
@@ -144,9 +168,19 @@ send sends data to the udp.
 发送异常就将ip加入黑名单了，这优点鲁棒
 */
 func send(dht *DHT, addr *net.UDPAddr, data map[string]interface{}) error {
-	dht.conn.SetWriteDeadline(time.Now().Add(time.Second * 15))
+	// BEP 42: 响应中告知对方它的外网ip
+	if data["y"] == "r" {
+		if ip, err := encodeCompactIPPortInfo(addr.IP, addr.Port); err == nil {
+			data["ip"] = ip
+		}
+	}
+
+	// 调用者的 PacketConn 的超时由调用者管理
+	if dht.PacketConn == nil {
+		dht.conn.SetWriteDeadline(time.Now().Add(time.Second * 15))
+	}
 
-	_, err := dht.conn.WriteToUDP([]byte(Encode(data)), addr)
+	_, err := dht.conn.WriteTo([]byte(Encode(data)), addr)
 	if err != nil {
 		dht.blackList.insert(addr.IP.String(), -1)
 	}
@@ -157,13 +191,75 @@ func send(dht *DHT, addr *net.UDPAddr, data map[string]interface{}) error {
 type query struct {
 	node *node
 	data map[string]interface{}
+	// done is called with the response or error message once the query
+	// ends, nil means it fails. It may be nil.
+	done func(response map[string]interface{})
+}
+
+/*
+maintains returns whether q is a find_node or ping sent by join or the
+refresh of the routing table. bootstrapNodes only records the answers to
+them, the lookups and the other queries don't touch it.
+*/
+func (q *query) maintains() bool {
+	if q.done != nil {
+		return false
+	}
+	t := q.data["q"]
+	return t == findNodeType || t == pingType
 }
 
 // transaction implements transaction.
 type transaction struct {
 	*query
 	id       string
-	response chan struct{}
+	response chan map[string]interface{}
+
+	// waiters are the done of the same queries sent while it's running, see
+	// sendQueryDone
+	waitersMu sync.Mutex
+	waiters   []func(response map[string]interface{})
+	finished  bool
+}
+
+// asks returns whether a asks the same as trans, eg the same target.
+func (trans *transaction) asks(a map[string]interface{}) bool {
+	ta, _ := trans.data["a"].(map[string]interface{})
+	for _, key := range []string{"target", "info_hash"} {
+		if ta[key] != a[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// wait adds done to be called with the response of trans. It returns false
+// when trans has finished.
+func (trans *transaction) wait(done func(map[string]interface{})) bool {
+	trans.waitersMu.Lock()
+	defer trans.waitersMu.Unlock()
+
+	if trans.finished {
+		return false
+	}
+	trans.waiters = append(trans.waiters, done)
+	return true
+}
+
+// finish calls done and the waiters of trans with response.
+func (trans *transaction) finish(response map[string]interface{}) {
+	trans.waitersMu.Lock()
+	trans.finished = true
+	waiters := trans.waiters
+	trans.waiters = nil
+	trans.waitersMu.Unlock()
+
+	if trans.done != nil {
+		trans.done(response)
+	}
+	for _, done := range waiters {
+		done(response)
+	}
 }
 
 // transactionManager represents the manager of transactions.
@@ -203,7 +299,7 @@ func (tm *transactionManager) newTransaction(id string, q *query) *transaction {
 	return &transaction{
 		id:       id,
 		query:    q,
-		response: make(chan struct{}, tm.dht.Try+1),
+		response: make(chan map[string]interface{}, tm.dht.Try+1),
 	}
 }
 
@@ -239,7 +335,11 @@ func (tm *transactionManager) delete(transID string) {
 
 	trans := v.(*transaction)
 	tm.transactions.Delete(trans.id)
-	tm.index.Delete(tm.genIndexKeyByTrans(trans))
+	// 同一个节点可能有问的不一样的查询在进行，index 指向的是后来的
+	key := tm.genIndexKeyByTrans(trans)
+	if v, ok := tm.index.Get(key); ok && v.(*transaction) == trans {
+		tm.index.Delete(key)
+	}
 }
 
 // len returns how many transactions are requesting now.
@@ -301,64 +401,128 @@ func (tm *transactionManager) query(q *query, try int) {
 	tm.insert(trans)
 	defer tm.delete(trans.id)
 
-	success := false
-	for i := 0; i < try; i++ {
+	var response map[string]interface{}
+	defer func() {
+		trans.finish(response)
+	}()
+
+	qtype := metricQueryType(q.data["q"].(string))
+	success, timedOut := false, false
+	for i := 0; i < try && !success; i++ {
 		if err := send(tm.dht, q.node.addr, q.data); err != nil {
 			// log.Println(q.node.addr, err)
 			break
 		}
+		tm.dht.metrics.queriesSent.inc(qtype)
 
 		select {
-		case <-trans.response:
+		case response = <-trans.response:
 			success = true
-			break
 		case <-time.After(time.Second * 15):
 			// case <-time.After(time.Second * 2):
+			timedOut = true
+		case <-tm.dht.closing:
+			// 节点停止，取消进行中的transaction
+			return
+		}
+	}
+	if !success {
+		if timedOut {
+			atomic.AddUint64(&tm.dht.metrics.transactionsTimedOut, 1)
+		}
+		if q.maintains() {
+			tm.dht.bootstrapNodes.failed(q.node.addr.String())
 		}
 	}
 	// 初始化时，还没有ready，就先不考虑黑名单问题，性能考虑，去掉条件：tm.dht.Ready &&
 	if !success && q.node.id != nil {
 		tm.dht.blackList.insert(q.node.addr.IP.String(), q.node.addr.Port)
-		tm.dht.routingTable.RemoveByAddr(q.node.addr.String())
+		tm.dht.removeByAddr(q.node.addr)
 	}
 }
 
-// run starts to listen and consume the query chan.
+// run starts to listen and consume the query chan until the dht stops.
 func (tm *transactionManager) run() {
 	var q *query
 	// 限定query1024并发，不然会很卡
 	xQ := make(chan struct{}, tm.dht.QueryWorkLimit*2)
 	for {
 		select {
+		case <-tm.dht.closing:
+			return
 		case q = <-tm.queryChan:
 			// 这里必须异步： go，否则全部堵塞无法运行
 			// go tm.query(q, tm.dht.Try)
-			xQ <- struct{}{}
-			go func(q1 *query) {
+			select {
+			case xQ <- struct{}{}:
+			case <-tm.dht.closing:
+				return
+			}
+			// 全局的查询速率，用完了就等
+			if d := tm.dht.outbound.wait(tm.dht.clock.Now()); d > 0 {
+				atomic.AddUint64(&tm.dht.metrics.outboundDelayed, 1)
+				select {
+				case <-time.After(d):
+				case <-tm.dht.closing:
+					<-xQ
+					return
+				}
+			}
+			q1 := q
+			if !tm.dht.spawn(func() {
 				defer func() {
 					<-xQ
 				}()
 				tm.query(q1, tm.dht.Try)
-			}(q)
-
+			}) {
+				<-xQ
+			}
 		}
 	}
 }
 
 // sendQuery send query-formed data to the chan.
 func (tm *transactionManager) sendQuery(no *node, queryType string, a map[string]interface{}) {
+	tm.sendQueryDone(no, queryType, a, nil)
+}
+
+/*
+sendQueryDone is like sendQuery, done is called with the response once the
+query ends, see query.done. The query which isn't sent is a failure. When the
+same query to the node is running, done waits for its response instead.
+*/
+func (tm *transactionManager) sendQueryDone(no *node, queryType string,
+	a map[string]interface{}, done func(map[string]interface{})) {
 
 	// If the target is self, then stop.
 	if no.id != nil && no.id.RawString() == tm.dht.node.id.RawString() ||
-		tm.getByIndex(tm.genIndexKey(queryType, no.addr.String())) != nil ||
 		tm.dht.blackList.in(no.addr.IP.String(), no.addr.Port) {
+		if done != nil {
+			done(nil)
+		}
 		return
 	}
 
-	data := makeQuery(tm.genTransID(), queryType, a)
-	tm.queryChan <- &query{
+	// 同样的查询正在进行，不再发送，等它的回应；问的不一样时照常发送
+	if trans := tm.getByIndex(
+		tm.genIndexKey(queryType, no.addr.String())); trans != nil {
+
+		if done == nil || trans.asks(a) && trans.wait(done) {
+			return
+		}
+	}
+
+	data := makeQuery(tm.genTransID(), queryType, a, tm.dht.ReadOnly)
+	select {
+	case tm.queryChan <- &query{
 		node: no,
 		data: data,
+		done: done,
+	}:
+	case <-tm.dht.closing:
+		if done != nil {
+			done(nil)
+		}
 	}
 }
 
@@ -371,34 +535,26 @@ func (tm *transactionManager) ping(no *node) {
 
 // findNode sends find_node query to the chan.
 func (tm *transactionManager) findNode(no *node, target string) {
-	tm.sendQuery(no, findNodeType, map[string]interface{}{
+	a := map[string]interface{}{
 		"id":     tm.dht.id(target),
 		"target": target,
-	})
+	}
+	if want := tm.dht.want(); want != nil {
+		a["want"] = want
+	}
+	tm.sendQuery(no, findNodeType, a)
 }
 
 // getPeers sends get_peers query to the chan.
 func (tm *transactionManager) getPeers(no *node, infoHash string) {
-	tm.sendQuery(no, getPeersType, map[string]interface{}{
+	a := map[string]interface{}{
 		"id":        tm.dht.id(infoHash),
 		"info_hash": infoHash,
-	})
-}
-
-/*
-announcePeer sends announce_peer query to the chan.
-implied_port 如果它存在且非零，则应忽略端口参数，而应使用UDP数据包的源端口作为对等体的端口,所以通常为1
-*/
-func (tm *transactionManager) announcePeer(
-	no *node, infoHash string, impliedPort, port int, token string) {
-
-	tm.sendQuery(no, announcePeerType, map[string]interface{}{
-		"id":           tm.dht.id(no.id.RawString()),
-		"info_hash":    infoHash,
-		"implied_port": impliedPort,
-		"port":         port,
-		"token":        token,
-	})
+	}
+	if want := tm.dht.want(); want != nil {
+		a["want"] = want
+	}
+	tm.sendQuery(no, getPeersType, a)
 }
 
 /*
@@ -462,6 +618,11 @@ func parseMessage(data interface{}) (map[string]interface{}, error) {
 func handleRequest(dht *DHT, addr *net.UDPAddr,
 	response map[string]interface{}) (success bool) {
 
+	// BEP 43, 只读节点不回应任何请求
+	if dht.ReadOnly {
+		return
+	}
+
 	t := response["t"].(string)
 
 	if err := ParseKeys(
@@ -473,6 +634,10 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 
 	q := response["q"].(string)
 	a := response["a"].(map[string]interface{})
+	dht.metrics.queriesReceived.inc(metricQueryType(q))
+	if !dht.allowQuery(addr, q) {
+		return
+	}
 
 	if err := ParseKey(a, "id", "string"); err != nil {
 		send(dht, addr, makeError(t, protocolError, err.Error()))
@@ -490,11 +655,11 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 		return
 	}
 
-	if no, ok := dht.routingTable.GetNodeByAddress(addr.String()); ok &&
+	if no, ok := dht.getNodeByAddress(addr); ok &&
 		no.id.RawString() != id {
 
 		dht.blackList.insert(addr.IP.String(), addr.Port)
-		dht.routingTable.RemoveByAddr(addr.String())
+		dht.removeByAddr(addr)
 
 		send(dht, addr, makeError(t, protocolError, "invalid id"))
 		return
@@ -502,10 +667,15 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 
 	switch q {
 	case pingType:
+		dht.events.publish(PingQueryEvent{ID: rawNodeID(id), Addr: addr})
 		send(dht, addr, makeResponse(t, map[string]interface{}{
 			"id": dht.id(id),
 		}))
 	case findNodeType:
+		if target, _ := a["target"].(string); len(target) == 20 {
+			dht.events.publish(FindNodeQueryEvent{
+				ID: rawNodeID(id), Target: rawNodeID(target), Addr: addr})
+		}
 		if dht.IsStandardMode() {
 			if err := ParseKey(a, "target", "string"); err != nil {
 				send(dht, addr, makeError(t, protocolError, err.Error()))
@@ -518,23 +688,13 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 				return
 			}
 
-			var nodes string
-			targetID := newBitmapFromString(target)
-
-			no, _ := dht.routingTable.GetNodeKBucktByID(targetID)
-			if no != nil {
-				nodes = no.CompactNodeInfo()
-			} else {
-				nodes = strings.Join(
-					dht.routingTable.GetNeighborCompactInfos(targetID, dht.K),
-					"",
-				)
+			r := map[string]interface{}{
+				"id": dht.id(target),
 			}
+			n4, n6 := parseWant(a, addr)
+			dht.setCompactNodes(r, newBitmapFromString(target), n4, n6)
 
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":    dht.id(target),
-				"nodes": nodes,
-			}))
+			send(dht, addr, makeResponse(t, r))
 		}
 	case getPeersType:
 		if err := ParseKey(a, "info_hash", "string"); err != nil {
@@ -552,34 +712,48 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 		if dht.IsCrawlMode() {
 			send(dht, addr, makeResponse(t, map[string]interface{}{
 				"id":    dht.id(infoHash),
-				"token": dht.tokenManager.token(addr),
+				"token": dht.token(addr),
 				"nodes": "",
 			}))
-		} else if peers := dht.peersManager.GetPeers(
-			infoHash, dht.K); len(peers) > 0 {
+		} else {
+			r := map[string]interface{}{
+				"id":    dht.id(infoHash),
+				"token": dht.token(addr),
+			}
 
-			values := make([]interface{}, len(peers))
-			for i, p := range peers {
-				values[i] = p.CompactIPPortInfo()
+			noseed, _ := a["noseed"].(int)
+			if values := dht.peerValues(
+				infoHash, addr, noseed != 0); len(values) > 0 {
+				r["values"] = values
 			}
+			// 有values也返回nodes，lookup才能继续接近infohash
+			n4, n6 := parseWant(a, addr)
+			dht.setCompactNodes(r, newBitmapFromString(infoHash), n4, n6)
 
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":     dht.id(infoHash),
-				"values": values,
-				"token":  dht.tokenManager.token(addr),
-			}))
-		} else {
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":    dht.id(infoHash),
-				"token": dht.tokenManager.token(addr),
-				"nodes": strings.Join(dht.routingTable.GetNeighborCompactInfos(
-					newBitmapFromString(infoHash), dht.K), ""),
-			}))
+			// BEP 33
+			if scrape, _ := a["scrape"].(int); scrape != 0 {
+				dht.peersManager.setScrape(infoHash, r)
+			}
+
+			send(dht, addr, makeResponse(t, r))
 		}
 
 		if dht.OnGetPeers != nil {
 			dht.OnGetPeers(infoHash, addr.IP.String(), addr.Port)
 		}
+		dht.events.publish(GetPeersQueryEvent{InfoHash: infoHash, Addr: addr})
+	case getType:
+		if dht.IsStandardMode() && !handleGet(dht, addr, t, a) {
+			return
+		}
+	case putType:
+		if dht.IsStandardMode() && !handlePut(dht, addr, t, a) {
+			return
+		}
+	case sampleInfohashesType:
+		if !handleSampleInfohashes(dht, addr, t, a) {
+			return
+		}
 	case announcePeerType:
 		if err := ParseKeys(a, [][]string{
 			{"info_hash", "string"},
@@ -596,9 +770,9 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 		token := a["token"].(string)
 
 		// 判断地址和token的一致性，不一致就返回
-		// addr在管理器中就从管理器中删除
-		if !dht.tokenManager.check(addr, token) {
-			//			send(dht, addr, makeError(t, protocolError, "invalid token"))
+		// token 在有效期内可以重复使用
+		if !dht.checkToken(addr, token) {
+			send(dht, addr, makeError(t, protocolError, "invalid token"))
 			return
 		}
 
@@ -607,9 +781,13 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 			port = addr.Port
 		}
 
+		seed, _ := a["seed"].(int)
 		// 伪装模式，接收DHT网络 数据包，监听功能
 		if dht.IsStandardMode() {
-			dht.peersManager.Insert(infoHash, newPeer(addr.IP, port, token))
+			peer := newPeer(addr.IP, port, token)
+			peer.Seed = seed != 0
+			dht.peersManager.Insert(infoHash, peer)
+			dht.peersManager.addScrape(infoHash, addr.IP, peer.Seed)
 
 			// 给个响应
 			send(dht, addr, makeResponse(t, map[string]interface{}{
@@ -617,10 +795,11 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 			}))
 		}
 
-		go dht.appendIps2DhtTracker(addr.String(), "")
 		if dht.OnAnnouncePeer != nil {
 			dht.OnAnnouncePeer(infoHash, addr.IP.String(), port)
 		}
+		dht.events.publish(AnnouncePeerEvent{
+			InfoHash: infoHash, Addr: addr, Port: port, Seed: seed != 0})
 		// join 到新的匿名节点，加快自己的节点被发现的能力，加大自己节点的推广作用，2022-04-04 add
 		// 缺点是，这样可能会被其他节点列入黑名单
 		// dht.transactionManager.findNode(
@@ -632,8 +811,15 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 		return
 	}
 
-	no, _ := newNode(id, addr.Network(), addr.String())
-	dht.routingTable.Insert(no)
+	// BEP 43, 只读节点不回应请求，不能放进路由表
+	if ro, _ := response["ro"].(int); ro != 0 {
+		dht.removeByAddr(addr)
+		return true
+	}
+
+	if no, err := newNode(id, addr.Network(), addr.String()); err == nil {
+		dht.insertNode(no)
+	}
 	// 不管节点是什么，加Ta
 	dht.Join2addr(addr.String())
 	return true
@@ -642,31 +828,24 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 /*
 findOn puts nodes in the response to the routingTable, then if target is in
 the nodes or all nodes are in the routingTable, it stops. Otherwise it
-continues to findNode or getPeers.
+continues to findNode or getPeers. The queries sent by lookup don't use it.
 */
 func findOn(dht *DHT, r map[string]interface{}, target *bitmap,
 	queryType string) error {
 
-	if err := ParseKey(r, "nodes", "string"); err != nil {
+	// BEP 32: nodes 和 nodes6
+	nodes, err := dht.parseCompactNodes(r)
+	if err != nil {
 		return err
 	}
 
-	nodes := r["nodes"].(string)
-	// 长度必须是26的倍数
-	if len(nodes)%26 != 0 {
-		return errors.New("the length of nodes should can be divided by 26")
-	}
-
 	hasNew, found := false, false
-	for i := 0; i < len(nodes)/26; i++ {
-		no, _ := newNodeFromCompactInfo(
-			string(nodes[i*26:(i+1)*26]), dht.Network)
-
+	for _, no := range nodes {
 		if no.id.RawString() == target.RawString() {
 			found = true
 		}
 
-		if dht.routingTable.Insert(no) {
+		if dht.insertNode(no) {
 			hasNew = true
 		}
 	}
@@ -676,7 +855,7 @@ func findOn(dht *DHT, r map[string]interface{}, target *bitmap,
 	}
 
 	targetID := target.RawString()
-	for _, no := range dht.routingTable.GetNeighbors(target, dht.K) {
+	for _, no := range dht.getNeighbors(target, dht.K) {
 		switch queryType {
 		case findNodeType:
 			dht.transactionManager.findNode(no, targetID)
@@ -704,6 +883,7 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 	if trans == nil {
 		return
 	}
+	dht.metrics.responsesReceived.inc(metricQueryType(trans.data["q"].(string)))
 
 	// inform transManager to delete the transaction.
 	if err := ParseKey(response, "r", "map"); err != nil {
@@ -724,11 +904,14 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 	// transaction, raise error.
 	if trans.node.id != nil && trans.node.id.RawString() != r["id"].(string) {
 		dht.blackList.insert(addr.IP.String(), addr.Port)
-		dht.routingTable.RemoveByAddr(addr.String())
+		dht.removeByAddr(addr)
 		return
 	}
-	// 记录地址信息，便于将来使用，当然可能是临时的，也可能是长效的
-	go dht.appendIps2DhtTracker(addr.String(), "")
+	// 正确回应 join、刷新路由表的节点下次 join 时优先使用
+	if trans.maintains() {
+		dht.bootstrapNodes.answered(addr.String(), dht.clock.Now())
+	}
+	dht.learnPublicIp(addr, response)
 	node, err := newNode(id, addr.Network(), addr.String())
 	if err != nil {
 		return
@@ -742,7 +925,11 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 		}
 
 		target := trans.data["a"].(map[string]interface{})["target"].(string)
-		if findOn(dht, r, newBitmapFromString(target), findNodeType) != nil {
+		if trans.done != nil {
+			// lookup 自己迭代查询
+			dht.insertCompactNodes(r)
+		} else if findOn(
+			dht, r, newBitmapFromString(target), findNodeType) != nil {
 			return
 		}
 	case getPeersType:
@@ -753,7 +940,10 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 		token := r["token"].(string)
 		infoHash := a["info_hash"].(string)
 
-		if err := ParseKey(r, "values", "list"); err == nil {
+		if trans.done != nil {
+			// lookup 自己处理 values 和 nodes
+			dht.insertCompactNodes(r)
+		} else if err := ParseKey(r, "values", "list"); err == nil {
 			values := r["values"].([]interface{})
 			for _, v := range values {
 				p, err := newPeerFromCompactIPPortInfo(v.(string), token)
@@ -764,21 +954,25 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 				if dht.OnGetPeersResponse != nil {
 					dht.OnGetPeersResponse(infoHash, p)
 				}
+				dht.events.publish(PeerFoundEvent{InfoHash: infoHash, Peer: p})
 			}
 		} else if findOn(
 			dht, r, newBitmapFromString(infoHash), getPeersType) != nil {
 			return
 		}
-	case announcePeerType:
+	case getType, sampleInfohashesType:
+		// nodes 加入路由表，迭代查询由 lookup、SampleInfohashes 进行
+		dht.insertCompactNodes(r)
+	case announcePeerType, putType:
 	default:
 		return
 	}
 
 	// inform transManager to delete transaction.
-	trans.response <- struct{}{}
+	trans.response <- response
 
 	dht.blackList.delete(addr.IP.String(), addr.Port)
-	dht.routingTable.Insert(node)
+	dht.insertNode(node)
 
 	return true
 }
@@ -798,7 +992,8 @@ func handleError(dht *DHT, addr *net.UDPAddr,
 	if trans := dht.transactionManager.filterOne(
 		response["t"].(string), addr); trans != nil {
 
-		trans.response <- struct{}{}
+		dht.metrics.errorsReceived.inc(metricQueryType(trans.data["q"].(string)))
+		trans.response <- response
 	}
 
 	return true
@@ -815,13 +1010,18 @@ handle handles packets received from udp.
 检查黑名单ip，黑名单ip数据直接跳过
 */
 func handle(dht *DHT, pkt packet) {
+	// 一个ip发太多数据包时不占用worker
+	if !dht.allowPacket(pkt.raddr) {
+		return
+	}
 	if len(dht.workerTokens) == dht.PacketWorkerLimit {
+		dht.metrics.packetsDropped.inc(dropWorkers)
 		return
 	}
 
 	dht.workerTokens <- struct{}{}
 
-	go func() {
+	if !dht.spawn(func() {
 		defer func() {
 			<-dht.workerTokens
 		}()
@@ -843,5 +1043,7 @@ func handle(dht *DHT, pkt packet) {
 		if f, ok := handlers[response["y"].(string)]; ok {
 			f(dht, pkt.raddr, response)
 		}
-	}()
+	}) {
+		<-dht.workerTokens
+	}
 }
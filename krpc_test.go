@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenManager(t *testing.T) {
+	tm := newTokenManager(time.Minute*10, realClock{})
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6881}
+	other := &net.UDPAddr{IP: net.ParseIP("1.2.3.5"), Port: 6881}
+
+	tk := tm.token(addr)
+	if tk != tm.token(&net.UDPAddr{IP: addr.IP, Port: 1}) {
+		t.Error("token depends on the port")
+	}
+	if tm.check(other, tk) {
+		t.Error("token of another ip is accepted")
+	}
+	// 可以重复使用
+	for i := 0; i < 2; i++ {
+		if !tm.check(addr, tk) {
+			t.Fatal("token is refused", i)
+		}
+	}
+
+	// 上一个secret生成的token仍然有效
+	now := tm.rotateTime.Add(time.Minute * 5)
+	tm.secrets(now)
+	if !tm.check(addr, tk) {
+		t.Error("token of the previous secret is refused")
+	}
+	if tm.token(addr) == tk {
+		t.Error("secret is not rotated")
+	}
+
+	tm.secrets(now.Add(time.Minute * 5))
+	if tm.check(addr, tk) {
+		t.Error("expired token is accepted")
+	}
+}
+
+func TestSendQueryDoneWaits(t *testing.T) {
+	d, conn := startQuerier(t, newTestConfig())
+	defer d.Stop()
+	defer conn.Close()
+
+	no := &node{addr: conn.LocalAddr().(*net.UDPAddr)}
+	responses := make(chan map[string]interface{}, 3)
+	done := func(response map[string]interface{}) { responses <- response }
+	target, other := randomString(20), randomString(20)
+
+	// readQuery returns the next query d sends to conn.
+	readQuery := func() map[string]interface{} {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		message, err := Decode(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, _ := message.(map[string]interface{})
+		return query
+	}
+
+	tm := d.transactionManager
+	tm.sendQueryDone(no, findNodeType, map[string]interface{}{
+		"id": d.id(target), "target": target}, done)
+	first := readQuery()
+	if first == nil {
+		t.Fatal("no query")
+	}
+
+	// 同样的查询等第一个的回应，问的不一样的照常发送
+	tm.sendQueryDone(no, findNodeType, map[string]interface{}{
+		"id": d.id(target), "target": target}, done)
+	tm.sendQueryDone(no, findNodeType, map[string]interface{}{
+		"id": d.id(other), "target": other}, done)
+	second := readQuery()
+	if a, _ := second["a"].(map[string]interface{}); a["target"] != other {
+		t.Fatal("different query is not sent", second)
+	}
+
+	if _, err := conn.WriteTo([]byte(Encode(makeResponse(first["t"].(string),
+		map[string]interface{}{"id": randomString(20)}))), d.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case response := <-responses:
+			if response == nil || response["t"] != first["t"] {
+				t.Error(i, response)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("no response", i)
+		}
+	}
+	if query := readQuery(); query != nil {
+		t.Error("query is sent again", query)
+	}
+}
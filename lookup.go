@@ -0,0 +1,489 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Iterative lookup of Kademlia, shared by find_node, get_peers, get and announce.
+候选节点按到target的XOR距离排序，每次最多向lookupAlpha个最近的未查询节点发送查询，
+最近的K个节点都已回应（或失败）时lookup收敛结束
+*/
+
+const (
+	// lookupAlpha is how many queries a lookup waits for at the same time.
+	lookupAlpha = 3
+	// lookupHopTimeout is how long a lookup waits for a node before it
+	// queries the next one. The node is then stalled, its late response is
+	// still used.
+	lookupHopTimeout = time.Second * 2
+)
+
+var (
+	// ErrNodeNotFound is returned by FindNode when no node has the id.
+	ErrNodeNotFound = errors.New("dht: node not found")
+	// ErrNoResponse is the error of a node which doesn't answer the query.
+	ErrNoResponse = errors.New("dht: no response")
+
+	errInvalidInfoHash = errors.New("dht: invalid info_hash")
+)
+
+// The states of lookup candidates.
+const (
+	candidateFresh = iota
+	candidateQueried
+	// 超过 hopTimeout 没有回应，不再占用alpha
+	candidateStalled
+	candidateResponded
+	candidateFailed
+)
+
+// lookupResponse is the response of a query sent by lookup, r is nil when the
+// query fails.
+type lookupResponse struct {
+	node  *node
+	token string
+	r     map[string]interface{}
+}
+
+// lookupCandidate is a node a lookup knows.
+type lookupCandidate struct {
+	node     *node
+	distance *bitmap
+	state    int
+	sendTime time.Time
+	response *lookupResponse
+}
+
+// lookup is an iterative query towards target.
+type lookup struct {
+	dht        *DHT
+	queryType  string
+	target     *bitmap
+	args       map[string]interface{}
+	alpha, k   int
+	hopTimeout time.Duration
+
+	// candidates are sorted by the distance to target
+	candidates []*lookupCandidate
+	byAddr     map[string]*lookupCandidate
+	// inflight is how many candidates are queried but not stalled
+	inflight int
+
+	// 回调不能阻塞，结果先放入results再通知
+	mu      sync.Mutex
+	results []*lookupResponse
+	notify  chan struct{}
+}
+
+/*
+newLookup returns a lookup which sends queryType queries whose arguments are
+a. The candidates are the K nodes closest to target in the routing tables.
+*/
+func newLookup(dht *DHT, queryType, target string,
+	a map[string]interface{}) *lookup {
+
+	l := &lookup{
+		dht:        dht,
+		queryType:  queryType,
+		target:     newBitmapFromString(target),
+		args:       a,
+		alpha:      lookupAlpha,
+		k:          dht.K,
+		hopTimeout: lookupHopTimeout,
+		byAddr:     make(map[string]*lookupCandidate),
+		notify:     make(chan struct{}, 1),
+	}
+	for _, no := range dht.getNeighbors(l.target, l.k) {
+		l.add(no)
+	}
+	return l
+}
+
+// add puts no into the candidates unless it's known. It returns whether no
+// is added.
+func (l *lookup) add(no *node) bool {
+	if no.id == nil || l.byAddr[no.addr.String()] != nil {
+		return false
+	}
+
+	c := &lookupCandidate{node: no, distance: l.target.Xor(no.id)}
+	i := sort.Search(len(l.candidates), func(i int) bool {
+		return c.distance.Compare(l.candidates[i].distance, maxPrefixLength) < 0
+	})
+	l.candidates = append(l.candidates, nil)
+	copy(l.candidates[i+1:], l.candidates[i:])
+	l.candidates[i] = c
+
+	l.byAddr[no.addr.String()] = c
+	return true
+}
+
+/*
+closest returns the K closest candidates which are not failed or stalled,
+they are the ones a lookup queries and waits for.
+*/
+func (l *lookup) closest() []*lookupCandidate {
+	closest := make([]*lookupCandidate, 0, l.k)
+	for _, c := range l.candidates {
+		if len(closest) == l.k {
+			break
+		}
+		if c.state != candidateFailed && c.state != candidateStalled {
+			closest = append(closest, c)
+		}
+	}
+	return closest
+}
+
+// converged returns whether all the K closest candidates have responded.
+func (l *lookup) converged() bool {
+	for _, c := range l.closest() {
+		if c.state != candidateResponded {
+			return false
+		}
+	}
+	return true
+}
+
+// next returns the fresh candidates to query now.
+func (l *lookup) next() []*lookupCandidate {
+	var next []*lookupCandidate
+	for _, c := range l.closest() {
+		if l.inflight+len(next) >= l.alpha {
+			break
+		}
+		if c.state == candidateFresh {
+			next = append(next, c)
+		}
+	}
+	return next
+}
+
+// query sends the query to c, the result is put into l.results.
+func (l *lookup) query(c *lookupCandidate, now time.Time) {
+	c.state, c.sendTime = candidateQueried, now
+	l.inflight++
+
+	no := c.node
+	l.dht.transactionManager.sendQueryDone(no, l.queryType, l.args,
+		func(response map[string]interface{}) {
+			resp := &lookupResponse{node: no}
+			if response != nil && response["y"] == "r" {
+				resp.r = response["r"].(map[string]interface{})
+				resp.token, _ = resp.r["token"].(string)
+			}
+
+			l.mu.Lock()
+			l.results = append(l.results, resp)
+			l.mu.Unlock()
+
+			select {
+			case l.notify <- struct{}{}:
+			default:
+			}
+		})
+}
+
+// handle updates the candidates with resp, the new nodes in it become
+// candidates.
+func (l *lookup) handle(resp *lookupResponse) {
+	c := l.byAddr[resp.node.addr.String()]
+	if c == nil || (c.state != candidateQueried && c.state != candidateStalled) {
+		return
+	}
+	if c.state == candidateQueried {
+		l.inflight--
+	}
+
+	if resp.r == nil {
+		c.state = candidateFailed
+		return
+	}
+	c.state, c.response = candidateResponded, resp
+
+	if nodes, err := l.dht.parseCompactNodes(resp.r); err == nil {
+		for _, no := range nodes {
+			l.add(no)
+		}
+	}
+}
+
+// stall marks the candidates queried before hopTimeout as stalled, and
+// returns how long to wait until the next one stalls.
+func (l *lookup) stall(now time.Time) time.Duration {
+	wait := l.hopTimeout
+	for _, c := range l.candidates {
+		if c.state != candidateQueried {
+			continue
+		}
+
+		if d := c.sendTime.Add(l.hopTimeout).Sub(now); d <= 0 {
+			c.state = candidateStalled
+			l.inflight--
+		} else if d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// responses returns the responses received, sorted by distance.
+func (l *lookup) responses() []*lookupResponse {
+	var responses []*lookupResponse
+	for _, c := range l.candidates {
+		if c.state == candidateResponded {
+			responses = append(responses, c.response)
+		}
+	}
+	return responses
+}
+
+/*
+run sends the queries until the lookup converges, see converged. found is
+called with every response, the lookup stops once it returns true. It
+returns the responses sorted by the distance to target, and ctx.Err() or
+ErrNotReady when it's canceled.
+*/
+func (l *lookup) run(ctx context.Context,
+	found func(*lookupResponse) bool) ([]*lookupResponse, error) {
+
+	if l.dht.isClosing() {
+		return nil, ErrNotReady
+	}
+
+	for {
+		now := time.Now()
+		wait := l.stall(now)
+		if l.converged() {
+			return l.responses(), nil
+		}
+
+		for _, c := range l.next() {
+			l.query(c, now)
+		}
+		if l.inflight == 0 {
+			// 没有可以查询的节点了
+			return l.responses(), nil
+		}
+
+		select {
+		case <-l.notify:
+			l.mu.Lock()
+			results := l.results
+			l.results = nil
+			l.mu.Unlock()
+
+			for _, resp := range results {
+				l.handle(resp)
+				if resp.r != nil && found != nil && found(resp) {
+					return l.responses(), nil
+				}
+			}
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return l.responses(), ctx.Err()
+		case <-l.dht.closing:
+			return l.responses(), ErrNotReady
+		}
+	}
+}
+
+// lookup runs a new lookup, see newLookup and lookup.run.
+func (dht *DHT) lookup(ctx context.Context, queryType, target string,
+	a map[string]interface{}, found func(*lookupResponse) bool) (
+	[]*lookupResponse, error) {
+
+	return newLookup(dht, queryType, target, a).run(ctx, found)
+}
+
+/*
+queryClosest sends queryType queries to the K closest nodes of responses which
+give a token, args returns the arguments with the token. It returns the nodes
+queried and the error of each of them: nil when the node accepts the query,
+a *KRPCError when it refuses, ErrNoResponse, or ctx.Err() and ErrNotReady
+for the queries not finished when ctx is done or the dht stops.
+*/
+func (dht *DHT) queryClosest(ctx context.Context, responses []*lookupResponse,
+	queryType string, args func(token string) map[string]interface{}) (
+	[]*node, []error) {
+
+	type result struct {
+		i   int
+		err error
+	}
+
+	var nodes []*node
+	ch := make(chan result, dht.K)
+	for _, resp := range responses {
+		if len(nodes) == dht.K {
+			break
+		}
+		if resp.token == "" {
+			continue
+		}
+
+		i := len(nodes)
+		nodes = append(nodes, resp.node)
+		dht.transactionManager.sendQueryDone(resp.node, queryType,
+			args(resp.token), func(response map[string]interface{}) {
+				switch {
+				case response == nil:
+					ch <- result{i, ErrNoResponse}
+				case response["y"] == "e":
+					if e := parseKRPCError(response); e != nil {
+						ch <- result{i, e}
+						return
+					}
+					ch <- result{i, ErrNoResponse}
+				default:
+					ch <- result{i, nil}
+				}
+			})
+	}
+
+	errs := make([]error, len(nodes))
+	done := make([]bool, len(nodes))
+	fail := func(err error) ([]*node, []error) {
+		for i := range errs {
+			if !done[i] {
+				errs[i] = err
+			}
+		}
+		return nodes, errs
+	}
+
+	for range nodes {
+		select {
+		case r := <-ch:
+			errs[r.i], done[r.i] = r.err, true
+		case <-ctx.Done():
+			return fail(ctx.Err())
+		case <-dht.closing:
+			return fail(ErrNotReady)
+		}
+	}
+	return nodes, errs
+}
+
+/*
+FindNode looks up the node whose id is id with find_node queries, and
+returns its address. It returns ErrNodeNotFound when the lookup converges
+without it.
+*/
+func (dht *DHT) FindNode(ctx context.Context, id NodeID) (*net.UDPAddr, error) {
+	target := id.RawString()
+	a := map[string]interface{}{
+		"id":     dht.id(target),
+		"target": target,
+	}
+	if want := dht.want(); want != nil {
+		a["want"] = want
+	}
+
+	var addr *net.UDPAddr
+	_, err := dht.lookup(ctx, findNodeType, target, a,
+		func(resp *lookupResponse) bool {
+			if resp.node.id.RawString() == target {
+				addr = resp.node.addr
+				return true
+			}
+			return false
+		})
+
+	if addr != nil {
+		return addr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrNodeNotFound
+}
+
+// parseInfoHash returns the raw infoHash, which is 20-length raw or 40-length
+// hex.
+func parseInfoHash(infoHash string) (string, error) {
+	if len(infoHash) == 40 {
+		data, err := hex.DecodeString(infoHash)
+		if err != nil {
+			return "", err
+		}
+		infoHash = string(data)
+	}
+
+	if len(infoHash) != 20 {
+		return "", errInvalidInfoHash
+	}
+	return infoHash, nil
+}
+
+// getPeersArgs returns the arguments of get_peers query.
+func (dht *DHT) getPeersArgs(infoHash string) map[string]interface{} {
+	a := map[string]interface{}{
+		"id":        dht.id(infoHash),
+		"info_hash": infoHash,
+	}
+	if want := dht.want(); want != nil {
+		a["want"] = want
+	}
+	return a
+}
+
+/*
+FindPeers looks up the peers of infoHash with get_peers queries. Every peer
+is sent to the returned channel once, which is closed when the lookup
+converges, ctx is done or the dht stops. The receiver should read until it's
+closed or cancel ctx. infoHash is the 20-length raw or 40-length hex string.
+*/
+func (dht *DHT) FindPeers(ctx context.Context, infoHash string) (
+	<-chan *Peer, error) {
+
+	infoHash, err := parseInfoHash(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	if dht.isClosing() {
+		return nil, ErrNotReady
+	}
+
+	l := newLookup(dht, getPeersType, infoHash, dht.getPeersArgs(infoHash))
+	ch := make(chan *Peer)
+
+	if !dht.spawn(func() {
+		defer close(ch)
+
+		seen := make(map[string]bool)
+		l.run(ctx, func(resp *lookupResponse) bool {
+			values, _ := resp.r["values"].([]interface{})
+			for _, v := range values {
+				info, ok := v.(string)
+				if !ok || seen[info] {
+					continue
+				}
+				p, err := newPeerFromCompactIPPortInfo(info, resp.token)
+				if err != nil {
+					continue
+				}
+				seen[info] = true
+
+				select {
+				case ch <- p:
+				case <-ctx.Done():
+					return true
+				case <-dht.closing:
+					return true
+				}
+			}
+			return false
+		})
+	}) {
+		return nil, ErrNotReady
+	}
+	return ch, nil
+}
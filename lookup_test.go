@@ -0,0 +1,218 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestLookup returns a lookup towards target which has no candidates.
+func newTestLookup(target string, k, alpha int) *lookup {
+	return &lookup{
+		dht:        New(newTestConfig()),
+		target:     newBitmapFromString(target),
+		alpha:      alpha,
+		k:          k,
+		hopTimeout: time.Second,
+		byAddr:     make(map[string]*lookupCandidate),
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+func TestLookupCandidates(t *testing.T) {
+	target := string(make([]byte, 20))
+	l := newTestLookup(target, 3, 2)
+
+	// 第i个节点距离target为i
+	var nodes []*node
+	for i := 1; i <= 5; i++ {
+		id := []byte(target)
+		id[19] = byte(i)
+		no, _ := newNode(string(id), "udp4", fmt.Sprintf("1.2.3.4:%d", i))
+		nodes = append(nodes, no)
+	}
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		l.add(nodes[i])
+	}
+	if l.add(nodes[0]) {
+		t.Error("node is added twice")
+	}
+	for i, c := range l.candidates {
+		if c.node != nodes[i] {
+			t.Fatal("candidates are not sorted", i)
+		}
+	}
+
+	now := time.Now()
+	next := l.next()
+	if len(next) != 2 || next[0].node != nodes[0] || next[1].node != nodes[1] {
+		t.Fatal("next", next)
+	}
+	for _, c := range next {
+		c.state, c.sendTime = candidateQueried, now
+		l.inflight++
+	}
+	if len(l.next()) != 0 {
+		t.Error("more than alpha queries")
+	}
+
+	// 失败的节点让出位置
+	l.handle(&lookupResponse{node: nodes[0]})
+	if next := l.next(); len(next) != 1 || next[0].node != nodes[2] {
+		t.Fatal("next after failure", next)
+	}
+	l.byAddr[nodes[2].addr.String()].state = candidateQueried
+	l.inflight++
+
+	// 超时的节点不再占用alpha
+	if wait := l.stall(now.Add(time.Second)); wait != time.Second {
+		t.Error("wait", wait)
+	}
+	if l.inflight != 0 || l.byAddr[nodes[1].addr.String()].state != candidateStalled {
+		t.Fatal("stall", l.inflight)
+	}
+	if l.converged() {
+		t.Error("converged before the closest respond")
+	}
+
+	// 超时后的回应仍然有效
+	for _, no := range nodes[1:3] {
+		l.handle(&lookupResponse{node: no, r: map[string]interface{}{}})
+	}
+	if next := l.next(); len(next) != 1 || next[0].node != nodes[3] || l.converged() {
+		t.Fatal("the third closest is not queried", next)
+	}
+	l.byAddr[nodes[3].addr.String()].state = candidateQueried
+	l.inflight++
+	l.handle(&lookupResponse{node: nodes[3], r: map[string]interface{}{}})
+	if !l.converged() {
+		t.Error("not converged")
+	}
+	if responses := l.responses(); len(responses) != 3 ||
+		responses[0].node != nodes[1] {
+		t.Error("responses", responses)
+	}
+}
+
+// startTestChain starts n dht nodes, each of which only knows the next one.
+func startTestChain(t *testing.T, n int) []*DHT {
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		nodes[i] = New(newTestConfig())
+		nodes[i].blackList.ClearAll()
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n-1; i++ {
+		next := nodes[i+1]
+		no, err := newNode(next.node.id.RawString(), "udp4", next.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i].routingTable.Insert(no)
+	}
+	return nodes
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := startTestChain(t, 3)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	addr, err := nodes[0].FindNode(ctx, nodes[2].NodeID())
+	if err != nil || addr.String() != nodes[2].Addr().String() {
+		t.Fatal(addr, err)
+	}
+
+	if _, err := nodes[0].FindNode(ctx, RandomNodeID()); err != ErrNodeNotFound {
+		t.Error(err)
+	}
+}
+
+func TestLookupStalled(t *testing.T) {
+	nodes := startTestChain(t, 3)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+
+	// silent 从不回应，但比其他节点都近
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	target := nodes[2].node.id.RawString()
+	id := []byte(target)
+	id[19] ^= 1
+	no, _ := newNode(string(id), "udp4", silent.LocalAddr().String())
+	nodes[0].routingTable.Insert(no)
+
+	l := newLookup(nodes[0], findNodeType, target, map[string]interface{}{
+		"id":     nodes[0].node.id.RawString(),
+		"target": target,
+	})
+	l.alpha, l.hopTimeout = 1, time.Millisecond*100
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	start := time.Now()
+	responses, err := l.run(ctx, nil)
+	if err != nil || !l.converged() {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second*5 {
+		t.Error("lookup waits for the stalled node")
+	}
+	if len(responses) != 2 || responses[0].node.id.RawString() != target {
+		t.Error("responses", len(responses))
+	}
+}
+
+func TestFindPeers(t *testing.T) {
+	nodes := startTestChain(t, 3)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+
+	infoHash := randomString(20)
+	p1 := newPeer(net.ParseIP("1.2.3.4"), 6881, "")
+	p2 := newPeer(net.ParseIP("1.2.3.5"), 6882, "")
+	nodes[1].peersManager.Insert(infoHash, p1)
+	nodes[2].peersManager.Insert(infoHash, p1)
+	nodes[2].peersManager.Insert(infoHash, p2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	peers, err := nodes[0].FindPeers(ctx, hex.EncodeToString([]byte(infoHash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]int)
+	for p := range peers {
+		got[p.CompactIPPortInfo()]++
+	}
+	if len(got) != 2 || got[p1.CompactIPPortInfo()] != 1 ||
+		got[p2.CompactIPPortInfo()] != 1 {
+		t.Error("peers", got)
+	}
+	if ctx.Err() != nil {
+		t.Error("lookup doesn't converge")
+	}
+
+	if _, err := nodes[0].FindPeers(ctx, "abc"); err != errInvalidInfoHash {
+		t.Error(err)
+	}
+}
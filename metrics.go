@@ -0,0 +1,335 @@
+package dht
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+运行时统计，生产环境跑 spider 时用来观察丢包、查询和路由表的情况。
+DHT.Metrics returns a snapshot, MetricsHandler serves it in the Prometheus
+text exposition format:
+	http.Handle("/metrics", dht.MetricsHandler(d, wire))
+*/
+
+const (
+	// dropQueue is the reason of the packets dropped when the packets queue
+	// is full.
+	dropQueue = "queue"
+	// dropWorkers is the reason of the packets dropped when all the packet
+	// workers are busy.
+	dropWorkers = "workers"
+	// otherQueryType is the label of the unknown query types, so a querier
+	// can't make up labels.
+	otherQueryType = "other"
+)
+
+// queryTypes are the query types counted by their own labels.
+var queryTypes = map[string]bool{
+	pingType:             true,
+	findNodeType:         true,
+	getPeersType:         true,
+	announcePeerType:     true,
+	getType:              true,
+	putType:              true,
+	sampleInfohashesType: true,
+}
+
+// metricQueryType returns the label of query type q.
+func metricQueryType(q string) string {
+	if queryTypes[q] {
+		return q
+	}
+	return otherQueryType
+}
+
+// counterVec is a group of counters keyed by a label.
+type counterVec struct {
+	sync.Mutex
+	counters map[string]uint64
+}
+
+// newCounterVec returns a new counterVec pointer.
+func newCounterVec() *counterVec {
+	return &counterVec{counters: make(map[string]uint64)}
+}
+
+// inc adds 1 to the counter of label.
+func (cv *counterVec) inc(label string) {
+	cv.Lock()
+	cv.counters[label]++
+	cv.Unlock()
+}
+
+// snapshot returns a copy of the counters.
+func (cv *counterVec) snapshot() map[string]uint64 {
+	cv.Lock()
+	defer cv.Unlock()
+
+	counters := make(map[string]uint64, len(cv.counters))
+	for label, n := range cv.counters {
+		counters[label] = n
+	}
+	return counters
+}
+
+// metrics counts what happens in a dht, the counters are kept between
+// restarts.
+type metrics struct {
+	// the uint64 fields go first to be 64-bit aligned for atomic
+	packetsReceived      uint64
+	transactionsTimedOut uint64
+	tokensIssued         uint64
+	tokenCheckFailures   uint64
+	rateLimitBlocked     uint64
+	outboundDelayed      uint64
+
+	packetsDropped    *counterVec
+	queriesSent       *counterVec
+	queriesReceived   *counterVec
+	responsesReceived *counterVec
+	errorsReceived    *counterVec
+	rateLimited       *counterVec
+}
+
+// newMetrics returns a new metrics pointer.
+func newMetrics() *metrics {
+	return &metrics{
+		packetsDropped:    newCounterVec(),
+		queriesSent:       newCounterVec(),
+		queriesReceived:   newCounterVec(),
+		responsesReceived: newCounterVec(),
+		errorsReceived:    newCounterVec(),
+		rateLimited:       newCounterVec(),
+	}
+}
+
+// Metrics is a snapshot of the counters and gauges of a dht.
+type Metrics struct {
+	// PacketsReceived is how many packets are read from the connection.
+	PacketsReceived uint64
+	// PacketsDropped is how many packets are dropped, by reason: "queue"
+	// when the packets queue is full, "workers" when all the packet workers
+	// are busy.
+	PacketsDropped map[string]uint64
+	// QueriesSent, QueriesReceived are keyed by query type, the unknown
+	// types are counted as "other".
+	QueriesSent     map[string]uint64
+	QueriesReceived map[string]uint64
+	// ResponsesReceived, ErrorsReceived are keyed by the type of the query
+	// answered.
+	ResponsesReceived map[string]uint64
+	ErrorsReceived    map[string]uint64
+	// TransactionsInFlight is how many queries are waiting for answers.
+	TransactionsInFlight int
+	// TransactionsTimedOut is how many queries get no answer after all
+	// the tries.
+	TransactionsTimedOut uint64
+	// RoutingTableNodes, RoutingTableBuckets are the sums of all the
+	// routing tables.
+	RoutingTableNodes   int
+	RoutingTableBuckets int
+	BlackListSize       int
+	TokensIssued        uint64
+	// TokenCheckFailures is how many announce_peer and put queries carry
+	// an invalid token.
+	TokenCheckFailures uint64
+	// EventsDropped is how many events are dropped because the subscribers
+	// don't keep up, see Subscribe.
+	EventsDropped uint64
+	// RateLimited is how many packets and queries are dropped by the rate
+	// limits, keyed by "packet" for IPRateLimit and query type for
+	// QueryRateLimit.
+	RateLimited map[string]uint64
+	// RateLimitBlocked is how many ips are blacklisted for exceeding the
+	// rate limits RateLimitStrikes times.
+	RateLimitBlocked uint64
+	// OutboundDelayed is how many queries wait for OutboundRateLimit.
+	OutboundDelayed uint64
+	// Blocklists is how many packets and nodes each Blocklist blocks in the
+	// dht, keyed by its name, see AddBlocklist.
+	Blocklists map[string]uint64
+}
+
+// Metrics returns a snapshot of the counters and gauges of the dht.
+func (dht *DHT) Metrics() Metrics {
+	m := dht.metrics
+	snapshot := Metrics{
+		PacketsReceived:      atomic.LoadUint64(&m.packetsReceived),
+		PacketsDropped:       m.packetsDropped.snapshot(),
+		QueriesSent:          m.queriesSent.snapshot(),
+		QueriesReceived:      m.queriesReceived.snapshot(),
+		ResponsesReceived:    m.responsesReceived.snapshot(),
+		ErrorsReceived:       m.errorsReceived.snapshot(),
+		TransactionsTimedOut: atomic.LoadUint64(&m.transactionsTimedOut),
+		BlackListSize:        dht.blackList.Len(),
+		TokensIssued:         atomic.LoadUint64(&m.tokensIssued),
+		TokenCheckFailures:   atomic.LoadUint64(&m.tokenCheckFailures),
+		EventsDropped:        atomic.LoadUint64(&dht.events.dropped),
+		RateLimited:          m.rateLimited.snapshot(),
+		RateLimitBlocked:     atomic.LoadUint64(&m.rateLimitBlocked),
+		OutboundDelayed:      atomic.LoadUint64(&m.outboundDelayed),
+		Blocklists:           dht.blackList.listStats(),
+	}
+
+	// 没有启动过时路由表等还没有创建
+	if dht.transactionManager != nil {
+		snapshot.TransactionsInFlight = dht.transactionManager.len()
+	}
+	if dht.routingTable != nil {
+		for _, rt := range dht.tables() {
+			snapshot.RoutingTableNodes += rt.Len()
+			snapshot.RoutingTableBuckets += rt.cachedKBuckets.Len()
+		}
+	}
+	return snapshot
+}
+
+// metricsWriter writes the metrics in the Prometheus text format, the first
+// error is kept and the later writes are skipped.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// metric writes the help and type lines of name.
+func (mw *metricsWriter) metric(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// value writes a sample of name without labels.
+func (mw *metricsWriter) value(name, typ, help string, v interface{}) {
+	mw.metric(name, typ, help)
+	mw.printf("%s %v\n", name, v)
+}
+
+// vec writes the samples of name keyed by label, sorted by label value.
+func (mw *metricsWriter) vec(name, help, label string, counters map[string]uint64) {
+	mw.metric(name, "counter", help)
+
+	values := make([]string, 0, len(counters))
+	for v := range counters {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		mw.printf("%s{%s=%q} %d\n", name, label, v, counters[v])
+	}
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+// WritePrometheus writes m in the Prometheus text exposition format.
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.value("dht_packets_received_total", "counter",
+		"Packets read from the connection.", m.PacketsReceived)
+	mw.vec("dht_packets_dropped_total",
+		"Packets dropped because the queue is full or the workers are busy.",
+		"reason", m.PacketsDropped)
+	mw.vec("dht_queries_sent_total", "Queries sent by type.", "type",
+		m.QueriesSent)
+	mw.vec("dht_queries_received_total", "Queries received by type.", "type",
+		m.QueriesReceived)
+	mw.vec("dht_responses_received_total",
+		"Responses received by the type of the query.", "type",
+		m.ResponsesReceived)
+	mw.vec("dht_errors_received_total",
+		"Errors received by the type of the query.", "type",
+		m.ErrorsReceived)
+	mw.value("dht_transactions_in_flight", "gauge",
+		"Queries waiting for answers.", m.TransactionsInFlight)
+	mw.value("dht_transactions_timed_out_total", "counter",
+		"Queries without answer after all the tries.", m.TransactionsTimedOut)
+	mw.value("dht_routing_table_nodes", "gauge",
+		"Nodes in the routing tables.", m.RoutingTableNodes)
+	mw.value("dht_routing_table_buckets", "gauge",
+		"Buckets in the routing tables.", m.RoutingTableBuckets)
+	mw.value("dht_blacklist_size", "gauge",
+		"Items in the blacklist.", m.BlackListSize)
+	mw.value("dht_tokens_issued_total", "counter",
+		"Tokens given in get_peers and get responses.", m.TokensIssued)
+	mw.value("dht_token_check_failures_total", "counter",
+		"Queries carrying an invalid token.", m.TokenCheckFailures)
+	mw.value("dht_events_dropped_total", "counter",
+		"Events dropped because the subscribers don't keep up.", m.EventsDropped)
+	mw.vec("dht_rate_limited_total",
+		"Packets and queries dropped by the rate limits.", "limit",
+		m.RateLimited)
+	mw.value("dht_rate_limit_blocked_total", "counter",
+		"IPs blacklisted for exceeding the rate limits.", m.RateLimitBlocked)
+	mw.value("dht_outbound_queries_delayed_total", "counter",
+		"Queries waiting for the outbound budget.", m.OutboundDelayed)
+	mw.vec("dht_blocklist_blocked_total",
+		"Packets and nodes blocked by each blocklist.", "list", m.Blocklists)
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+// WireMetrics is a snapshot of the counters of a Wire.
+type WireMetrics struct {
+	// MetadataFetched is how many metadata are downloaded and verified.
+	MetadataFetched uint64
+	// MetadataFailed is how many fetches end without the metadata.
+	MetadataFailed uint64
+	// Blocklists is how many peers each Blocklist blocks in the wire, keyed
+	// by its name, see AddBlocklist.
+	Blocklists map[string]uint64
+}
+
+// Metrics returns a snapshot of the counters of the wire.
+func (wire *Wire) Metrics() WireMetrics {
+	return WireMetrics{
+		MetadataFetched: atomic.LoadUint64(&wire.metadataFetched),
+		MetadataFailed:  atomic.LoadUint64(&wire.metadataFailed),
+		Blocklists:      wire.blackList.listStats(),
+	}
+}
+
+// WritePrometheus writes m in the Prometheus text exposition format.
+func (m WireMetrics) WritePrometheus(w io.Writer) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.value("dht_wire_metadata_fetched_total", "counter",
+		"Metadata downloaded and verified.", m.MetadataFetched)
+	mw.value("dht_wire_metadata_failed_total", "counter",
+		"Metadata fetches which fail.", m.MetadataFailed)
+	mw.vec("dht_wire_blocklist_blocked_total",
+		"Peers blocked by each blocklist.", "list", m.Blocklists)
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+/*
+MetricsHandler returns a http handler serving the metrics of dht and wire
+in the Prometheus text exposition format, either of them can be nil.
+*/
+func MetricsHandler(dht *DHT, wire *Wire) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if dht != nil {
+			if err := dht.Metrics().WritePrometheus(w); err != nil {
+				return
+			}
+		}
+		if wire != nil {
+			wire.Metrics().WritePrometheus(w)
+		}
+	})
+}
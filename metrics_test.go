@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	nodes := startTestChain(t, 2)
+	for _, d := range nodes {
+		defer d.Stop()
+	}
+	a, b := nodes[0], nodes[1]
+	addr := b.Addr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := a.FindNode(ctx, b.NodeID()); err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash := randomString(20)
+	resp := simQuery(a, addr, getPeersType, map[string]interface{}{
+		"id": a.node.id.RawString(), "info_hash": infoHash})
+	if resp == nil || resp["y"] != "r" {
+		t.Fatal(resp)
+	}
+	resp = simQuery(a, addr, announcePeerType, map[string]interface{}{
+		"id": a.node.id.RawString(), "info_hash": infoHash, "port": 6881,
+		"token": "invalid"})
+	if resp == nil || resp["y"] != "e" {
+		t.Fatal(resp)
+	}
+
+	ma, mb := a.Metrics(), b.Metrics()
+	if ma.QueriesSent[findNodeType] == 0 || ma.ResponsesReceived[findNodeType] == 0 ||
+		mb.QueriesReceived[findNodeType] == 0 {
+		t.Error("find_node", ma.QueriesSent, ma.ResponsesReceived, mb.QueriesReceived)
+	}
+	if ma.ErrorsReceived[announcePeerType] != 1 {
+		t.Error("errors", ma.ErrorsReceived)
+	}
+	if mb.TokensIssued == 0 || mb.TokenCheckFailures != 1 {
+		t.Error("tokens", mb.TokensIssued, mb.TokenCheckFailures)
+	}
+	if ma.PacketsReceived == 0 || ma.RoutingTableNodes == 0 ||
+		ma.RoutingTableBuckets == 0 {
+		t.Error(ma)
+	}
+
+	// 未知的查询类型都算作 other
+	b.metrics.queriesReceived.inc(metricQueryType("made_up"))
+	if b.Metrics().QueriesReceived[otherQueryType] != 1 {
+		t.Error("other", b.Metrics().QueriesReceived)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(a, NewWire(16, 16, 16)).ServeHTTP(rec,
+		httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE dht_packets_received_total counter\n",
+		`dht_errors_received_total{type="announce_peer"} 1` + "\n",
+		"# TYPE dht_routing_table_nodes gauge\n",
+		"dht_wire_metadata_failed_total 0\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("%q is not in\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestMetricsDropped(t *testing.T) {
+	d := New(newTestConfig())
+	if m := d.Metrics(); m.RoutingTableNodes != 0 || m.TransactionsInFlight != 0 {
+		t.Error("not started", m)
+	}
+
+	for i := 0; i < d.PacketWorkerLimit; i++ {
+		d.workerTokens <- struct{}{}
+	}
+	handle(d, packet{[]byte("de"), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}})
+	if n := d.Metrics().PacketsDropped[dropWorkers]; n != 1 {
+		t.Error("dropped", n)
+	}
+}
+
+func TestWireMetrics(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	wire := NewWire(16, 16, 16)
+	wire.fetchMetadata(Request{
+		InfoHash: []byte(randomString(20)), IP: "127.0.0.1", Port: port})
+	if m := wire.Metrics(); m.MetadataFailed != 1 || m.MetadataFetched != 0 {
+		t.Error(m)
+	}
+}
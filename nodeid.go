@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+NodeID is the 20-byte id of a dht node. 节点id全球唯一，重启后保持不变，
+其他节点路由表中我们的位置才不会丢失
+*/
+type NodeID [20]byte
+
+// RandomNodeID returns a random node id.
+func RandomNodeID() (id NodeID) {
+	copy(id[:], randomString(20))
+	return
+}
+
+/*
+ParseNodeID parses s as a node id. s is either the 40-length hex string or
+the 20-length raw string, otherwise a *NodeIDError is returned.
+*/
+func ParseNodeID(s string) (id NodeID, err error) {
+	switch len(s) {
+	case 40:
+		data, e := hex.DecodeString(s)
+		if e != nil {
+			err = &NodeIDError{s, "invalid hex string"}
+			return
+		}
+		copy(id[:], data)
+	case 20:
+		copy(id[:], s)
+	default:
+		err = &NodeIDError{s, "should be a 20-length raw or 40-length hex string"}
+	}
+	return
+}
+
+// String returns the hex string of id.
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// RawString returns the 20-length raw string of id.
+func (id NodeID) RawString() string {
+	return string(id[:])
+}
+
+// LoadNodeID reads the node id saved by NodeID.Save from file.
+func LoadNodeID(file string) (NodeID, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return NodeID{}, err
+	}
+	return ParseNodeID(strings.TrimSpace(string(data)))
+}
+
+// Save writes id to file in hex, the directories are created if needed.
+func (id NodeID) Save(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// 先写临时文件再改名，避免写一半的文件
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(id.String()+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+/*
+nodeID returns the node id of config:
+1、LocalNodeId is used when it is set
+2、otherwise it is loaded from NodeIDFile
+3、otherwise a new id is generated
+With SecureNodeID, a loaded id which is not BEP 42 compliant for PublicIp is
+replaced by a new one, and a forced one is an error.
+The id is saved to NodeIDFile when it is set, so it survives restarts.
+*/
+func (config *Config) nodeID() (id NodeID, err error) {
+	publicIP := net.ParseIP(config.PublicIp)
+	secure := config.SecureNodeID
+
+	switch {
+	case config.LocalNodeId != "":
+		if id, err = ParseNodeID(config.LocalNodeId); err != nil {
+			return
+		}
+		if secure && !IsSecureNodeID(id, publicIP) {
+			return id, &ConfigError{"LocalNodeId",
+				"should be BEP 42 compliant for PublicIp with SecureNodeID"}
+		}
+	case config.NodeIDFile != "":
+		id, err = LoadNodeID(config.NodeIDFile)
+		if err == nil && (!secure || IsSecureNodeID(id, publicIP)) {
+			return
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		id = config.newNodeID(publicIP, secure)
+	default:
+		return config.newNodeID(publicIP, secure), nil
+	}
+
+	if config.NodeIDFile != "" {
+		err = id.Save(config.NodeIDFile)
+	}
+	return
+}
+
+// newNodeID generates a node id, BEP 42 compliant for publicIP if secure.
+func (config *Config) newNodeID(publicIP net.IP, secure bool) NodeID {
+	if secure {
+		return SecureNodeID(publicIP)
+	}
+	return RandomNodeID()
+}
+
+// WithNodeID forces the node id.
+func WithNodeID(id NodeID) Option {
+	return func(config *Config) {
+		config.LocalNodeId = id.String()
+	}
+}
+
+// WithNodeIDFile sets the file the node id is loaded from and saved to.
+func WithNodeIDFile(file string) Option {
+	return func(config *Config) {
+		config.NodeIDFile = file
+	}
+}
@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNodeID(t *testing.T) {
+	hexID := strings.Repeat("0a", 20)
+
+	id, err := ParseNodeID(hexID)
+	if err != nil || id.String() != hexID {
+		t.Error(id, err)
+	}
+
+	raw, err := ParseNodeID(id.RawString())
+	if err != nil || raw != id {
+		t.Error(raw, err)
+	}
+
+	for _, s := range []string{"", "abc", strings.Repeat("zz", 20)} {
+		if _, err := ParseNodeID(s); err == nil {
+			t.Error(s)
+		} else if _, ok := err.(*NodeIDError); !ok {
+			t.Error(err)
+		}
+	}
+}
+
+func TestNodeIDFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state", "node_id")
+	config := newTestConfig().With(WithNodeIDFile(file))
+
+	d1, err := NewDHT(config.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d2, err := NewDHT(config.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d1.NodeID() != d2.NodeID() {
+		t.Error(d1.NodeID(), d2.NodeID())
+	}
+
+	if id, err := LoadNodeID(file); err != nil || id != d1.NodeID() {
+		t.Error(id, err)
+	}
+
+	// a forced id replaces the saved one
+	forced := RandomNodeID()
+	d3, err := NewDHT(config.With(WithNodeID(forced)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d3.NodeID() != forced || d3.LocalNodeId != forced.String() {
+		t.Error(d3.NodeID(), forced)
+	}
+
+	if id, _ := LoadNodeID(file); id != forced {
+		t.Error(id, forced)
+	}
+}
+
+func TestInvalidNodeID(t *testing.T) {
+	config := newTestConfig()
+	config.LocalNodeId = "abc"
+
+	if err := config.Validate(); err == nil ||
+		!err.(ConfigErrors).Has("LocalNodeId") {
+		t.Error(err)
+	}
+}
+
+func TestSecureNodeIDConfig(t *testing.T) {
+	// 没有 PublicIp 时报错，不退回随机id
+	config := newTestConfig().With(WithSecureNodeID())
+	if _, err := NewDHT(config.Clone()); err == nil ||
+		!err.(ConfigErrors).Has("PublicIp") {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("124.31.75.21")
+	config.PublicIp = ip.String()
+	d, err := NewDHT(config.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSecureNodeID(d.NodeID(), ip) {
+		t.Error("insecure", d.NodeID())
+	}
+
+	// a forced id must be compliant
+	forced := RandomNodeID()
+	for IsSecureNodeID(forced, ip) {
+		forced = RandomNodeID()
+	}
+	_, err = NewDHT(config.With(WithNodeID(forced)))
+	if e, ok := err.(*ConfigError); !ok || e.Field != "LocalNodeId" {
+		t.Error(err)
+	}
+
+	// 学到的ip和id不符时记日志
+	var logs bytes.Buffer
+	d.Config.Log = log.New(&logs, "", 0)
+	d.setPublicIP("21.75.31.124")
+	if !strings.Contains(logs.String(), "not BEP 42 compliant") {
+		t.Error(logs.String())
+	}
+}
+
+func TestNodeIDSharedConfig(t *testing.T) {
+	// 同一个 config 建两个节点，id 不同，config 不变
+	config := newTestConfig()
+	d1, err := NewDHT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewDHT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d1.NodeID() == d2.NodeID() {
+		t.Error("same id", d1.NodeID())
+	}
+	if config.LocalNodeId != "" {
+		t.Error(config.LocalNodeId)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -160,6 +161,10 @@ type Response struct {
 
 // Wire represents the wire protocol.
 type Wire struct {
+	// the counters of Metrics, first to be 64-bit aligned for atomic
+	metadataFetched uint64
+	metadataFailed  uint64
+
 	blackList    *blackList
 	queue        *syncedMap
 	requests     chan Request
@@ -233,11 +238,17 @@ func (wire *Wire) fetchMetadata(r Request) {
 		pieces       [][]byte
 		utMetadata   int
 		metadataSize int
+		fetched      bool
 	)
 
 	defer func() {
 		pieces = nil
 		recover()
+		if fetched {
+			atomic.AddUint64(&wire.metadataFetched, 1)
+		} else {
+			atomic.AddUint64(&wire.metadataFailed, 1)
+		}
 	}()
 
 	infoHash := r.InfoHash
@@ -347,6 +358,7 @@ func (wire *Wire) fetchMetadata(r Request) {
 				if !bytes.Equal(infoHash, info[:]) {
 					return
 				}
+				fetched = true
 
 				wire.responses <- Response{
 					Request:      r,
@@ -362,7 +374,7 @@ func (wire *Wire) fetchMetadata(r Request) {
 
 // Run starts the peer wire protocol.
 func (wire *Wire) Run() {
-	go wire.blackList.clear()
+	go wire.blackList.clear(nil)
 
 	for r := range wire.requests {
 		wire.workerTokens <- struct{}{}
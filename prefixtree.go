@@ -0,0 +1,288 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+)
+
+/*
+prefixTree 是按位分支的前缀树（radix 2），ipv4 和 ipv6 各一棵，查询一个ip最多
+走32或128步，和前缀的数量无关。The ipv4-mapped ipv6 addresses are looked up
+as ipv4.
+*/
+
+// errInvalidPrefix is returned when a blacklist entry can't be parsed.
+var errInvalidPrefix = errors.New("should be an ip, a CIDR or a `start-end` ip range")
+
+// prefixNode is a node of prefixTree, set tells whether it ends a prefix.
+type prefixNode struct {
+	children [2]*prefixNode
+	value    interface{}
+	set      bool
+}
+
+// prefixTree maps the ip prefixes to values, and finds the longest prefix
+// of an ip.
+type prefixTree struct {
+	sync.RWMutex
+	v4, v6 *prefixNode
+	size   int
+}
+
+// newPrefixTree returns a new prefixTree pointer.
+func newPrefixTree() *prefixTree {
+	return &prefixTree{v4: &prefixNode{}, v6: &prefixNode{}}
+}
+
+// root returns the root and the bits of ip, ip is nil when it's invalid.
+// t must be locked.
+func (t *prefixTree) root(ip net.IP) (*prefixNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, ip4
+	}
+	if len(ip) == net.IPv6len {
+		return t.v6, ip
+	}
+	return nil, nil
+}
+
+/*
+prefixRoot is root for a prefix, and returns how many bits of ip it has. An
+ipv4-mapped ipv6 prefix like ::ffff:10.0.0.0/104 goes to the ipv4 tree, its
+length is 96 bits shorter there. t must be locked.
+*/
+func (t *prefixTree) prefixRoot(prefix *net.IPNet) (*prefixNode, net.IP, int) {
+	ones, bits := prefix.Mask.Size()
+	no, ip := t.root(prefix.IP)
+	if no == nil {
+		return nil, nil, 0
+	}
+	if ones -= bits - len(ip)*8; ones < 0 {
+		ones = 0
+	}
+	return no, ip, ones
+}
+
+// bit returns the i-th bit of ip.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insert maps prefix to value, the old value of prefix is replaced.
+func (t *prefixTree) insert(prefix *net.IPNet, value interface{}) {
+	t.Lock()
+	defer t.Unlock()
+
+	no, ip, ones := t.prefixRoot(prefix)
+	if no == nil {
+		return
+	}
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if no.children[b] == nil {
+			no.children[b] = &prefixNode{}
+		}
+		no = no.children[b]
+	}
+	if !no.set {
+		t.size++
+	}
+	no.value, no.set = value, true
+}
+
+// delete removes prefix, it returns whether prefix is in t.
+func (t *prefixTree) delete(prefix *net.IPNet) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	no, ip, ones := t.prefixRoot(prefix)
+	if no == nil {
+		return false
+	}
+	// 记下路径，删除后回收空的分支
+	path := make([]*prefixNode, 0, ones+1)
+	for i := 0; i < ones && no != nil; i++ {
+		path = append(path, no)
+		no = no.children[bit(ip, i)]
+	}
+	if no == nil || !no.set {
+		return false
+	}
+	no.value, no.set = nil, false
+	t.size--
+
+	for i := len(path) - 1; i >= 0; i-- {
+		if no.set || no.children[0] != nil || no.children[1] != nil {
+			break
+		}
+		path[i].children[bit(ip, i)] = nil
+		no = path[i]
+	}
+	return true
+}
+
+// lookup returns the value of the longest prefix containing ip.
+func (t *prefixTree) lookup(ip net.IP) (value interface{}, ok bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	no, ip := t.root(ip)
+	for i := 0; no != nil; i++ {
+		if no.set {
+			value, ok = no.value, true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		no = no.children[bit(ip, i)]
+	}
+	return
+}
+
+// Len returns how many prefixes are in t.
+func (t *prefixTree) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.size
+}
+
+// clear removes all the prefixes.
+func (t *prefixTree) clear() {
+	t.Lock()
+	defer t.Unlock()
+	t.v4, t.v6, t.size = &prefixNode{}, &prefixNode{}, 0
+}
+
+// hostPrefix returns the prefix of ip alone, eg 1.2.3.4/32.
+func hostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+/*
+rangePrefixes returns the fewest prefixes covering the ips from start to end,
+eg 1.2.3.1-1.2.3.6 is 1.2.3.1/32, 1.2.3.2/31, 1.2.3.4/31 and 1.2.3.6/32.
+*/
+func rangePrefixes(start, end net.IP) ([]*net.IPNet, error) {
+	size := net.IPv6len
+	if start.To4() != nil && end.To4() != nil {
+		size = net.IPv4len
+	} else if start.To4() != nil || end.To4() != nil {
+		return nil, errInvalidPrefix
+	}
+	bits := size * 8
+
+	from := new(big.Int).SetBytes(start.To16()[net.IPv6len-size:])
+	to := new(big.Int).SetBytes(end.To16()[net.IPv6len-size:])
+	if from.Cmp(to) > 0 {
+		return nil, errInvalidPrefix
+	}
+
+	var prefixes []*net.IPNet
+	one, last := big.NewInt(1), new(big.Int)
+	for from.Cmp(to) <= 0 {
+		// from 对齐的最大的块，且不超过 to
+		n := int(from.TrailingZeroBits())
+		if from.Sign() == 0 || n > bits {
+			n = bits
+		}
+		for ; n > 0; n-- {
+			last.Lsh(one, uint(n)).Add(last, from).Sub(last, one)
+			if last.Cmp(to) <= 0 {
+				break
+			}
+		}
+
+		ip := make(net.IP, size)
+		from.FillBytes(ip)
+		prefixes = append(prefixes, &net.IPNet{IP: ip,
+			Mask: net.CIDRMask(bits-n, bits)})
+		from.Add(from, new(big.Int).Lsh(one, uint(n)))
+	}
+	return prefixes, nil
+}
+
+// parsePrefixes parses an ip, a CIDR or a `start-end` ip range.
+func parsePrefixes(s string) ([]*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		start := net.ParseIP(strings.TrimSpace(s[:i]))
+		end := net.ParseIP(strings.TrimSpace(s[i+1:]))
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("%q %w", s, errInvalidPrefix)
+		}
+		prefixes, err := rangePrefixes(start, end)
+		if err != nil {
+			return nil, fmt.Errorf("%q %w", s, err)
+		}
+		return prefixes, nil
+	}
+
+	if strings.Contains(s, "/") {
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q %w", s, errInvalidPrefix)
+		}
+		return []*net.IPNet{prefix}, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q %w", s, errInvalidPrefix)
+	}
+	return []*net.IPNet{hostPrefix(ip)}, nil
+}
+
+/*
+bogons are the ranges never routed on the internet: private, loopback,
+link-local, shared, documentation, benchmarking, multicast and reserved,
+see RFC 6890. Config.BlockBogons keeps the nodes advertising them out of the
+routing table, the packets from them are still handled.
+*/
+var bogons = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// newBogonTree returns a prefixTree of the bogons.
+func newBogonTree() *prefixTree {
+	tree := newPrefixTree()
+	for _, prefix := range bogonPrefixes() {
+		tree.insert(prefix, nil)
+	}
+	return tree
+}
+
+// bogonPrefixes returns the parsed bogons.
+func bogonPrefixes() []*net.IPNet {
+	prefixes := make([]*net.IPNet, len(bogons))
+	for i, s := range bogons {
+		_, prefixes[i], _ = net.ParseCIDR(s)
+	}
+	return prefixes
+}
@@ -0,0 +1,158 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func mustPrefix(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+func TestPrefixTree(t *testing.T) {
+	tree := newPrefixTree()
+	tree.insert(mustPrefix(t, "10.0.0.0/8"), "a")
+	tree.insert(mustPrefix(t, "10.1.0.0/16"), "b")
+	tree.insert(mustPrefix(t, "2001:db8::/32"), "c")
+	tree.insert(mustPrefix(t, "0.0.0.0/0"), "d")
+	tree.insert(mustPrefix(t, "10.1.0.0/16"), "e")
+	if tree.Len() != 4 {
+		t.Error("len", tree.Len())
+	}
+
+	cases := []struct {
+		ip    string
+		value interface{}
+	}{
+		{"10.2.3.4", "a"},
+		{"10.1.3.4", "e"},
+		{"::ffff:10.1.3.4", "e"},
+		{"2001:db8::1", "c"},
+		{"8.8.8.8", "d"},
+		{"2001:db9::1", nil},
+	}
+	for _, c := range cases {
+		value, ok := tree.lookup(net.ParseIP(c.ip))
+		if value != c.value || ok != (c.value != nil) {
+			t.Error(c.ip, value, ok)
+		}
+	}
+	if _, ok := tree.lookup(nil); ok {
+		t.Error("nil ip")
+	}
+
+	if !tree.delete(mustPrefix(t, "10.1.0.0/16")) ||
+		tree.delete(mustPrefix(t, "10.1.0.0/16")) ||
+		tree.delete(mustPrefix(t, "10.2.0.0/16")) {
+		t.Error("delete")
+	}
+	if value, _ := tree.lookup(net.ParseIP("10.1.3.4")); value != "a" {
+		t.Error("deleted", value)
+	}
+	// 空的分支被回收
+	if tree.v4.children[0].children[0].children[0].children[0].
+		children[1].children[0].children[1].children[0].children[0] != nil {
+		t.Error("branch is kept")
+	}
+
+	tree.clear()
+	if _, ok := tree.lookup(net.ParseIP("8.8.8.8")); ok || tree.Len() != 0 {
+		t.Error("clear")
+	}
+}
+
+func TestPrefixTreeMapped(t *testing.T) {
+	tree := newPrefixTree()
+	tree.insert(mustPrefix(t, "::ffff:10.0.0.0/104"), "a")
+	tree.insert(mustPrefix(t, "::ffff:0:0/96"), "b")
+	for ip, value := range map[string]interface{}{
+		"10.1.2.3":        "a",
+		"::ffff:10.1.2.3": "a",
+		"11.1.2.3":        "b",
+		"::1":             nil,
+	} {
+		if v, _ := tree.lookup(net.ParseIP(ip)); v != value {
+			t.Error(ip, v)
+		}
+	}
+	if !tree.delete(mustPrefix(t, "::ffff:10.0.0.0/104")) ||
+		!tree.delete(mustPrefix(t, "0.0.0.0/0")) || tree.Len() != 0 {
+		t.Error("delete", tree.Len())
+	}
+
+	// 配置里的 ipv4-mapped CIDR
+	d, err := NewDHT(newTestConfig().With(
+		WithBlockedIPs("::ffff:10.0.0.0/104")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.blackList.in("10.1.2.3", 1) || d.blackList.in("11.1.2.3", 1) {
+		t.Error("mapped CIDR isn't blocked")
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []string
+	}{
+		{"1.2.3.4", []string{"1.2.3.4/32"}},
+		{" 10.1.2.3/8 ", []string{"10.0.0.0/8"}},
+		{"::1", []string{"::1/128"}},
+		{"1.2.3.1 - 1.2.3.6", []string{
+			"1.2.3.1/32", "1.2.3.2/31", "1.2.3.4/31", "1.2.3.6/32"}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"1.2.3.0-1.2.4.255", []string{"1.2.3.0/24", "1.2.4.0/24"}},
+		{"fe80::-fe80::3", []string{"fe80::/126"}},
+	}
+	for _, c := range cases {
+		prefixes, err := parsePrefixes(c.in)
+		if err != nil {
+			t.Error(c.in, err)
+			continue
+		}
+		var out []string
+		for _, prefix := range prefixes {
+			out = append(out, prefix.String())
+		}
+		if len(out) != len(c.out) {
+			t.Error(c.in, out)
+			continue
+		}
+		for i := range out {
+			if out[i] != c.out[i] {
+				t.Error(c.in, out)
+			}
+		}
+	}
+
+	for _, in := range []string{"", "1.2.3", "1.2.3.4/33", "1.2.3.9-1.2.3.1",
+		"1.2.3.4-::1", "1.2.3.4-x"} {
+		if _, err := parsePrefixes(in); err == nil {
+			t.Error(in)
+		}
+	}
+}
+
+func TestBogons(t *testing.T) {
+	tree := newBogonTree()
+	if tree.Len() != len(bogons) {
+		t.Error("len", tree.Len())
+	}
+	for _, ip := range []string{"10.1.2.3", "192.168.1.1", "127.0.0.1",
+		"224.0.0.1", "255.255.255.255", "::1", "fe80::1", "fd00::1"} {
+		if _, ok := tree.lookup(net.ParseIP(ip)); !ok {
+			t.Error(ip)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "1.1.1.1", "2001:4860::8888"} {
+		if _, ok := tree.lookup(net.ParseIP(ip)); ok {
+			t.Error(ip)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNoPublicIP is the error when a PublicIPResolver finds no public ip.
+var ErrNoPublicIP = errors.New("public ip not found")
+
+/*
+PublicIPResolver discovers the public ip of this host, and the port mapped
+by NAT when it knows, otherwise port is 0.
+Config 默认不设置，创建配置时不做任何网络请求，需要时显式调用
+Config.ResolvePublicIP
+*/
+type PublicIPResolver interface {
+	PublicIP(ctx context.Context) (ip string, port int, err error)
+}
+
+// StaticResolver returns the fixed IP and Port, it does no network I/O.
+type StaticResolver struct {
+	IP   string
+	Port int
+}
+
+// PublicIP returns r.IP and r.Port.
+func (r StaticResolver) PublicIP(ctx context.Context) (string, int, error) {
+	if net.ParseIP(r.IP) == nil {
+		return "", 0, ErrNoPublicIP
+	}
+	return r.IP, r.Port, nil
+}
+
+/*
+HTTPResolver gets the public ip from a http service which answers the ip
+in plain text, like
+curl -H 'User-Agent:curl' http://ifconfig.me
+缺点不通互联网的时候不准确，切换vpn的时候需要重新获取
+*/
+type HTTPResolver struct {
+	// URL defaults to http://ifconfig.me
+	URL string
+	// Client defaults to a client with 30 seconds timeout
+	Client *http.Client
+}
+
+// PublicIP requests r.URL and parses the body as an ip.
+func (r HTTPResolver) PublicIP(ctx context.Context) (string, int, error) {
+	url, client := r.URL, r.Client
+	if url == "" {
+		url = "http://ifconfig.me"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: time.Second * 30}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Set("User-Agent", "curl")
+	req.Header.Set("Cache-Control", "no-cache")
+	res, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", 0, err
+	}
+
+	ip := strings.TrimSpace(string(data))
+	if net.ParseIP(ip) == nil {
+		return "", 0, ErrNoPublicIP
+	}
+	return ip, 0, nil
+}
+
+/*
+ResolvePublicIP discovers the public ip by config.PublicIPResolver and
+stores it in config.PublicIp. The port mapped by NAT is returned as well,
+Address is left alone.
+*/
+func (config *Config) ResolvePublicIP(ctx context.Context) (
+	ip string, port int, err error) {
+
+	if config.PublicIPResolver == nil {
+		return "", 0, &ConfigError{"PublicIPResolver", "is not set"}
+	}
+
+	if ip, port, err = config.PublicIPResolver.PublicIP(ctx); err != nil {
+		return
+	}
+
+	config.PublicIp = ip
+	if nil != config.Log {
+		config.Log.Println("your public IP is ", ip, " port ", port)
+	}
+	return
+}
+
+// WithPublicIPResolver sets the resolver used by ResolvePublicIP and to
+// detect the change of the public ip while running.
+func WithPublicIPResolver(r PublicIPResolver) Option {
+	return func(config *Config) {
+		config.PublicIPResolver = r
+	}
+}
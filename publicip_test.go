@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+func TestNewStandardConfigOffline(t *testing.T) {
+	config := NewStandardConfig(WithLogger(nil))
+	if config.Address != ":0" || config.PublicIp != "" ||
+		config.PublicIPResolver != nil {
+		t.Error(config.Address, config.PublicIp)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	config := newTestConfig()
+	if _, _, err := config.ResolvePublicIP(context.Background()); err == nil {
+		t.Fail()
+	}
+
+	config = config.With(WithPublicIPResolver(StaticResolver{"1.2.3.4", 6881}))
+	ip, port, err := config.ResolvePublicIP(context.Background())
+	if err != nil || ip != "1.2.3.4" || port != 6881 ||
+		config.PublicIp != "1.2.3.4" {
+		t.Error(ip, port, err)
+	}
+
+	if _, _, err := (StaticResolver{}).PublicIP(context.Background()); err != ErrNoPublicIP {
+		t.Error(err)
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "5.6.7.8")
+		}))
+	defer server.Close()
+
+	ip, port, err := HTTPResolver{URL: server.URL}.PublicIP(context.Background())
+	if err != nil || ip != "5.6.7.8" || port != 0 {
+		t.Error(ip, port, err)
+	}
+}
+
+// useStunServers makes StunList ask only addrs until the returned func is
+// called.
+func useStunServers(addrs ...string) (restore func()) {
+	mu.Lock()
+	saved := aStunLists
+	aStunLists = addrs
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		aStunLists = saved
+		mu.Unlock()
+	}
+}
+
+func TestStunList(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+			res := stun.MustBuild(req, stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: net.IPv4(1, 2, 3, 4), Port: 6881})
+			server.WriteTo(res.Raw, addr)
+		}
+	}()
+	defer useStunServers(server.LocalAddr().String())()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ip, port, err := (StunList{}).PublicIP(ctx)
+	if err != nil || ip != "1.2.3.4" || port != 6881 {
+		t.Error(ip, port, err)
+	}
+}
+
+func TestStunListCancel(t *testing.T) {
+	// 不回应的stun服务器
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	defer useStunServers(silent.LocalAddr().String())()
+
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond*100)
+	defer cancel()
+	if _, _, err := (StunList{}).PublicIP(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	// 查询的goroutine随ctx结束，服务器不算失败
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Error("goroutines are left", n, goroutines)
+	}
+	time.Sleep(time.Millisecond * 10)
+	mu.Lock()
+	n := len(aStunLists)
+	mu.Unlock()
+	if n != 1 {
+		t.Error("cancelled server is removed")
+	}
+}
@@ -0,0 +1,273 @@
+package dht
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+限流：handle 只用 workerTokens 限制了总的并发，一个ip发大量数据包就能占满所有
+worker。这里用令牌桶限制每个ip的数据包、每个ip每种查询的速率，以及全局发出的
+查询速率。An ip exceeding its limits RateLimitStrikes times before it goes
+idle for rateLimitIdle is blacklisted. The decisions are counted in Metrics.
+*/
+
+const (
+	// rateLimitIdle is how long an ip is kept after its last packet.
+	rateLimitIdle = time.Minute
+	// maxRateLimitedIPs is how many ips are tracked, the least recently
+	// seen ip is dropped for a new one when it's full.
+	maxRateLimitedIPs = 1 << 16
+	// limitPacket is the label of the packets limited in Metrics.
+	limitPacket = "packet"
+)
+
+// RateLimit is a token bucket: Rate tokens per second, at most Burst
+// tokens. Rate 0 means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// enabled returns whether rl limits anything.
+func (rl RateLimit) enabled() bool {
+	return rl.Rate > 0
+}
+
+// valid returns whether rl is no limit or a limit with a positive burst.
+func (rl RateLimit) valid() bool {
+	return rl.Rate == 0 || rl.Rate > 0 && rl.Burst > 0
+}
+
+// tokenBucket is the state of a RateLimit.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens since the last refill, a new bucket is full.
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst),
+			b.tokens+elapsed.Seconds()*limit.Rate)
+	}
+	b.last = now
+}
+
+// take takes a token at now, it returns false when there is none.
+func (b *tokenBucket) take(now time.Time, limit RateLimit) bool {
+	b.refill(now, limit)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token at now even if there is none, and returns how long
+// to wait until it's available.
+func (b *tokenBucket) reserve(now time.Time, limit RateLimit) time.Duration {
+	b.refill(now, limit)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / limit.Rate * float64(time.Second))
+}
+
+// ipLimits is the state of an ip in ipLimiter.
+type ipLimits struct {
+	ip      string
+	packets tokenBucket
+	queries map[string]*tokenBucket
+	// strikes is how many times the ip exceeds its limits
+	strikes int
+	last    time.Time
+	// elem is the place of the ip in ipLimiter.lru
+	elem *list.Element
+}
+
+// ipLimiter limits the packets and the queries of each ip.
+type ipLimiter struct {
+	sync.Mutex
+	packet, query RateLimit
+	// the ip is blocked after so many strikes, 0 means never
+	maxStrikes int
+	ips        map[string]*ipLimits
+	// lru is the ipLimits by the last time, the least recent is at the back
+	lru *list.List
+}
+
+// newIPLimiter returns a new ipLimiter pointer.
+func newIPLimiter(packet, query RateLimit, maxStrikes int) *ipLimiter {
+	return &ipLimiter{
+		packet:     packet,
+		query:      query,
+		maxStrikes: maxStrikes,
+		ips:        make(map[string]*ipLimits),
+		lru:        list.New(),
+	}
+}
+
+/*
+limits returns the state of ip. When too many ips are tracked, the least
+recently seen one is dropped, with its strikes. l must be locked.
+超过上限时丢掉最久没有数据包的ip，而不是不限制新的ip
+*/
+func (l *ipLimiter) limits(ip string, now time.Time) *ipLimits {
+	lim, ok := l.ips[ip]
+	if ok {
+		l.lru.MoveToFront(lim.elem)
+	} else {
+		if len(l.ips) >= maxRateLimitedIPs {
+			l.remove(l.lru.Back().Value.(*ipLimits))
+		}
+		lim = &ipLimits{ip: ip}
+		lim.elem = l.lru.PushFront(lim)
+		l.ips[ip] = lim
+	}
+	lim.last = now
+	return lim
+}
+
+// remove stops tracking lim. l must be locked.
+func (l *ipLimiter) remove(lim *ipLimits) {
+	l.lru.Remove(lim.elem)
+	delete(l.ips, lim.ip)
+}
+
+// strike records that the ip of lim exceeds its limits, and returns whether
+// it should be blocked. l must be locked.
+func (l *ipLimiter) strike(lim *ipLimits) (block bool) {
+	lim.strikes++
+	if l.maxStrikes > 0 && lim.strikes >= l.maxStrikes {
+		l.remove(lim)
+		return true
+	}
+	return false
+}
+
+// allowPacket returns whether a packet from ip is allowed at now, and
+// whether ip should be blocked.
+func (l *ipLimiter) allowPacket(ip string, now time.Time) (ok, block bool) {
+	if !l.packet.enabled() {
+		return true, false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	lim := l.limits(ip, now)
+	if lim.packets.take(now, l.packet) {
+		return true, false
+	}
+	return false, l.strike(lim)
+}
+
+/*
+allowQuery returns whether a query of type q from ip is allowed at now, and
+whether ip should be blocked. The unknown types share one bucket, or an ip
+could make the map grow with names of its own.
+*/
+func (l *ipLimiter) allowQuery(ip, q string, now time.Time) (ok, block bool) {
+	if !l.query.enabled() {
+		return true, false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	lim := l.limits(ip, now)
+	if lim.queries == nil {
+		lim.queries = make(map[string]*tokenBucket)
+	}
+	q = metricQueryType(q)
+	bucket, ok := lim.queries[q]
+	if !ok {
+		bucket = &tokenBucket{}
+		lim.queries[q] = bucket
+	}
+	if bucket.take(now, l.query) {
+		return true, false
+	}
+	return false, l.strike(lim)
+}
+
+// clean removes the ips idle for rateLimitIdle, their strikes are forgotten.
+func (l *ipLimiter) clean(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	// 从最久的开始，遇到不空闲的就停
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		lim := e.Value.(*ipLimits)
+		if now.Sub(lim.last) < rateLimitIdle {
+			break
+		}
+		l.remove(lim)
+	}
+}
+
+// outboundLimiter is the budget of the queries sent by the dht.
+type outboundLimiter struct {
+	sync.Mutex
+	limit  RateLimit
+	bucket tokenBucket
+}
+
+// wait returns how long a query sent at now should wait for the budget.
+func (l *outboundLimiter) wait(now time.Time) time.Duration {
+	if !l.limit.enabled() {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return l.bucket.reserve(now, l.limit)
+}
+
+// rateLimited counts a limited packet or query, and blacklists addr.IP when
+// block is set.
+func (dht *DHT) rateLimited(addr *net.UDPAddr, label string, block bool) {
+	dht.metrics.rateLimited.inc(label)
+	if block {
+		atomic.AddUint64(&dht.metrics.rateLimitBlocked, 1)
+		dht.blackList.insert(addr.IP.String(), -1)
+		dht.removeByAddr(addr)
+	}
+}
+
+// allowPacket returns whether the packet from addr should be handled.
+func (dht *DHT) allowPacket(addr *net.UDPAddr) bool {
+	ok, block := dht.ipLimiter.allowPacket(addr.IP.String(), dht.clock.Now())
+	if !ok {
+		dht.rateLimited(addr, limitPacket, block)
+	}
+	return ok
+}
+
+// allowQuery returns whether the query of type q from addr should be
+// handled.
+func (dht *DHT) allowQuery(addr *net.UDPAddr, q string) bool {
+	ok, block := dht.ipLimiter.allowQuery(addr.IP.String(), q,
+		dht.clock.Now())
+	if !ok {
+		dht.rateLimited(addr, metricQueryType(q), block)
+	}
+	return ok
+}
+
+// WithRateLimits sets IPRateLimit, QueryRateLimit and OutboundRateLimit.
+func WithRateLimits(ip, query, outbound RateLimit) Option {
+	return func(config *Config) {
+		config.IPRateLimit = ip
+		config.QueryRateLimit = query
+		config.OutboundRateLimit = outbound
+	}
+}
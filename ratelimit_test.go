@@ -0,0 +1,239 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	var b tokenBucket
+	for i := 0; i < limit.Burst; i++ {
+		if !b.take(now, limit) {
+			t.Fatal("burst", i)
+		}
+	}
+	if b.take(now, limit) {
+		t.Error("over burst")
+	}
+	// 每秒2个
+	if !b.take(now.Add(time.Millisecond*500), limit) {
+		t.Error("not refilled")
+	}
+	// 不会超过 Burst
+	now = now.Add(time.Hour)
+	for i := 0; i < limit.Burst; i++ {
+		b.take(now, limit)
+	}
+	if b.take(now, limit) {
+		t.Error("refilled over burst")
+	}
+
+	var r tokenBucket
+	for i := 0; i < limit.Burst; i++ {
+		if d := r.reserve(now, limit); d != 0 {
+			t.Fatal("burst", i, d)
+		}
+	}
+	if d := r.reserve(now, limit); d != time.Millisecond*500 {
+		t.Error(d)
+	}
+	if d := r.reserve(now, limit); d != time.Second {
+		t.Error(d)
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	l := newIPLimiter(RateLimit{Rate: 1, Burst: 1},
+		RateLimit{Rate: 1, Burst: 1}, 3)
+	now := time.Now()
+
+	if ok, _ := l.allowPacket("1.2.3.4", now); !ok {
+		t.Fatal("first packet")
+	}
+	if ok, block := l.allowPacket("1.2.3.4", now); ok || block {
+		t.Error("second packet", ok, block)
+	}
+	if ok, _ := l.allowPacket("5.6.7.8", now); !ok {
+		t.Error("other ip")
+	}
+
+	// 每种查询分开计算
+	if ok, _ := l.allowQuery("1.2.3.4", pingType, now); !ok {
+		t.Error("ping")
+	}
+	if ok, _ := l.allowQuery("1.2.3.4", findNodeType, now); !ok {
+		t.Error("find_node")
+	}
+	if ok, block := l.allowQuery("1.2.3.4", pingType, now); ok || block {
+		t.Error("second strike", ok, block)
+	}
+	if ok, block := l.allowQuery("1.2.3.4", findNodeType, now); ok || !block {
+		t.Error("third strike", ok, block)
+	}
+	if _, ok := l.ips["1.2.3.4"]; ok {
+		t.Error("blocked ip is kept")
+	}
+
+	// 未知的查询类型共用一个桶
+	l.allowQuery("5.6.7.8", "foo", now)
+	if ok, _ := l.allowQuery("5.6.7.8", "bar", now); ok ||
+		len(l.ips["5.6.7.8"].queries) != 1 {
+		t.Error("unknown query types", ok, len(l.ips["5.6.7.8"].queries))
+	}
+
+	l.clean(now.Add(rateLimitIdle - time.Second))
+	if len(l.ips) != 1 {
+		t.Error("cleaned early", len(l.ips))
+	}
+	l.clean(now.Add(rateLimitIdle))
+	if len(l.ips) != 0 {
+		t.Error("not cleaned", len(l.ips))
+	}
+
+	off := newIPLimiter(RateLimit{}, RateLimit{}, 1)
+	for i := 0; i < 10; i++ {
+		if ok, _ := off.allowPacket("1.2.3.4", now); !ok {
+			t.Fatal("disabled limit")
+		}
+	}
+}
+
+func TestIPLimiterFull(t *testing.T) {
+	l := newIPLimiter(RateLimit{Rate: 1, Burst: 1}, RateLimit{}, 0)
+	now := time.Now()
+	ip := func(i int) string {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String()
+	}
+
+	for i := 0; i < maxRateLimitedIPs; i++ {
+		l.allowPacket(ip(i), now.Add(time.Duration(i)))
+	}
+	// 第一个ip又来了数据包，最久的变成第二个
+	now = now.Add(maxRateLimitedIPs)
+	if ok, _ := l.allowPacket(ip(0), now); ok {
+		t.Error("ip 0 is not limited")
+	}
+
+	// 满了以后新的ip照样限制，丢掉最久的
+	if ok, _ := l.allowPacket("1.2.3.4", now); !ok {
+		t.Error("first packet")
+	}
+	if ok, _ := l.allowPacket("1.2.3.4", now); ok {
+		t.Error("new ip is not limited when it's full")
+	}
+	if _, ok := l.ips[ip(1)]; ok || len(l.ips) != maxRateLimitedIPs ||
+		l.lru.Len() != maxRateLimitedIPs {
+		t.Error("least recent ip is kept", len(l.ips), l.lru.Len())
+	}
+	if _, ok := l.ips[ip(0)]; !ok {
+		t.Error("recent ip is dropped")
+	}
+
+	l.clean(now.Add(rateLimitIdle))
+	if len(l.ips) != 0 || l.lru.Len() != 0 {
+		t.Error("not cleaned", len(l.ips), l.lru.Len())
+	}
+}
+
+func TestOutboundLimiter(t *testing.T) {
+	l := &outboundLimiter{limit: RateLimit{Rate: 10, Burst: 1}}
+	now := time.Now()
+	if d := l.wait(now); d != 0 {
+		t.Error(d)
+	}
+	if d := l.wait(now); d != time.Millisecond*100 {
+		t.Error(d)
+	}
+
+	off := &outboundLimiter{}
+	if d := off.wait(now); d != 0 {
+		t.Error(d)
+	}
+}
+
+func TestRateLimitBlacklist(t *testing.T) {
+	config := newTestConfig()
+	config.IPRateLimit = RateLimit{Rate: 0.1, Burst: 2}
+	config.RateLimitStrikes = 3
+	d, conn := startQuerier(t, config)
+	defer d.Stop()
+	defer conn.Close()
+
+	events := d.Subscribe(EventBlacklisted)
+	defer d.Unsubscribe(events)
+
+	id := randomString(20)
+	for i := 0; i < 2; i++ {
+		if resp := queryFrom(t, conn, d, pingType,
+			map[string]interface{}{"id": id}, false); resp == nil {
+			t.Fatal("ping", i)
+		}
+	}
+	// 第3次超限就加入黑名单
+	for i := 0; i < 3; i++ {
+		if resp := queryFrom(t, conn, d, pingType,
+			map[string]interface{}{"id": id}, false); resp != nil {
+			t.Error("not limited", i, resp)
+		}
+	}
+
+	if e, ok := waitEvent(t, events, EventBlacklisted).(BlacklistedEvent); !ok ||
+		e.IP != "127.0.0.1" || e.Port != -1 {
+		t.Error(e)
+	}
+	if !d.blackList.in("127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port) {
+		t.Error("not blacklisted")
+	}
+	m := d.Metrics()
+	if m.RateLimited[limitPacket] != 3 || m.RateLimitBlocked != 1 {
+		t.Error(m.RateLimited, m.RateLimitBlocked)
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	config := newTestConfig()
+	config.QueryRateLimit = RateLimit{Rate: 0.1, Burst: 1}
+	d, conn := startQuerier(t, config)
+	defer d.Stop()
+	defer conn.Close()
+
+	id := randomString(20)
+	if resp := queryFrom(t, conn, d, pingType,
+		map[string]interface{}{"id": id}, false); resp == nil {
+		t.Fatal("ping")
+	}
+	if resp := queryFrom(t, conn, d, pingType,
+		map[string]interface{}{"id": id}, false); resp != nil {
+		t.Error("ping is not limited", resp)
+	}
+	if resp := queryFrom(t, conn, d, findNodeType, map[string]interface{}{
+		"id": id, "target": randomString(20)}, false); resp == nil {
+		t.Error("find_node is limited")
+	}
+	if n := d.Metrics().RateLimited[pingType]; n != 1 {
+		t.Error("limited", n)
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	config := NewStandardConfig(WithRateLimits(RateLimit{Rate: 1},
+		RateLimit{Rate: -1, Burst: 1}, RateLimit{}))
+	config.RateLimitStrikes = -1
+	errs, _ := config.Validate().(ConfigErrors)
+	for _, field := range []string{"IPRateLimit", "QueryRateLimit",
+		"RateLimitStrikes"} {
+		if !errs.Has(field) {
+			t.Error(field, errs)
+		}
+	}
+	if errs.Has("OutboundRateLimit") {
+		t.Error(errs)
+	}
+	if l := NewCrawlConfig().OutboundRateLimit; l.enabled() {
+		t.Error("crawl mode", l)
+	}
+}
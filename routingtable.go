@@ -28,7 +28,7 @@ type node struct {
 func newNode(id, network, address string) (*node, error) {
 	// id = id[:20]
 	if len(id) != 20 {
-		return nil, errors.New("node id should be a 20-length string")
+		return nil, &NodeIDError{id, "should be a 20-length string"}
 	}
 	addr, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
@@ -39,14 +39,18 @@ func newNode(id, network, address string) (*node, error) {
 }
 
 // newNodeFromCompactInfo parses compactNodeInfo and returns a node pointer.
-// compactNodeInfo 长度必须为26 byte
+// compactNodeInfo 长度必须为26 byte，ipv6为38 byte
 // 前20 byte将拆分为id
-// 后6byte 将拆分为 ip & port
-func newNodeFromCompactInfo(
-	compactNodeInfo string, network string) (*node, error) {
-
-	if len(compactNodeInfo) != 26 {
-		return nil, errors.New("compactNodeInfo should be a 26-length string")
+// 后6byte（ipv6为18byte） 将拆分为 ip & port
+func newNodeFromCompactInfo(compactNodeInfo string) (*node, error) {
+	network := "udp4"
+	switch len(compactNodeInfo) {
+	case compactNodeInfoLen:
+	case compactNodeInfo6Len:
+		network = "udp6"
+	default:
+		return nil, errors.New(
+			"compactNodeInfo should be a 26 or 38-length string")
 	}
 
 	id := compactNodeInfo[:20]
@@ -81,8 +85,10 @@ Peer represents a peer contact.
 每个peer有：ip、port、token
 */
 type Peer struct {
-	IP    net.IP
-	Port  int
+	IP   net.IP
+	Port int
+	// Seed is whether the peer announces with seed=1, see BEP 33
+	Seed  bool
 	token string
 }
 
@@ -99,7 +105,7 @@ func newPeer(ip net.IP, port int, token string) *Peer {
 
 /*
 newPeerFromCompactIPPortInfo create a peer pointer by compact ip/port info.
-compactInfo 长度为6，包含ip和port信息，也就是不支持ipv6
+compactInfo 长度为6，包含ip和port信息，ipv6长度为18
 */
 func newPeerFromCompactIPPortInfo(compactInfo, token string) (*Peer, error) {
 	ip, port, err := decodeCompactIPPortInfo(compactInfo)
@@ -131,6 +137,10 @@ type peersManager struct {
 	sync.RWMutex
 	table *syncedMap
 	dht   *DHT
+	// BEP 51
+	samples infoHashSample
+	// BEP 33, *scrapeFilters keyed by infohash, the oldest first
+	scrapes *keyedDeque
 }
 
 /*
@@ -140,8 +150,9 @@ newPeersManager returns a new peersManager.
 */
 func newPeersManager(dht *DHT) *peersManager {
 	return &peersManager{
-		table: newSyncedMap(),
-		dht:   dht,
+		table:   newSyncedMap(),
+		dht:     dht,
+		scrapes: newKeyedDeque(),
 	}
 }
 
@@ -190,15 +201,17 @@ type kbucket struct {
 	nodes, candidates *keyedDeque
 	lastChanged       time.Time
 	prefix            *bitmap
+	clock             clock
 }
 
 // newKBucket returns a new kbucket pointer.
-func newKBucket(prefix *bitmap) *kbucket {
+func newKBucket(prefix *bitmap, c clock) *kbucket {
 	bucket := &kbucket{
 		nodes:       newKeyedDeque(),
 		candidates:  newKeyedDeque(),
-		lastChanged: time.Now(),
+		lastChanged: c.Now(),
 		prefix:      prefix,
+		clock:       c,
 	}
 	return bucket
 }
@@ -226,7 +239,7 @@ func (bucket *kbucket) UpdateTimestamp() {
 	bucket.Lock()
 	defer bucket.Unlock()
 
-	bucket.lastChanged = time.Now()
+	bucket.lastChanged = bucket.clock.Now()
 }
 
 // Insert inserts node to the bucket. It returns whether the node is new in
@@ -241,33 +254,32 @@ func (bucket *kbucket) Insert(no *node) bool {
 }
 
 /*
-Replace removes node, then put bucket.candidates.Back() to the right
-place of bucket.nodes.
-不管节点是否存在，都做一次删除，在何时时间位置插入
+Replace removes node, then puts bucket.candidates.Back() to bucket.nodes. With
+preferSecure the last candidate with a BEP 42 secure id is taken before the
+insecure ones. It returns the promoted candidate, or nil.
+不管节点是否存在，都做一次删除
 */
-func (bucket *kbucket) Replace(no *node) {
+func (bucket *kbucket) Replace(no *node, preferSecure bool) *node {
 	bucket.nodes.Delete(no.id.RawString())
 	bucket.UpdateTimestamp()
 
 	if bucket.candidates.Len() == 0 {
-		return
+		return nil
 	}
 
-	no = bucket.candidates.Remove(bucket.candidates.Back()).(*node)
-
-	inserted := false
-	for e := range bucket.nodes.Iter() {
-		if e.Value.(*node).lastActiveTime.After(
-			no.lastActiveTime) && !inserted {
-
-			bucket.nodes.InsertBefore(no, e)
-			inserted = true
+	promoted := bucket.candidates.Back()
+	if preferSecure {
+		// Iter 要遍历完，中途退出会一直占着读锁
+		for e := range bucket.candidates.Iter() {
+			if e.Value.(*node).isSecure() {
+				promoted = e
+			}
 		}
 	}
 
-	if !inserted {
-		bucket.nodes.PushBack(no)
-	}
+	no = bucket.candidates.Remove(promoted).(*node)
+	bucket.nodes.Push(no.id.RawString(), no)
+	return no
 }
 
 /*
@@ -275,9 +287,10 @@ ping所有节点，确保只留下活跃的节点
 Fresh pings the expired nodes in the bucket.
 */
 func (bucket *kbucket) Fresh(dht *DHT) {
+	now := dht.clock.Now()
 	for e := range bucket.nodes.Iter() {
 		no := e.Value.(*node)
-		if time.Since(no.lastActiveTime) > dht.NodeExpriedAfter {
+		if now.Sub(no.lastActiveTime) > dht.NodeExpriedAfter {
 			dht.transactionManager.ping(no)
 		}
 	}
@@ -291,10 +304,10 @@ type routingTableNode struct {
 }
 
 // newRoutingTableNode returns a new routingTableNode pointer.
-func newRoutingTableNode(prefix *bitmap) *routingTableNode {
+func newRoutingTableNode(prefix *bitmap, c clock) *routingTableNode {
 	return &routingTableNode{
 		children: make([]*routingTableNode, 2),
-		bucket:   newKBucket(prefix),
+		bucket:   newKBucket(prefix, c),
 	}
 }
 
@@ -345,7 +358,7 @@ func (tableNode *routingTableNode) Split() {
 
 	for i := 0; i < 2; i++ {
 		tableNode.SetChild(i, newRoutingTableNode(newBitmapFrom(
-			tableNode.KBucket().prefix, prefixLen+1)))
+			tableNode.KBucket().prefix, prefixLen+1), tableNode.KBucket().clock))
 	}
 
 	tableNode.Lock()
@@ -354,12 +367,14 @@ func (tableNode *routingTableNode) Split() {
 
 	for e := range tableNode.KBucket().nodes.Iter() {
 		nd := e.Value.(*node)
-		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().nodes.PushBack(nd)
+		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().nodes.Push(
+			nd.id.RawString(), nd)
 	}
 
 	for e := range tableNode.KBucket().candidates.Iter() {
 		nd := e.Value.(*node)
-		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().candidates.PushBack(nd)
+		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().candidates.Push(
+			nd.id.RawString(), nd)
 	}
 
 	for i := 0; i < 2; i++ {
@@ -376,11 +391,13 @@ type routingTable struct {
 	cachedKBuckets *keyedDeque
 	dht            *DHT
 	clearQueue     *syncedList
+	// nodes without BEP 42 compliant ids, tracked for PreferSecureNodeID
+	insecureNodes *syncedMap
 }
 
 // newRoutingTable returns a new routingTable pointer.
 func newRoutingTable(k int, dht *DHT) *routingTable {
-	root := newRoutingTableNode(newBitmap(0))
+	root := newRoutingTableNode(newBitmap(0), dht.clock)
 
 	rt := &routingTable{
 		RWMutex:        &sync.RWMutex{},
@@ -390,6 +407,7 @@ func newRoutingTable(k int, dht *DHT) *routingTable {
 		cachedKBuckets: newKeyedDeque(),
 		dht:            dht,
 		clearQueue:     newSyncedList(),
+		insecureNodes:  newSyncedMap(),
 	}
 
 	rt.cachedKBuckets.Push(root.bucket.prefix.String(), root.bucket)
@@ -403,7 +421,19 @@ func (rt *routingTable) Insert(nd *node) bool {
 	defer rt.Unlock()
 
 	if rt.dht.blackList.in(nd.addr.IP.String(), nd.addr.Port) ||
-		rt.cachedNodes.Len() >= rt.dht.MaxNodes {
+		rt.dht.isBogon(nd.addr.IP) {
+		return false
+	}
+
+	// BEP 42
+	secure := rt.dht.NodeIDPolicy == AcceptAnyNodeID || nd.isSecure()
+	if !secure && rt.dht.NodeIDPolicy == RequireSecureNodeID {
+		return false
+	}
+
+	// 路由表满了，PreferSecureNodeID 时安全的节点替换掉不安全的节点
+	if rt.cachedNodes.Len() >= rt.dht.MaxNodes &&
+		!(secure && rt.evictInsecure()) {
 		return false
 	}
 
@@ -420,13 +450,17 @@ func (rt *routingTable) Insert(nd *node) bool {
 			// If next is not the leaf.
 			root = next
 		} else if root.KBucket().nodes.Len() < rt.k ||
-			root.KBucket().nodes.HasKey(nd.id.RawString()) {
+			root.KBucket().nodes.HasKey(nd.id.RawString()) ||
+			(secure && rt.evictInsecureFrom(root.KBucket())) {
+			// 桶满了，PreferSecureNodeID 时安全的节点替换掉桶里不安全的节点
 
 			bucket = root.KBucket()
 			isNew := bucket.Insert(nd)
-
-			rt.cachedNodes.Set(nd.addr.String(), nd)
-			rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+			rt.track(bucket, nd)
+			if isNew {
+				rt.dht.events.publish(NodeAddedEvent{
+					ID: rawNodeID(nd.id.RawString()), Addr: nd.addr})
+			}
 
 			return isNew
 		} else if root.KBucket().prefix.Compare(nd.id, prefixLen-1) == 0 {
@@ -445,13 +479,14 @@ func (rt *routingTable) Insert(nd *node) bool {
 			root = root.Child(nd.id.Bit(prefixLen - 1))
 		} else {
 			// Finally, store node as a candidate and fresh the bucket.
-			root.KBucket().candidates.PushBack(nd)
+			root.KBucket().candidates.Push(nd.id.RawString(), nd)
 			if root.KBucket().candidates.Len() > rt.k {
 				root.KBucket().candidates.Remove(
 					root.KBucket().candidates.Front())
 			}
 
-			go root.KBucket().Fresh(rt.dht)
+			bucket = root.KBucket()
+			rt.dht.spawn(func() { bucket.Fresh(rt.dht) })
 			return false
 		}
 	}
@@ -491,6 +526,84 @@ func (rt *routingTable) GetNeighborCompactInfos(id *bitmap, size int) []string {
 	return infos
 }
 
+/*
+evictInsecure removes a node without BEP 42 compliant id to make room for a
+secure one. It returns false when NodeIDPolicy isn't PreferSecureNodeID or
+there is no such node. rt must be locked.
+*/
+func (rt *routingTable) evictInsecure() bool {
+	if rt.dht.NodeIDPolicy != PreferSecureNodeID {
+		return false
+	}
+
+	var old *node
+	rt.insecureNodes.RLock()
+	for _, v := range rt.insecureNodes.data {
+		old = v.(*node)
+		break
+	}
+	rt.insecureNodes.RUnlock()
+
+	if old == nil {
+		return false
+	}
+
+	if nd, bucket := rt.getNodeKBucktByID(old.id); nd != nil {
+		rt.evict(bucket, nd)
+	} else {
+		rt.insecureNodes.Delete(old.addr.String())
+		rt.cachedNodes.Delete(old.addr.String())
+		rt.dht.events.publish(NodeEvictedEvent{
+			ID: rawNodeID(old.id.RawString()), Addr: old.addr})
+	}
+	return true
+}
+
+/*
+evictInsecureFrom evicts a node without a BEP 42 secure id from the full
+bucket for PreferSecureNodeID, so that a secure node can take its place.
+*/
+func (rt *routingTable) evictInsecureFrom(bucket *kbucket) bool {
+	if rt.dht.NodeIDPolicy != PreferSecureNodeID {
+		return false
+	}
+
+	var old *node
+	// Iter 要遍历完，中途退出会一直占着读锁
+	for e := range bucket.nodes.Iter() {
+		if nd := e.Value.(*node); old == nil && !nd.isSecure() {
+			old = nd
+		}
+	}
+
+	if old == nil {
+		return false
+	}
+	rt.evict(bucket, old)
+	return true
+}
+
+// evict removes old from bucket without promoting a candidate.
+func (rt *routingTable) evict(bucket *kbucket, old *node) {
+	bucket.nodes.Delete(old.id.RawString())
+	bucket.UpdateTimestamp()
+
+	rt.insecureNodes.Delete(old.addr.String())
+	rt.cachedNodes.Delete(old.addr.String())
+	rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+	rt.dht.events.publish(NodeEvictedEvent{
+		ID: rawNodeID(old.id.RawString()), Addr: old.addr})
+}
+
+// track caches nd, which is in bucket now.
+func (rt *routingTable) track(bucket *kbucket, nd *node) {
+	rt.cachedNodes.Set(nd.addr.String(), nd)
+	rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+	if rt.dht.NodeIDPolicy != AcceptAnyNodeID && !nd.isSecure() {
+		rt.insecureNodes.Set(nd.addr.String(), nd)
+	}
+}
+
 // GetNodeKBucktById returns node whose id is `id` and the bucket it
 // belongs to.
 func (rt *routingTable) GetNodeKBucktByID(id *bitmap) (
@@ -499,6 +612,13 @@ func (rt *routingTable) GetNodeKBucktByID(id *bitmap) (
 	rt.RLock()
 	defer rt.RUnlock()
 
+	return rt.getNodeKBucktByID(id)
+}
+
+// getNodeKBucktByID is GetNodeKBucktByID without lock.
+func (rt *routingTable) getNodeKBucktByID(id *bitmap) (
+	nd *node, bucket *kbucket) {
+
 	var next *routingTableNode
 	root := rt.root
 
@@ -532,9 +652,23 @@ func (rt *routingTable) GetNodeByAddress(address string) (no *node, ok bool) {
 // Remove deletes the node whose id is `id`.
 func (rt *routingTable) Remove(id *bitmap) {
 	if nd, bucket := rt.GetNodeKBucktByID(id); nd != nil {
-		bucket.Replace(nd)
 		rt.cachedNodes.Delete(nd.addr.String())
-		rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+		rt.insecureNodes.Delete(nd.addr.String())
+		promoted := bucket.Replace(nd,
+			rt.dht.NodeIDPolicy == PreferSecureNodeID)
+		if promoted != nil {
+			rt.track(bucket, promoted)
+		} else {
+			rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+		}
+		rt.dht.events.publish(NodeEvictedEvent{
+			ID: rawNodeID(nd.id.RawString()), Addr: nd.addr})
+
+		// 候选节点补进桶里也是新加入的节点
+		if promoted != nil {
+			rt.dht.events.publish(NodeAddedEvent{
+				ID: rawNodeID(promoted.id.RawString()), Addr: promoted.addr})
+		}
 	}
 }
 
@@ -550,7 +684,7 @@ func (rt *routingTable) RemoveByAddr(address string) {
 Fresh sends findNode to all nodes in the expired nodes.
 */
 func (rt *routingTable) Fresh() {
-	now := time.Now()
+	now := rt.dht.clock.Now()
 
 	for e := range rt.cachedKBuckets.Iter() {
 		bucket := e.Value.(*kbucket)
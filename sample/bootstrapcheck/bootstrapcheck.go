@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hktalent/dht"
+)
+
+/*
+检查 dhTrackers.txt 中的节点，只保留回应的 DHT 节点和 UDP tracker，去重后写回
+
+	go run ./sample/bootstrapcheck -in dhTrackers.txt -out dhTrackers.txt
+*/
+func main() {
+	in := flag.String("in", "dhTrackers.txt", "candidates, ip:port or udp://host:port/announce per line")
+	out := flag.String("out", "dhTrackers.txt", "file the alive candidates are written to")
+	timeout := flag.Duration("timeout", time.Second*3, "how long to wait for each candidate")
+	workers := flag.Int("workers", 256, "how many candidates are probed at the same time")
+	flag.Parse()
+
+	var candidates []string
+	for _, file := range append([]string{*in}, flag.Args()...) {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lines, err := dht.ReadBootstrapCandidates(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		candidates = append(candidates, lines...)
+	}
+
+	checks := dht.CheckBootstrapNodes(context.Background(), candidates,
+		*timeout, *workers)
+
+	count := make(map[dht.BootstrapKind]int)
+	for _, check := range checks {
+		count[check.Kind]++
+	}
+	fmt.Printf("%d candidates, %d unique: %d dht, %d tracker, %d dead\n",
+		len(candidates), len(checks), count[dht.BootstrapDHTNode],
+		count[dht.BootstrapUDPTracker], count[dht.BootstrapDead])
+
+	buf := &bytes.Buffer{}
+	if err := dht.WriteBootstrapList(buf, checks); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -9,27 +10,27 @@ import (
 )
 
 func main() {
-	d := dht.New(nil)
-	d.OnGetPeersResponse = func(infoHash string, peer *dht.Peer) {
-		fmt.Printf("GOT PEER: <%s:%d>\n", peer.IP, peer.Port)
+	d, err := dht.NewDHT(nil)
+	if err != nil {
+		log.Fatal(err)
 	}
+	if err := d.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer d.Stop()
 
-	go func() {
-		for {
-			// ubuntu-14.04.2-desktop-amd64.iso
-			err := d.GetPeers("546cf15f724d19c4319cc17b179d7e035f89c1f4")
-			if err != nil && err != dht.ErrNotReady {
-				log.Fatal(err)
-			}
-
-			if err == dht.ErrNotReady {
-				time.Sleep(time.Second * 1)
-				continue
-			}
+	// 等待加入DHT网络
+	time.Sleep(time.Second * 30)
 
-			break
-		}
-	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
 
-	d.Run()
+	// ubuntu-14.04.2-desktop-amd64.iso
+	peers, err := d.FindPeers(ctx, "546cf15f724d19c4319cc17b179d7e035f89c1f4")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for peer := range peers {
+		fmt.Printf("GOT PEER: <%s:%d>\n", peer.IP, peer.Port)
+	}
 }
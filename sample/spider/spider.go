@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"time"
@@ -125,9 +127,9 @@ func sendReq(data []byte, id string) {
 向相邻节点发起查询，发完就退出
 */
 func getMyPeer(d *dht.DHT) {
-	fmt.Println("getMyPeer " + d.LocalNodeId)
+	fmt.Println("getMyPeer " + dht.LocalNodeId)
 	for {
-		err := d.GetPeers(d.LocalNodeId)
+		err := d.GetPeers(dht.LocalNodeId)
 		// 有错误发生就继续循环，继续发送节点查询
 		if err != nil && err != dht.ErrNotReady {
 			fmt.Println(err)
@@ -148,6 +150,7 @@ func getMyPeer(d *dht.DHT) {
 func main() {
 	address = flag.String("address", ":6881", "random port :0")
 	resUrl = flag.String("resUrl", "", "Elasticsearch url, eg: http://127.0.0.1:9200/dht_index/_doc/")
+	blocklist := flag.String("blocklist", "", "ipfilter.dat or P2P blocklist, may be gzipped")
 	if "" == *resUrl {
 		//   = "http://127.0.0.1:9200/dht_index/_doc/"
 		// *resUrl = "http://127.0.0.1:9200/dht_index/_doc/"
@@ -212,37 +215,61 @@ func main() {
 	////////////////////////////////////////////////////////////////////////////////////////////
 
 	var d *dht.DHT
-	config := dht.NewCrawlConfig()
-	config.PacketWorkerLimit = 2560
-	// config.Address = dht.StunList{}.GetSelfPublicIpPort()
-	// fmt.Println(config.Address)
+	config := dht.NewCrawlConfig(
+		dht.WithPacketLimits(1024*10, 2560),
+		dht.WithPortRange(dht.DefaultPortRange[0], dht.DefaultPortRange[1]),
+		dht.WithPublicIPResolver(dht.StunList{}),
+	)
+	// 通过stun获得public ip，失败也不影响运行
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	if _, _, err := config.ResolvePublicIP(ctx); err != nil {
+		log.Println(err)
+	}
+	cancel()
 	if "" != *address {
 		config.Address = *address
 	}
-	// 发布的节点信息到来
-	config.OnAnnouncePeer = func(infoHash, ip string, port int) {
-		// 这里和爬虫建立管理
-		w.Request([]byte(infoHash), ip, port)
-		// sendReq([]byte(fmt.Sprintf("{\"ip\":\"%s\",\"port\":%d,\"type\":\"peer\"}", ip, port)), fmt.Sprintf("%s_%d", ip, port))
-		if infoHash == d.LocalNodeId && ip != d.Config.PublicIp {
-			fmt.Printf("找到 : %s:%d\n", ip, port)
-		}
-		// d.Join2addr(fmt.Sprintf("%s:%d", ip, port))
-	}
 	// fmt.Println("DHT tracer servers lists length : ", len(config.PrimeNodes))
-	d = dht.New(config)
-	// d.Mode = &dht.newNode(myPeerId, "", config.Address)
-	d.OnGetPeersResponse = func(infoHash string, peer *dht.Peer) {
-		if infoHash == d.LocalNodeId {
-			fmt.Printf("my private net: <%s:%d>\n", peer.IP, peer.Port)
-		} else if 0 < len(*resUrl) {
-			// sendReq([]byte(fmt.Sprintf("{\"ip\":\"%s\",\"port\":%d,\"type\":\"peer\"}", peer.IP, peer.Port)), fmt.Sprintf("%s_%d", peer.IP, peer.Port))
-			// fmt.Printf("OnGetPeersResponse peer info : %v:%d\n", peer.IP.String(), peer.Port)
+	var err error
+	if d, err = dht.NewDHT(config); err != nil {
+		log.Fatal(err)
+	}
+	// dht 和 wire 共用一份黑名单，文件变了自动重新加载
+	if "" != *blocklist {
+		list, err := dht.LoadBlocklist(*blocklist)
+		if err != nil {
+			log.Fatal(err)
 		}
+		d.AddBlocklist(list)
+		w.AddBlocklist(list)
+		go list.Watch(context.Background(), time.Minute)
 	}
+	// 运行统计: curl http://127.0.0.1:6060/metrics
+	http.Handle("/metrics", dht.MetricsHandler(d, w))
+	// 发布的节点信息到来、查到的peer，在单独的goroutine中处理，不阻塞数据包的处理
+	events := d.Subscribe(dht.EventAnnouncePeer, dht.EventPeerFound)
+	go func() {
+		for e := range events {
+			switch e := e.(type) {
+			case dht.AnnouncePeerEvent:
+				// 这里和爬虫建立管理
+				ip := e.Addr.IP.String()
+				w.Request([]byte(e.InfoHash), ip, e.Port)
+				if e.InfoHash == dht.LocalNodeId && ip != d.Config.PublicIp {
+					fmt.Printf("找到 : %s:%d\n", ip, e.Port)
+				}
+			case dht.PeerFoundEvent:
+				if e.InfoHash == dht.LocalNodeId {
+					fmt.Printf("my private net: <%s:%d>\n", e.Peer.IP, e.Peer.Port)
+				}
+			}
+		}
+	}()
 	// 告知相邻节点我有这个资源
-	d.AnnouncePeer(d.LocalNodeId)
+	d.AnnouncePeer(dht.LocalNodeId)
 	// go getMyPeer(d)
 	d.Log("wait join DHT net for 1 ~ 2 minute ...")
-	d.Run()
+	if err := d.RunContext(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 }
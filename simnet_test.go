@@ -0,0 +1,654 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+simNetwork is an in-memory udp network for the tests which run many dht
+nodes. Packets are delivered after latency and dropped with probability loss,
+the random source is seeded so that a failing run can be repeated. A conn
+behind NAT has a private LocalAddr, the others see its public address, and
+only the endpoints it has sent to can reach it.
+*/
+type simNetwork struct {
+	mu      sync.Mutex
+	conns   map[string]*simConn
+	rand    *rand.Rand
+	latency time.Duration
+	loss    float64
+	hosts   int
+}
+
+// newSimNetwork returns a network without loss.
+func newSimNetwork(seed int64, latency time.Duration) *simNetwork {
+	return &simNetwork{
+		conns:   make(map[string]*simConn),
+		rand:    rand.New(rand.NewSource(seed)),
+		latency: latency,
+	}
+}
+
+// setLoss changes the probability that a packet is dropped.
+func (sn *simNetwork) setLoss(loss float64) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.loss = loss
+}
+
+// listen returns a conn on a new host of 198.18.0.0/15, see RFC 2544.
+func (sn *simNetwork) listen(nat bool) *simConn {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.hosts++
+	c := &simConn{
+		network: sn,
+		public: &net.UDPAddr{
+			IP:   net.IPv4(198, 18, byte(sn.hosts/250), byte(sn.hosts%250+1)),
+			Port: 6881,
+		},
+		in:      make(chan simPacket, 1024),
+		wake:    make(chan struct{}),
+		queries: make(map[string]int),
+	}
+	c.local = c.public
+	if nat {
+		c.local = &net.UDPAddr{
+			IP:   net.IPv4(10, 0, byte(sn.hosts/250), byte(sn.hosts%250+1)),
+			Port: 6881,
+		}
+		c.contacted = make(map[string]bool)
+	}
+	sn.conns[c.public.String()] = c
+	return c
+}
+
+// deliver sends data from the conn from to the address to.
+func (sn *simNetwork) deliver(from *simConn, data []byte, to *net.UDPAddr) {
+	sn.mu.Lock()
+	dst, ok := sn.conns[to.String()]
+	lost := sn.loss > 0 && sn.rand.Float64() < sn.loss
+	latency := sn.latency
+	sn.mu.Unlock()
+
+	if !ok || lost || !dst.accept(from.public) {
+		return
+	}
+
+	pkt := simPacket{append([]byte(nil), data...), from.public}
+	if latency == 0 {
+		dst.push(pkt)
+		return
+	}
+	time.AfterFunc(latency, func() { dst.push(pkt) })
+}
+
+// simPacket is a packet on the way in simNetwork.
+type simPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// simConn is a net.PacketConn of simNetwork.
+type simConn struct {
+	network       *simNetwork
+	local, public *net.UDPAddr
+	in            chan simPacket
+
+	mu       sync.Mutex
+	deadline time.Time
+	// wake is closed when deadline changes or the conn is closed
+	wake   chan struct{}
+	closed bool
+	// 只有NAT后面的conn才有，发送过的地址才能进来
+	contacted map[string]bool
+	// queries counts the queries sent by type
+	queries map[string]int
+}
+
+// accept returns whether a packet from addr gets through the NAT.
+func (c *simConn) accept(addr *net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.closed && (c.contacted == nil || c.contacted[addr.String()])
+}
+
+// push puts pkt into the receive buffer, it's dropped when the buffer is full
+// like a real socket.
+func (c *simConn) push(pkt simPacket) {
+	select {
+	case c.in <- pkt:
+	default:
+	}
+}
+
+// sent returns how many queryType queries the conn has sent.
+func (c *simConn) sent(queryType string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queries[queryType]
+}
+
+// hasContacted returns whether the conn behind NAT has sent to addr.
+func (c *simConn) hasContacted(addr net.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.contacted[addr.String()]
+}
+
+func (c *simConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		closed, deadline, wake := c.closed, c.deadline, c.wake
+		c.mu.Unlock()
+
+		if closed {
+			return 0, nil, net.ErrClosed
+		}
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-c.in:
+			return copy(p, pkt.data), pkt.from, nil
+		case <-wake:
+		case <-timeout:
+		}
+	}
+}
+
+func (c *simConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	to, err := toUDPAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	var queryType string
+	if data, err := Decode(p); err == nil {
+		if msg, ok := data.(map[string]interface{}); ok && msg["y"] == "q" {
+			queryType, _ = msg["q"].(string)
+		}
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if c.contacted != nil {
+		c.contacted[to.String()] = true
+	}
+	if queryType != "" {
+		c.queries[queryType]++
+	}
+	c.mu.Unlock()
+
+	c.network.deliver(c, p, to)
+	return len(p), nil
+}
+
+func (c *simConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.wake)
+	}
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// fakeClock is a clock which only moves on Add.
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+// Add moves the clock forward by d.
+func (c *fakeClock) Add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// simCluster is the dht nodes running on a simNetwork with a shared fakeClock.
+type simCluster struct {
+	network *simNetwork
+	clock   *fakeClock
+	nodes   []*DHT
+	conns   map[*DHT]*simConn
+	primes  []string
+}
+
+/*
+startSimCluster starts n nodes on a new network, the first primes nodes are
+the prime nodes of all. The nodes are started one by one, each after the
+previous one joins, otherwise the prime nodes drop the packets of hundreds
+of nodes joining together. It returns once every node knows K nodes. The
+nodes are stopped when the test ends.
+*/
+func startSimCluster(t *testing.T, n, primes int) *simCluster {
+	c := &simCluster{
+		network: newSimNetwork(1, time.Millisecond*5),
+		clock:   newFakeClock(),
+		conns:   make(map[*DHT]*simConn),
+	}
+	t.Cleanup(c.stop)
+
+	conns := make([]*simConn, n)
+	for i := range conns {
+		conns[i] = c.network.listen(false)
+		if i < primes {
+			c.primes = append(c.primes, conns[i].public.String())
+		}
+	}
+	for i, conn := range conns {
+		d := c.start(t, conn)
+		// 丢包时 join 的find_node要等15秒后重发
+		deadline := time.Now().Add(time.Second * 40)
+		for i > 0 && d.tablesLen() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s can't join", conn.public)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	c.waitJoined(t)
+	c.settle()
+	return c
+}
+
+// start starts a node on conn which joins through the prime nodes.
+func (c *simCluster) start(t *testing.T, conn *simConn) *DHT {
+	config := newTestConfig().With(WithPacketConn(conn))
+	config.Address = conn.LocalAddr().String()
+	for _, addr := range c.primes {
+		if addr != conn.public.String() {
+			config.PrimeNodes = append(config.PrimeNodes, addr)
+		}
+	}
+
+	// 加入时包很多，默认的16个worker会丢包，-race 最多8128个goroutine
+	config.PacketWorkerLimit = 64
+	d := New(config)
+	d.clock = c.clock
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.nodes = append(c.nodes, d)
+	c.conns[d] = conn
+	return d
+}
+
+// waitJoined waits until every node knows K nodes, or all the others when
+// there are fewer.
+func (c *simCluster) waitJoined(t *testing.T) {
+	deadline := time.Now().Add(time.Second * 30)
+	for _, d := range c.nodes {
+		want := d.K
+		if len(c.nodes)-1 < want {
+			want = len(c.nodes) - 1
+		}
+		for d.tablesLen() < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s knows %d nodes", c.conns[d].public, d.tablesLen())
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+}
+
+// settle waits until the queries of joining stop, the lookups of the tests
+// are slow when the network is busy.
+func (c *simCluster) settle() {
+	sent := -1
+	for deadline := time.Now().Add(time.Second * 30); time.Now().Before(deadline); {
+		n := 0
+		for _, conn := range c.conns {
+			n += conn.sent(findNodeType)
+		}
+		if n == sent {
+			return
+		}
+		sent = n
+		time.Sleep(time.Millisecond * 500)
+	}
+}
+
+func (c *simCluster) stop() {
+	var wg sync.WaitGroup
+	for _, d := range c.nodes {
+		wg.Add(1)
+		go func(d *DHT) {
+			defer wg.Done()
+			d.Stop()
+		}(d)
+	}
+	wg.Wait()
+}
+
+// closest returns the ids of the k nodes closest to target in the cluster
+// except self.
+func (c *simCluster) closest(self *DHT, target string, k int) []string {
+	ids := make([]string, 0, len(c.nodes))
+	for _, d := range c.nodes {
+		if d != self {
+			ids = append(ids, d.node.id.RawString())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(xorDistance(ids[i], target),
+			xorDistance(ids[j], target)) < 0
+	})
+	if len(ids) > k {
+		ids = ids[:k]
+	}
+	return ids
+}
+
+// xorDistance returns the xor of two 20-length ids.
+func xorDistance(a, b string) []byte {
+	d := make([]byte, len(a))
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// overlap returns how many ids of nodes are in ids.
+func overlap(nodes []*node, ids []string) int {
+	n := 0
+	for _, no := range nodes {
+		for _, id := range ids {
+			if no.id.RawString() == id {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+/*
+assertLookup runs a find_node lookup from d towards target and fails the test
+when fewer than want of the K nodes responding are the true K closest.
+*/
+func (c *simCluster) assertLookup(t *testing.T, d *DHT, target string,
+	want int) {
+
+	t.Helper()
+
+	l := newLookup(d, findNodeType, target, map[string]interface{}{
+		"id":     d.id(target),
+		"target": target,
+	})
+	// -race 下几百个节点很慢，回应常常超过 lookupHopTimeout
+	l.hopTimeout = time.Second * 5
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	responses, err := l.run(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*node, len(responses))
+	for i, resp := range responses {
+		nodes[i] = resp.node
+	}
+	if n := overlap(nodes, c.closest(d, target, d.K)); n < want {
+		t.Errorf("lookup of %x finds %d of the %d closest", target, n, d.K)
+	}
+}
+
+/*
+assertAnnounce announces infoHash from announcer, then fails the test when
+the nodes accepting it are not the closest or finder can't find the peer.
+*/
+func (c *simCluster) assertAnnounce(t *testing.T, announcer, finder *DHT,
+	infoHash string, want int) {
+
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	results, err := announcer.Announce(ctx, infoHash, 6882, false)
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted []*node
+	for _, r := range results {
+		if r.Err == nil {
+			no, _ := newNode(string(r.ID[:]), "udp4", r.Addr.String())
+			accepted = append(accepted, no)
+		}
+	}
+	if n := overlap(accepted, c.closest(announcer, infoHash, announcer.K)); n < want {
+		t.Errorf("%d of the %d closest accept the announce", n, announcer.K)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	peers, err := finder.FindPeers(ctx, fmt.Sprintf("%x", infoHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := c.conns[announcer].public
+	found := false
+	for p := range peers {
+		found = found || p.IP.Equal(public.IP) && p.Port == 6882
+	}
+	if !found {
+		t.Error("announced peer is not found")
+	}
+}
+
+// simQuery sends a query from d to addr and returns the response or error
+// message, nil when there is none.
+func simQuery(d *DHT, addr *net.UDPAddr, queryType string,
+	a map[string]interface{}) map[string]interface{} {
+
+	ch := make(chan map[string]interface{}, 1)
+	d.transactionManager.sendQueryDone(&node{addr: addr}, queryType, a,
+		func(msg map[string]interface{}) { ch <- msg })
+	return <-ch
+}
+
+func TestSimLookupConvergence(t *testing.T) {
+	c := startSimCluster(t, 128, 4)
+
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 8; i++ {
+		d := c.nodes[r.Intn(len(c.nodes))]
+		c.assertLookup(t, d, randomString(20), d.K*3/4)
+	}
+
+	// 超时的查询会把节点加入黑名单，个别节点可能找不到
+	found := 0
+	for i := 0; i < 4; i++ {
+		d, other := c.nodes[i], c.nodes[r.Intn(len(c.nodes)-4)+4]
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		addr, err := d.FindNode(ctx, other.NodeID())
+		cancel()
+		if err == nil && addr.String() == c.conns[other].public.String() {
+			found++
+		}
+	}
+	if found < 3 {
+		t.Errorf("%d of 4 nodes are found", found)
+	}
+
+	c.assertAnnounce(t, c.nodes[5], c.nodes[100], randomString(20),
+		c.nodes[5].K/2)
+}
+
+func TestSimLoss(t *testing.T) {
+	c := startSimCluster(t, 64, 4)
+	c.network.setLoss(0.05)
+
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 2; i++ {
+		d := c.nodes[r.Intn(len(c.nodes))]
+		c.assertLookup(t, d, randomString(20), d.K/4)
+	}
+	c.assertAnnounce(t, c.nodes[10], c.nodes[40], randomString(20), 1)
+}
+
+func TestSimNAT(t *testing.T) {
+	c := startSimCluster(t, 32, 4)
+	conn := c.network.listen(true)
+	natted := c.start(t, conn)
+	c.waitJoined(t)
+	c.settle()
+
+	// 没有被NAT节点联系过的节点找不到它。联系过的节点可能在那之前就
+	// 向它发过find_node，还在等回应，这样的节点会跳过对它的查询
+	var stranger, friend *DHT
+	for _, d := range c.nodes[:len(c.nodes)-1] {
+		pending := d.transactionManager.getByIndex(
+			d.transactionManager.genIndexKey(findNodeType, conn.public.String()))
+		if !conn.hasContacted(c.conns[d].public) {
+			stranger = d
+		} else if pending == nil {
+			friend = d
+		}
+	}
+	if stranger == nil || friend == nil {
+		t.Fatal("every node is contacted or none is")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	if _, err := stranger.FindNode(ctx, natted.NodeID()); err != ErrNodeNotFound {
+		t.Error("node behind NAT is reached", err)
+	}
+	addr, err := friend.FindNode(ctx, natted.NodeID())
+	if err != nil || addr.String() != conn.public.String() {
+		t.Error(addr, err)
+	}
+}
+
+func TestSimTokenExpiry(t *testing.T) {
+	c := startSimCluster(t, 8, 2)
+	d, other := c.nodes[0], c.nodes[1]
+	addr := c.conns[other].public
+	infoHash := randomString(20)
+
+	getToken := func() string {
+		resp := simQuery(d, addr, getPeersType, d.getPeersArgs(infoHash))
+		r, _ := resp["r"].(map[string]interface{})
+		token, _ := r["token"].(string)
+		if token == "" {
+			t.Fatal("no token", resp)
+		}
+		return token
+	}
+	announce := func(token string) bool {
+		resp := simQuery(d, addr, announcePeerType, map[string]interface{}{
+			"id":        d.id(infoHash),
+			"info_hash": infoHash,
+			"port":      6882,
+			"token":     token,
+		})
+		if resp == nil {
+			t.Fatal("no response")
+		}
+		return resp["y"] == "r"
+	}
+
+	token := getToken()
+	// 上一个secret生成的token仍然有效
+	c.clock.Add(d.TokenExpiredAfter / 2)
+	if !announce(token) {
+		t.Error("token of the previous secret is refused")
+	}
+
+	c.clock.Add(d.TokenExpiredAfter)
+	if announce(token) {
+		t.Error("expired token is accepted")
+	}
+	if !announce(getToken()) {
+		t.Error("new token is refused")
+	}
+}
+
+func TestSimKBucketExpiry(t *testing.T) {
+	c := startSimCluster(t, 32, 4)
+	d := c.nodes[len(c.nodes)-1]
+	conn := c.conns[d]
+
+	c.clock.Add(d.KBucketExpiredAfter + time.Minute)
+	sent := conn.sent(findNodeType)
+	d.routingTable.Fresh()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for conn.sent(findNodeType)-sent < d.RefreshNodeNum {
+		if time.Now().After(deadline) {
+			t.Fatal("expired buckets are not refreshed",
+				conn.sent(findNodeType)-sent)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -1,12 +1,14 @@
 package dht
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
-	"net/url"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/multiformats/go-multiaddr"
 	"github.com/pion/stun"
@@ -60,16 +62,16 @@ func (r StunList) GetDhtListRawA() []string {
 	return strings.Split(strings.TrimSpace(string(bDhTrackers)), "\n")
 }
 
+// GetDhtUdpLists returns the DHT nodes in dhTrackers.txt, the udp://.../announce
+// entries are UDP trackers and skipped, see CheckBootstrapNodes.
 func (r StunList) GetDhtUdpLists() []string {
-	a := r.GetDhtList()
 	xR := []string{}
-	for _, x := range a {
-		if -1 < strings.Index(x, "udp://") {
-			u, err := url.Parse(x)
-			if err != nil {
-				continue
-			}
-			xR = append(xR, u.Host)
+	for _, x := range r.GetDhtListRawA() {
+		if -1 < strings.Index(x, "://") {
+			continue
+		}
+		if addr, ok := ParseBootstrapCandidate(x); ok {
+			xR = append(xR, addr)
 		}
 	}
 	return xR
@@ -133,91 +135,92 @@ func Log(a ...interface{}) {
 	// fmt.Println(a...)
 }
 
-// 获取本机NAT的public ip和port
+// 获取本机NAT的public ip和port，30秒内没有得到就返回空
 func (r StunList) GetSelfPublicIpPort() (string, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	ip, port, _ := r.PublicIP(ctx)
+	return ip, port
+}
+
+/*
+PublicIP implements PublicIPResolver, it asks all the stun servers at the
+same time and returns the first answer.
+失败的stun服务器会从列表中移除
+*/
+func (r StunList) PublicIP(ctx context.Context) (string, int, error) {
 	a := r.GetStunLists()
+	addrs := make(chan *stun.XORMappedAddress, len(a))
 
-	// len(a)
-	done := make(chan struct{}, len(a))
-	doneClose := make(chan bool)
-	ip := make(chan string, len(a))
-	var s, szIp string
 	var wg sync.WaitGroup
-	var doOnce sync.Once
-	for _, v1 := range a {
-		xxx1 := v1
-		done <- struct{}{}
+	for _, v := range a {
+		wg.Add(1)
 		go func(v string) {
-			wg.Add(1)
-			defer func() {
-				<-done
-				wg.Done()
-			}()
-			select {
-			case <-doneClose:
-				return
-			default:
-				{
-					c, err := stun.Dial("udp", v)
-					if err != nil {
-						rmIt(v)
-						Log("1", err, v)
-						return
-					}
-					defer c.Close()
-					message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-					if err := c.Do(message, func(res stun.Event) {
-						if res.Error != nil {
-							rmIt(v)
-							Log("2", res.Error, v)
-							return
-						}
-						var xorAddr stun.XORMappedAddress
-						if err := xorAddr.GetFrom(res.Message); err != nil {
-							rmIt(v)
-							Log("3", err, v)
-							return
-						}
-						sss := fmt.Sprintf("%s:%d", xorAddr.IP, xorAddr.Port)
-						ip <- sss
-						doOnce.Do(func() {
-							close(doneClose)
-							close(done)
-						})
-					}); err != nil {
-						rmIt(v)
-						Log("4", err, v)
+			defer wg.Done()
 
-					}
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "udp", v)
+			if err != nil {
+				if ctx.Err() == nil {
+					rmIt(v)
 				}
+				Log("1", err, v)
+				return
 			}
-		}(xxx1)
-	}
-	wg.Wait()
+			c, err := stun.NewClient(conn)
+			if err != nil {
+				conn.Close()
+				Log("1", err, v)
+				return
+			}
+			defer c.Close()
 
-	var port int
-	var err error
-	// tick1 := time.Tick(time.Duration(time.Second * 10))
-	select {
-	// case <-tick1:
-	// 	return szIp, port
-	case s = <-ip:
-		{
-			// close(ip)
-			// fmt.Println("close(doneClose) ...", len(done))
-			a1 := strings.Split(s, ":")
-			szIp = a1[0]
-			if 1 < len(a1) {
-				port, err = strconv.Atoi(a1[1])
+			// 不用 Do：它等不到 ctx 结束，client 关闭后也不返回。回应的
+			// Message 会被复用，在回调里解析
+			results := make(chan error, 1)
+			var xorAddr stun.XORMappedAddress
+			message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+			if err := c.Start(message, func(res stun.Event) {
+				err := res.Error
 				if err == nil {
+					err = xorAddr.GetFrom(res.Message)
 				}
+				results <- err
+			}); err != nil {
+				rmIt(v)
+				Log("4", err, v)
+				return
 			}
-			// close(done)
-			return szIp, port
+
+			select {
+			case err := <-results:
+				if err != nil {
+					rmIt(v)
+					Log("2", err, v)
+					return
+				}
+				addrs <- &xorAddr
+			case <-ctx.Done():
+				// 取消的不算服务器失败
+			}
+		}(v)
+	}
+
+	go func() {
+		wg.Wait()
+		close(addrs)
+	}()
+
+	select {
+	case addr, ok := <-addrs:
+		if !ok {
+			return "", 0, ErrNoPublicIP
 		}
+		return addr.IP.String(), addr.Port, nil
+	case <-ctx.Done():
+		return "", 0, ctx.Err()
 	}
-	// wg.Wait()
-	return szIp, port
 }
 
 func (r StunList) GetSelfPublicIpPort1() (string, int) {
@@ -0,0 +1,274 @@
+package dht
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+路由表持久化：停止时保存，启动时先ping保存的节点，回应的不够K个才通过
+PrimeNodes 加入，不用每次都从几百个 PrimeNodes 重新开始。
+The file is a bencoded dict:
+	{
+		"v": 1,
+		"id": <the id of the node which saves it>,
+		"buckets": [{
+			"prefix": <raw prefix of the kbucket>,
+			"bits": <prefix length>,
+			"nodes": [{"node": <compact node info>, "seen": <unix time>}, ...]
+		}, ...]
+	}
+*/
+
+const (
+	// routingTableVersion is the version of the routing table file format.
+	routingTableVersion = 1
+	// warmStartTimeout is how long Run waits for the saved nodes to answer
+	// before it joins through PrimeNodes.
+	warmStartTimeout = time.Second * 5
+)
+
+var (
+	// ErrRoutingTableVersion is returned by ImportRoutingTable when the file
+	// is written by a newer version.
+	ErrRoutingTableVersion = errors.New("dht: unsupported routing table version")
+
+	errInvalidRoutingTable = errors.New("dht: invalid routing table file")
+)
+
+/*
+ExportRoutingTable writes the id, address and last seen time of the nodes in
+the routing tables to w, bucket by bucket. It returns ErrNotReady when the
+dht has never been started.
+*/
+func (dht *DHT) ExportRoutingTable(w io.Writer) error {
+	if dht.routingTable == nil {
+		return ErrNotReady
+	}
+
+	buckets := make([]interface{}, 0)
+	for _, rt := range dht.tables() {
+		for e := range rt.cachedKBuckets.Iter() {
+			bucket := e.Value.(*kbucket)
+
+			nodes := make([]interface{}, 0, bucket.nodes.Len())
+			for e := range bucket.nodes.Iter() {
+				no := e.Value.(*node)
+				nodes = append(nodes, map[string]interface{}{
+					"node": no.CompactNodeInfo(),
+					"seen": int(no.lastActiveTime.Unix()),
+				})
+			}
+			if len(nodes) == 0 {
+				continue
+			}
+
+			buckets = append(buckets, map[string]interface{}{
+				"prefix": bucket.prefix.RawString(),
+				"bits":   bucket.prefix.Size,
+				"nodes":  nodes,
+			})
+		}
+	}
+
+	_, err := io.WriteString(w, Encode(map[string]interface{}{
+		"v":       routingTableVersion,
+		"id":      dht.node.id.RawString(),
+		"buckets": buckets,
+	}))
+	return err
+}
+
+/*
+ImportRoutingTable reads the nodes written by ExportRoutingTable and pings
+them, those answering are put into the routing table. Before the dht is
+started, they are pinged by Run instead of joining through PrimeNodes.
+*/
+func (dht *DHT) ImportRoutingTable(r io.Reader) error {
+	nodes, err := readRoutingTable(r)
+	if err != nil {
+		return err
+	}
+
+	dht.runMu.Lock()
+	running := dht.running
+	if !running {
+		dht.savedNodes = append(dht.savedNodes, nodes...)
+	}
+	dht.runMu.Unlock()
+
+	if running {
+		dht.spawn(func() { dht.pingNodes(nodes, len(nodes)) })
+	}
+	return nil
+}
+
+// readRoutingTable returns the nodes written by ExportRoutingTable, the most
+// recently seen first.
+func readRoutingTable(r io.Reader) ([]*node, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := Decode(data)
+	if err != nil {
+		return nil, errInvalidRoutingTable
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok || ParseKey(dict, "v", "int") != nil {
+		return nil, errInvalidRoutingTable
+	}
+	if dict["v"].(int) != routingTableVersion {
+		return nil, ErrRoutingTableVersion
+	}
+	if ParseKey(dict, "buckets", "list") != nil {
+		return nil, errInvalidRoutingTable
+	}
+
+	var nodes []*node
+	for _, b := range dict["buckets"].([]interface{}) {
+		bucket, ok := b.(map[string]interface{})
+		if !ok || ParseKey(bucket, "nodes", "list") != nil {
+			return nil, errInvalidRoutingTable
+		}
+
+		for _, n := range bucket["nodes"].([]interface{}) {
+			item, ok := n.(map[string]interface{})
+			if !ok || ParseKeys(item,
+				[][]string{{"node", "string"}, {"seen", "int"}}) != nil {
+				return nil, errInvalidRoutingTable
+			}
+
+			no, err := newNodeFromCompactInfo(item["node"].(string))
+			if err != nil {
+				return nil, errInvalidRoutingTable
+			}
+			no.lastActiveTime = time.Unix(int64(item["seen"].(int)), 0)
+			nodes = append(nodes, no)
+		}
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].lastActiveTime.After(nodes[j].lastActiveTime)
+	})
+	return nodes, nil
+}
+
+// loadRoutingTable returns the nodes imported before Run and those saved in
+// RoutingTableFile.
+func (dht *DHT) loadRoutingTable() []*node {
+	dht.runMu.Lock()
+	nodes := dht.savedNodes
+	dht.savedNodes = nil
+	dht.runMu.Unlock()
+
+	if dht.RoutingTableFile == "" {
+		return nodes
+	}
+
+	file, err := os.Open(dht.RoutingTableFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dht.Log("load routing table: ", err)
+		}
+		return nodes
+	}
+	defer file.Close()
+
+	saved, err := readRoutingTable(file)
+	if err != nil {
+		dht.Log("load routing table: ", err)
+	}
+	return append(nodes, saved...)
+}
+
+// saveRoutingTable writes the routing tables to RoutingTableFile if it is set.
+func (dht *DHT) saveRoutingTable() error {
+	if dht.RoutingTableFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dht.RoutingTableFile), 0755); err != nil {
+		return err
+	}
+
+	// 先写临时文件再改名，避免写一半的文件
+	tmp := dht.RoutingTableFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := dht.ExportRoutingTable(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dht.RoutingTableFile)
+}
+
+/*
+pingNodes pings nodes and returns how many of them answer. It returns once
+want of them answer, all of them finish or warmStartTimeout passes, the
+nodes answering later are still put into the routing table.
+*/
+func (dht *DHT) pingNodes(nodes []*node, want int) int {
+	answers := make(chan bool, len(nodes))
+	sent := 0
+	for _, no := range nodes {
+		if dht.table(no.addr.IP) == nil {
+			continue
+		}
+
+		sent++
+		dht.transactionManager.sendQueryDone(no, pingType,
+			map[string]interface{}{"id": dht.id(no.id.RawString())},
+			func(response map[string]interface{}) {
+				answers <- response != nil && response["y"] == "r"
+			})
+	}
+
+	timer := time.NewTimer(warmStartTimeout)
+	defer timer.Stop()
+
+	n := 0
+	for i := 0; i < sent && n < want; i++ {
+		select {
+		case ok := <-answers:
+			if ok {
+				n++
+			}
+		case <-timer.C:
+			return n
+		case <-dht.closing:
+			return n
+		}
+	}
+	return n
+}
+
+/*
+bootstrap joins the dht network. The saved nodes are pinged first, it joins
+through PrimeNodes only when fewer than K of them answer.
+*/
+func (dht *DHT) bootstrap() {
+	nodes := dht.loadRoutingTable()
+	if len(nodes) > 0 && dht.pingNodes(nodes, dht.K) >= dht.K {
+		return
+	}
+	dht.join()
+}
+
+// WithRoutingTableFile sets the file the routing table is saved to on Stop
+// and loaded from on Run.
+func WithRoutingTableFile(file string) Option {
+	return func(config *Config) {
+		config.RoutingTableFile = file
+	}
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoutingTableExport(t *testing.T) {
+	d := New(newTestConfig())
+	if err := d.ExportRoutingTable(&bytes.Buffer{}); err != ErrNotReady {
+		t.Error(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	seen := time.Unix(time.Now().Unix()-60, 0)
+	want := make(map[string]time.Time)
+	for i := 0; i < 20; i++ {
+		no, _ := newNode(randomString(20), "udp4", genAddress("1.2.3.4", 1000+i))
+		no.lastActiveTime = seen.Add(time.Duration(i) * time.Second)
+		if d.routingTable.Insert(no) {
+			want[no.CompactNodeInfo()] = no.lastActiveTime
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := d.ExportRoutingTable(buf); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := readRoutingTable(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != len(want) {
+		t.Fatal("nodes", len(nodes), len(want))
+	}
+	for i, no := range nodes {
+		if !want[no.CompactNodeInfo()].Equal(no.lastActiveTime) {
+			t.Error("last seen time", no.lastActiveTime)
+		}
+		if i > 0 && no.lastActiveTime.After(nodes[i-1].lastActiveTime) {
+			t.Error("not sorted by last seen time")
+		}
+	}
+
+	data := Encode(map[string]interface{}{
+		"v": routingTableVersion + 1, "buckets": make([]interface{}, 0)})
+	if _, err := readRoutingTable(bytes.NewBufferString(data)); err != ErrRoutingTableVersion {
+		t.Error(err)
+	}
+	if _, err := readRoutingTable(bytes.NewBufferString("d1:vi1ee")); err != errInvalidRoutingTable {
+		t.Error(err)
+	}
+}
+
+func TestWarmRestart(t *testing.T) {
+	peers := startTestChain(t, 2)
+	for _, p := range peers {
+		defer p.Stop()
+	}
+
+	// prime 从不回应，收到find_node说明在通过 PrimeNodes 加入
+	prime, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prime.Close()
+
+	config := newTestConfig().With(
+		WithRoutingTableFile(filepath.Join(t.TempDir(), "routing_table")))
+	config.K = 2
+	config.PrimeNodes = []string{prime.LocalAddr().String()}
+	d := New(config)
+	d.blackList.ClearAll()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		no, _ := newNode(p.node.id.RawString(), "udp4", p.Addr().String())
+		d.routingTable.Insert(no)
+	}
+	d.Stop()
+
+	// 保存的节点都回应，不再通过 PrimeNodes 加入
+	prime.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	for {
+		if _, _, err := prime.ReadFrom(make([]byte, 1024)); err != nil {
+			break
+		}
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; d.tablesLen() < 2; i++ {
+		if i == 100 {
+			t.Fatal("saved nodes are not restored", d.tablesLen())
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	prime.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := prime.ReadFrom(make([]byte, 1024)); err == nil {
+		t.Error("joins through PrimeNodes")
+	}
+	d.Stop()
+
+	// 保存的节点不回应时通过 PrimeNodes 加入
+	for _, p := range peers {
+		p.Stop()
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	prime.SetReadDeadline(time.Now().Add(warmStartTimeout + time.Second*5))
+	if _, _, err := prime.ReadFrom(make([]byte, 1024)); err != nil {
+		t.Error("doesn't join through PrimeNodes", err)
+	}
+}
@@ -1,5 +1,6 @@
+# 把节点学到的bootstrap节点合并到 dhTrackers.txt，参数是 Config.StateDir
 cat $HOME/chinaOk.txt|grep -E '[\d\.:]+' >>dhTrackers.txt
-cat $HOME/ips.txt|grep -E '[\d\.:]+' >>dhTrackers.txt
-cat dhTrackers.txt|sort -u|uniq > dhTrackers1.txt
-mv dhTrackers1.txt dhTrackers.txt
-rm -rf $HOME/chinaOk.txt  $HOME/ips.txt
+cut -d' ' -f1 ${1:-.}/bootstrap_nodes|grep -E '[\d\.:]+' >>dhTrackers.txt
+# 探测每个节点，去掉不回应的，DHT节点和UDP tracker分开写回
+go run ./sample/bootstrapcheck -in dhTrackers.txt -out dhTrackers.txt
+rm -rf $HOME/chinaOk.txt
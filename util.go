@@ -3,11 +3,8 @@ package dht
 import (
 	"crypto/rand"
 	"errors"
-	"io/ioutil"
 	"net"
-	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -56,15 +53,21 @@ func int2bytes(val uint64) []byte {
 decodeCompactIPPortInfo decodes compactIP-address/port info in BitTorrent
 DHT Protocol. It returns the ip and port number.
 info 长度必须为6： 前4 byte为ip地址，后2byte为uint64 port
+ipv6（BEP 32）长度为18：前16 byte为ip地址
 */
 func decodeCompactIPPortInfo(info string) (ip net.IP, port int, err error) {
-	if len(info) != 6 {
-		err = errors.New("compact info should be 6-length long")
+	switch len(info) {
+	case 6:
+		ip = net.IPv4(info[0], info[1], info[2], info[3])
+	case 18:
+		ip = net.IP([]byte(info[:16]))
+	default:
+		err = errors.New("compact info should be 6 or 18-length long")
 		return
 	}
 
-	ip = net.IPv4(info[0], info[1], info[2], info[3])
-	port = int((uint16(info[4]) << 8) | uint16(info[5]))
+	n := len(info)
+	port = int((uint16(info[n-2]) << 8) | uint16(info[n-1]))
 	return
 }
 
@@ -83,7 +86,12 @@ func encodeCompactIPPortInfo(ip net.IP, port int) (info string, err error) {
 		p[0] = 0
 	}
 
-	info = string(append(ip, p...))
+	// ipv4 may be stored in 16 bytes
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	info = string(append(append([]byte(nil), ip...), p...))
 	return
 }
 
@@ -109,42 +117,45 @@ func getLocalIPs() (ips []string) {
 	return
 }
 
-// getRemoteIP returns the wlan ip.
-// 通过
-// curl -H 'User-Agent:curl' http://ifconfig.me
-// 获取本机互联网ip地址
-// 缺点不通互联网的时候不准确
-// 其他方式可以通过webrtc来获得本地地址更加准确和方便
-// 这个方法有bug，切换vpn的时候，结果并没有发生变化
-func getRemoteIP() (ip string, err error) {
-	client := &http.Client{
-		Timeout: time.Second * 30,
-	}
+// genAddress returns a ip:port address, ipv6 is in brackets.
+func genAddress(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
 
-	req, err := http.NewRequest("GET", "http://ifconfig.me", nil)
-	if err != nil {
-		return
+// toUDPAddr returns addr as a *net.UDPAddr, other addresses are parsed from
+// their `ip:port` string.
+func toUDPAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr, nil
+	}
+	if addr == nil {
+		return nil, errors.New("nil address")
 	}
 
-	req.Header.Set("User-Agent", "curl")
-	req.Header.Set("Cache-Control", "no-cache")
-	res, err := client.Do(req)
+	host, port, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	defer res.Body.Close()
-
-	data, err := ioutil.ReadAll(res.Body)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid ip " + host)
+	}
+	p, err := strconv.Atoi(port)
 	if err != nil {
-		return
+		return nil, err
 	}
-	ip = string(data)
+	return &net.UDPAddr{IP: ip, Port: p}, nil
+}
 
-	return
+// clock tells the time of token and kbucket expiry, tests replace it with a
+// fake one.
+type clock interface {
+	Now() time.Time
 }
 
-// genAddress returns a ip:port address.
-func genAddress(ip string, port int) string {
-	return strings.Join([]string{ip, strconv.Itoa(port)}, ":")
+// realClock is the clock of time.Now.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
 }